@@ -9,6 +9,7 @@ require (
 	github.com/gorilla/websocket v1.4.1 // indirect
 	github.com/improbable-eng/grpc-web v0.13.0
 	github.com/jhump/protoreflect v1.7.0
+	github.com/klauspost/compress v1.11.13
 	github.com/mwitkow/go-conntrack v0.0.0-20190716064945-2f068394615f // indirect
 	github.com/pkg/errors v0.9.1
 	github.com/rs/cors v1.7.0 // indirect
@@ -16,5 +17,7 @@ require (
 	github.com/ssoor/certstrap v1.0.1
 	github.com/stretchr/testify v1.6.1
 	golang.org/x/net v0.0.0-20200226121028-0de0cce0169b
+	google.golang.org/genproto v0.0.0-20190819201941-24fa4b261c55
 	google.golang.org/grpc v1.26.0
+	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c
 )
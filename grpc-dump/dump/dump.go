@@ -1,37 +1,74 @@
 package dump
 
 import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
 	"github.com/bradleyjkemp/grpc-tools/grpc-proxy"
+	"github.com/bradleyjkemp/grpc-tools/internal"
 	"github.com/bradleyjkemp/grpc-tools/internal/proto_decoder"
 	"github.com/sirupsen/logrus"
-	"io"
-	"strings"
 )
 
-func Run(output io.Writer, protoRoots, protoDescriptors string, proxyConfig ...grpc_proxy.Configurator) error {
-	var resolvers []proto_decoder.MessageResolver
-	if protoRoots != "" {
-		r, err := proto_decoder.NewFileResolver(strings.Split(protoRoots, ",")...)
-		if err != nil {
-			return err
-		}
-		resolvers = append(resolvers, r)
-	}
-	if protoDescriptors != "" {
-		r, err := proto_decoder.NewDescriptorResolver(strings.Split(protoRoots, ",")...)
-		if err != nil {
-			return err
-		}
-		resolvers = append(resolvers, r)
-	}
+// Config holds the grpc-dump specific settings (see the grpc-dump flags for details).
+type Config struct {
+	ProtoRoots       string // comma separated
+	ProtoImportPaths string // comma separated
+	ProtoDescriptors string // comma separated
+	WatchProtos      bool   // reload the protos whenever they change
+	// comma separated list of key=message.Type pairs
+	// used to decode binary (-bin) metadata values
+	BinaryMetadataTypes string
+	// the file to write connection events to (disabled if empty)
+	ConnectionLog string
+}
+
+const protoWatchInterval = 2 * time.Second
 
+func Run(output io.Writer, config Config, proxyConfig ...grpc_proxy.Configurator) error {
+	binaryMetadataTypes, err := parseBinaryMetadataTypes(config.BinaryMetadataTypes)
+	if err != nil {
+		return err
+	}
 	// TODO: unify this logger with the one provided by grpc_proxy?
 	logger := logrus.New()
+	resolver, err := proto_decoder.NewReloadableResolver(logger, config.ProtoRoots, config.ProtoImportPaths, config.ProtoDescriptors)
+	if err != nil {
+		return err
+	}
+	if config.WatchProtos {
+		stopWatching := resolver.Watch(logger, protoWatchInterval)
+		defer stopWatching()
+	}
+
+	dumpWriter := internal.NewDumpWriter(output)
 	opts := append(
 		proxyConfig,
-		grpc_proxy.WithInterceptor(
-			dumpInterceptor(logger, output, proto_decoder.NewDecoder(logger, resolvers...))),
+		grpc_proxy.WithDecoder(proto_decoder.NewDecoder(logger, resolver)),
+		grpc_proxy.WithObserver(NewObserver(proto_decoder.NewBinaryMetadataDecoder(logger, binaryMetadataTypes), func(rpc *internal.RPC) {
+			if err := dumpWriter.Write(rpc); err != nil {
+				logger.WithError(err).Fatal("Failed to write rpc")
+			}
+		})),
+		grpc_proxy.WithAdminHandler("/reload_protos", reloadHandler(logger, resolver)),
 	)
+	if config.ConnectionLog != "" {
+		connectionLog, err := os.Create(config.ConnectionLog)
+		if err != nil {
+			return fmt.Errorf("failed to create connection log: %v", err)
+		}
+		defer connectionLog.Close()
+		connectionWriter := internal.NewConnectionEventWriter(connectionLog)
+		opts = append(opts, grpc_proxy.WithConnectionObserver(grpc_proxy.ConnectionObserverFunc(func(event *internal.ConnectionEvent) {
+			if err := connectionWriter.Write(event); err != nil {
+				logger.WithError(err).Warn("Failed to write connection event")
+			}
+		})))
+	}
 	proxy, err := grpc_proxy.New(
 		opts...,
 	)
@@ -41,3 +78,35 @@ func Run(output io.Writer, protoRoots, protoDescriptors string, proxyConfig ...g
 
 	return proxy.Start()
 }
+
+func parseBinaryMetadataTypes(types string) (map[string]string, error) {
+	parsed := map[string]string{}
+	for _, keyType := range strings.Split(types, ",") {
+		if keyType == "" {
+			continue
+		}
+		parts := strings.SplitN(keyType, "=", 2)
+		if len(parts) != 2 || !internal.IsBinaryMetadataKey(parts[0]) || parts[1] == "" {
+			return nil, fmt.Errorf("invalid binary metadata type %q: must be of the form key-bin=package.Message", keyType)
+		}
+		parsed[strings.ToLower(parts[0])] = parts[1]
+	}
+	return parsed, nil
+}
+
+// reloadHandler reparses all of the protos when it receives a POST request
+func reloadHandler(logger logrus.FieldLogger, resolver *proto_decoder.ReloadableResolver) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "reloading protos requires a POST request", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := resolver.Reload(); err != nil {
+			logger.WithError(err).Warn("Failed to reload protos")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logger.Info("Reloaded protos")
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
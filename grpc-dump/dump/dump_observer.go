@@ -0,0 +1,175 @@
+package dump
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bradleyjkemp/grpc-tools/grpc-proxy"
+	"github.com/bradleyjkemp/grpc-tools/internal"
+	"github.com/bradleyjkemp/grpc-tools/internal/proto_decoder"
+	"github.com/bradleyjkemp/grpc-tools/internal/proto_descriptor"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	"google.golang.org/grpc/metadata"
+)
+
+// dump observer implements a grpc_proxy.RPCObserver that records all RPC details
+
+type pbm struct {
+	*dynamic.Message
+}
+
+func (p *pbm) MarshalJSON() ([]byte, error) {
+	fd := make([]*desc.FileDescriptor, 0)
+	for _, d := range proto_descriptor.LoadedMessageTypes() {
+		fd = append(fd, d.GetFile())
+	}
+	return p.MarshalJSONPB(
+		&jsonpb.Marshaler{
+			AnyResolver: dynamic.AnyResolver(
+				dynamic.NewMessageFactoryWithDefaults(),
+				fd...,
+			),
+		})
+}
+
+type dumpObserver struct {
+	sync.Mutex
+	rpcs            map[*grpc_proxy.RPCInfo]*internal.RPC
+	metadataDecoder *proto_decoder.BinaryMetadataDecoder
+	onRPC           func(rpc *internal.RPC)
+}
+
+// NewObserver returns a grpc_proxy.RPCObserver that records the details
+// of each RPC and passes the completed RPC to onRPC.
+func NewObserver(metadataDecoder *proto_decoder.BinaryMetadataDecoder, onRPC func(rpc *internal.RPC)) grpc_proxy.RPCObserver {
+	return &dumpObserver{
+		rpcs:            map[*grpc_proxy.RPCInfo]*internal.RPC{},
+		metadataDecoder: metadataDecoder,
+		onRPC:           onRPC,
+	}
+}
+
+func (d *dumpObserver) rpc(info *grpc_proxy.RPCInfo) *internal.RPC {
+	d.Lock()
+	defer d.Unlock()
+	return d.rpcs[info]
+}
+
+func (d *dumpObserver) RPCStarted(info *grpc_proxy.RPCInfo) {
+	fullMethod := strings.Split(info.FullMethod, "/")
+	d.Lock()
+	defer d.Unlock()
+	rpc := &internal.RPC{
+		Service:  fullMethod[1],
+		Method:   fullMethod[2],
+		Metadata: info.Metadata,
+
+		RequestEncoding:  info.RequestEncoding,
+		ResponseEncoding: info.ResponseEncoding,
+		ProxyUser:        info.ProxyUser,
+		TLS:              info.TLS,
+		ConnectionID:     info.ConnectionID,
+	}
+	if !info.Deadline.IsZero() {
+		deadline := info.Deadline
+		rpc.Deadline = &deadline
+		rpc.Timeout = deadline.Sub(info.StartTime).String()
+	}
+	d.rpcs[info] = rpc
+}
+
+func (d *dumpObserver) MessageObserved(info *grpc_proxy.RPCInfo, message *internal.Message) {
+	rpc := d.rpc(info)
+	// copy the message so that other observers are unaffected by wrapping the decoded form
+	dumped := *message
+	if decoded, ok := message.Message.(*dynamic.Message); ok {
+		dumped.Message = &pbm{decoded}
+	}
+	rpc.Messages = append(rpc.Messages, &dumped)
+}
+
+func (d *dumpObserver) HeadersObserved(info *grpc_proxy.RPCInfo, headers metadata.MD) {
+	rpc := d.rpc(info)
+	rpc.MetadataRespHeaders = metadata.Join(rpc.MetadataRespHeaders, headers)
+}
+
+func (d *dumpObserver) TrailersObserved(info *grpc_proxy.RPCInfo, trailers metadata.MD) {
+	d.rpc(info).MetadataRespTrailers = trailers
+}
+
+func (d *dumpObserver) RPCFinished(info *grpc_proxy.RPCInfo, rpcErr error) {
+	d.Lock()
+	rpc := d.rpcs[info]
+	delete(d.rpcs, info)
+	d.Unlock()
+
+	d.decodeBinaryMetadata(rpc)
+	rpc.Timing = dumpTiming(info.Timing)
+	rpc.Status = proto_decoder.DecodeStatus(rpcErr)
+	if rpc.Status != nil {
+		for _, detail := range rpc.Status.Details {
+			if decoded, ok := detail.Value.(*dynamic.Message); ok {
+				detail.Value = &pbm{decoded}
+			}
+		}
+	}
+	d.onRPC(rpc)
+}
+
+// decodes the binary metadata values and then base64 encodes
+// them so that they survive being written to the dump
+func (d *dumpObserver) decodeBinaryMetadata(rpc *internal.RPC) {
+	sources := []struct {
+		source internal.MetadataSource
+		md     *metadata.MD
+	}{
+		{internal.RequestMetadata, &rpc.Metadata},
+		{internal.ResponseHeaders, &rpc.MetadataRespHeaders},
+		{internal.ResponseTrailers, &rpc.MetadataRespTrailers},
+	}
+	for _, s := range sources {
+		for _, decoded := range d.metadataDecoder.Decode(s.source, *s.md) {
+			if value, ok := decoded.Value.(*dynamic.Message); ok {
+				decoded.Value = &pbm{value}
+			}
+			rpc.BinaryMetadata = append(rpc.BinaryMetadata, decoded)
+		}
+		*s.md = internal.EncodeBinaryMetadata(*s.md)
+	}
+}
+
+func dumpTiming(timing grpc_proxy.RPCTiming) *internal.Timing {
+	optional := func(t time.Time) *time.Time {
+		if t.IsZero() {
+			return nil
+		}
+		return &t
+	}
+	since := func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Sub(timing.Received).String()
+	}
+	dumped := &internal.Timing{
+		Received:            timing.Received,
+		UpstreamConnected:   optional(timing.UpstreamConnected),
+		UpstreamRequestSent: optional(timing.UpstreamRequestSent),
+		FirstResponse:       optional(timing.FirstResponse),
+		UpstreamFinished:    optional(timing.UpstreamFinished),
+		LastMessage:         optional(timing.LastMessage),
+		Finished:            timing.Finished,
+
+		ConnectionAcquisition: since(timing.UpstreamConnected),
+		TimeToFirstResponse:   since(timing.FirstResponse),
+		ProxyOverhead:         timing.ProxyOverhead().String(),
+		Total:                 timing.Total().String(),
+	}
+	if upstreamLatency := timing.UpstreamLatency(); upstreamLatency > 0 {
+		dumped.UpstreamLatency = upstreamLatency.String()
+	}
+	return dumped
+}
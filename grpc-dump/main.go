@@ -4,23 +4,61 @@ import (
 	"flag"
 	"fmt"
 	"github.com/bradleyjkemp/grpc-tools/grpc-dump/dump"
+	"github.com/bradleyjkemp/grpc-tools/grpc-dump/report"
 	"github.com/bradleyjkemp/grpc-tools/grpc-proxy"
 	_ "github.com/bradleyjkemp/grpc-tools/internal/versionflag"
 	"os"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "report" {
+		runReport(os.Args[2:])
+		return
+	}
+
 	var (
 		protoRoots       = flag.String("proto_roots", "", "A comma separated list of directories to search for gRPC service definitions.")
-		protoDescriptors = flag.String("proto_descriptors", "", "A comma separated list of proto descriptors to load gRPC service definitions from.")
+		protoImportPaths = flag.String("proto_import_paths", "", "A comma separated list of directories to search for imports of the files in --proto_roots.")
+		protoDescriptors = flag.String("proto_descriptors", "", "A comma separated list of descriptor set files (protoc --descriptor_set_out or buf image) to load gRPC service definitions from.")
+		watchProtos      = flag.Bool("watch_protos", false, "Reload the proto roots and descriptors whenever they change.")
+
+		binaryMetadataTypes = flag.String("binary_metadata_types", "", "A comma separated list of key-bin=package.Message pairs used to decode binary metadata. Other binary metadata is decoded heuristically.")
+		connectionLog       = flag.String("connection_log", "", "File to write a JSON stream of client connection events (e.g. TLS interception and HTTP/2 GOAWAY frames) to. RPCs record the connection_id of the connection they were received on.")
 	)
 
 	grpc_proxy.RegisterDefaultFlags()
 	flag.Parse()
-	err := dump.Run(os.Stdout, *protoRoots, *protoDescriptors, grpc_proxy.DefaultFlags())
+	err := dump.Run(os.Stdout, dump.Config{
+		ProtoRoots:       *protoRoots,
+		ProtoImportPaths: *protoImportPaths,
+		ProtoDescriptors: *protoDescriptors,
+		WatchProtos:      *watchProtos,
+
+		BinaryMetadataTypes: *binaryMetadataTypes,
+		ConnectionLog:       *connectionLog,
+	}, grpc_proxy.DefaultFlags())
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		flag.Usage()
 		os.Exit(1)
 	}
 }
+
+// runReport summarises the latencies of the RPCs in a dump
+// usage: grpc-dump report [dump file] (reads stdin if no file is given)
+func runReport(args []string) {
+	input := os.Stdin
+	if len(args) > 0 {
+		var err error
+		input, err = os.Open(args[0])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer input.Close()
+	}
+	if err := report.Run(input, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,113 @@
+package report
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bradleyjkemp/grpc-tools/internal"
+)
+
+// methodSummary collects the latencies of all the RPCs to a method
+type methodSummary struct {
+	method              string
+	rpcs                int
+	errors              int
+	total               []time.Duration
+	timeToFirstResponse []time.Duration
+	upstreamLatency     []time.Duration
+	proxyOverhead       []time.Duration
+}
+
+// Run reads a grpc-dump JSON stream and writes a per-method summary of the
+// RPCs' latencies, split between time spent in the upstream server and
+// time spent in the proxy/network path.
+func Run(dump io.Reader, output io.Writer) error {
+	summaries, err := summarise(dump)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(output, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "METHOD\tRPCS\tERRORS\tTOTAL p50\tTOTAL p90\tTOTAL p99\tTOTAL max\tFIRST RESPONSE p50\tUPSTREAM p50\tPROXY OVERHEAD p50")
+	for _, s := range summaries {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			s.method, s.rpcs, s.errors,
+			percentile(s.total, 50), percentile(s.total, 90), percentile(s.total, 99), percentile(s.total, 100),
+			percentile(s.timeToFirstResponse, 50),
+			percentile(s.upstreamLatency, 50),
+			percentile(s.proxyOverhead, 50),
+		)
+	}
+	return w.Flush()
+}
+
+func summarise(dump io.Reader) ([]*methodSummary, error) {
+	dumpReader := internal.NewDumpReader(dump)
+	byMethod := map[string]*methodSummary{}
+	for {
+		rpc, err := dumpReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		summary := byMethod[rpc.StreamName()]
+		if summary == nil {
+			summary = &methodSummary{method: rpc.StreamName()}
+			byMethod[rpc.StreamName()] = summary
+		}
+		summary.rpcs++
+		if rpc.Status != nil {
+			summary.errors++
+		}
+		if rpc.Timing == nil {
+			// dumped before timing was recorded
+			continue
+		}
+		summary.total = appendDuration(summary.total, rpc.Timing.Total)
+		summary.timeToFirstResponse = appendDuration(summary.timeToFirstResponse, rpc.Timing.TimeToFirstResponse)
+		summary.upstreamLatency = appendDuration(summary.upstreamLatency, rpc.Timing.UpstreamLatency)
+		summary.proxyOverhead = appendDuration(summary.proxyOverhead, rpc.Timing.ProxyOverhead)
+	}
+
+	var summaries []*methodSummary
+	for _, summary := range byMethod {
+		summaries = append(summaries, summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].method < summaries[j].method
+	})
+	return summaries, nil
+}
+
+func appendDuration(durations []time.Duration, duration string) []time.Duration {
+	if duration == "" {
+		return durations
+	}
+	parsed, err := time.ParseDuration(duration)
+	if err != nil {
+		return durations
+	}
+	return append(durations, parsed)
+}
+
+// percentile uses the nearest-rank method, returning "-" if there are no durations
+func percentile(durations []time.Duration, p int) string {
+	if len(durations) == 0 {
+		return "-"
+	}
+	sorted := append([]time.Duration(nil), durations...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1].Round(time.Microsecond).String()
+}
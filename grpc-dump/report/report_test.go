@@ -0,0 +1,24 @@
+package report
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testDump = `{"service":"test.Service","method":"Fast","messages":[],"timing":{"total":"10ms","time_to_first_response":"8ms","upstream_latency":"7ms","proxy_overhead":"3ms"}}
+{"service":"test.Service","method":"Fast","messages":[],"timing":{"total":"20ms","time_to_first_response":"18ms","upstream_latency":"15ms","proxy_overhead":"5ms"}}
+{"service":"test.Service","method":"Slow","messages":[],"error":{"code":"Unavailable","message":"down"},"timing":{"total":"1s","proxy_overhead":"1s"}}
+`
+
+func TestReport(t *testing.T) {
+	output := &bytes.Buffer{}
+	require.NoError(t, Run(strings.NewReader(testDump), output))
+
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	require.Len(t, lines, 3)
+	require.Equal(t, []string{"/test.Service/Fast", "2", "0", "10ms", "20ms", "20ms", "20ms", "8ms", "7ms", "3ms"}, strings.Fields(lines[1]))
+	require.Equal(t, []string{"/test.Service/Slow", "1", "1", "1s", "1s", "1s", "1s", "-", "-", "1s"}, strings.Fields(lines[2]))
+}
@@ -0,0 +1,98 @@
+package fixture
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/empty"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// the methods of the admin service (see the grpc-fixture README for its definition)
+const (
+	adminResetMethod       = "/grpc_fixture.Admin/Reset"
+	adminSetScenarioMethod = "/grpc_fixture.Admin/SetScenario"
+)
+
+// adminService answers the admin RPCs (which reset the fixture and switch scenario
+// like the admin HTTP endpoints) and passes all other RPCs on to the next handler
+func adminService(interceptor *fixtureInterceptor) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		switch info.FullMethod {
+		case adminResetMethod:
+			if err := receiveAdminRequest(ss, &empty.Empty{}); err != nil {
+				return err
+			}
+			interceptor.reset()
+		case adminSetScenarioMethod:
+			// the name of the scenario (empty switches back to the default dump)
+			name := &wrappers.StringValue{}
+			if err := receiveAdminRequest(ss, name); err != nil {
+				return err
+			}
+			if err := interceptor.setScenario(name.GetValue()); err != nil {
+				return status.Error(codes.NotFound, err.Error())
+			}
+		default:
+			return handler(srv, ss)
+		}
+		response, err := proto.Marshal(&empty.Empty{})
+		if err != nil {
+			return err
+		}
+		return ss.SendMsg(response)
+	}
+}
+
+func receiveAdminRequest(ss grpc.ServerStream, request proto.Message) error {
+	var receivedMessage []byte
+	if err := ss.RecvMsg(&receivedMessage); err != nil {
+		return err
+	}
+	if err := proto.Unmarshal(receivedMessage, request); err != nil {
+		return status.Errorf(codes.InvalidArgument, "invalid admin request: %v", err)
+	}
+	return nil
+}
+
+// resetHandler restarts sequenced playback from the first saved responses
+func resetHandler(interceptor *fixtureInterceptor) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "resetting requires a POST request", http.StatusMethodNotAllowed)
+			return
+		}
+		interceptor.reset()
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// scenarioHandler switches to the scenario given by the name parameter
+// (an empty name switches back to the default dump)
+func scenarioHandler(interceptor *fixtureInterceptor) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "switching scenario requires a POST request", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := interceptor.setScenario(r.URL.Query().Get("name")); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// coverageHandler reports which saved responses have been used and the requests that didn't match
+func coverageHandler(interceptor *fixtureInterceptor) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(interceptor.coverageReport()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
@@ -0,0 +1,297 @@
+package fixture
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bradleyjkemp/grpc-tools/internal"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// the number of unmatched requests kept for the coverage report
+const maxUnmatchedRequests = 100
+
+// coverage records which saved RPCs and templates have been used
+// and which requests couldn't be matched
+type coverage struct {
+	used              map[usedKey]bool
+	matched           map[methodKey]int
+	unmatched         map[methodKey]int
+	unmatchedRequests []*unmatchedRequest
+}
+
+type usedKey struct {
+	scenario string
+	entry    interface{} // either the end of a saved RPC or a template
+}
+
+type methodKey struct {
+	scenario string
+	method   string
+}
+
+func newCoverage() coverage {
+	return coverage{
+		used:      map[usedKey]bool{},
+		matched:   map[methodKey]int{},
+		unmatched: map[methodKey]int{},
+	}
+}
+
+type coverageReport struct {
+	Methods   []*methodCoverage   `json:"methods"`
+	Unmatched []*unmatchedRequest `json:"unmatched"`
+}
+
+type methodCoverage struct {
+	Scenario string `json:"scenario,omitempty"`
+	Method   string `json:"method"`
+	// the number of saved RPCs (identical RPCs are only counted once unless sequenced) and templates
+	Saved int `json:"saved"`
+	Used  int `json:"used"`
+	// the requests of each saved RPC or template that hasn't been used
+	Unused    []string `json:"unused,omitempty"`
+	Matched   int      `json:"matched"`
+	Unmatched int      `json:"unmatched"`
+}
+
+type unmatchedRequest struct {
+	Time     time.Time   `json:"time"`
+	Scenario string      `json:"scenario,omitempty"`
+	Method   string      `json:"method"`
+	Request  interface{} `json:"request,omitempty"` // the decoded message that didn't match
+	// how the request differs from the nearest saved request
+	NearestDifferences []string `json:"nearest_differences,omitempty"`
+}
+
+// recordUsed marks a saved RPC or template as having been used to respond
+func (f *fixtureInterceptor) recordUsed(fullMethod string, entry interface{}) {
+	f.Lock()
+	defer f.Unlock()
+	f.coverage.used[usedKey{f.scenario, entry}] = true
+	f.coverage.matched[methodKey{f.scenario, fullMethod}]++
+}
+
+// unmatched records a (decoded) request that couldn't be matched against any of the candidates
+// and returns the error to respond with.
+// If subset is set then the candidates only need to contain a subset of the request's fields.
+func (f *fixtureInterceptor) unmatched(fullMethod string, request interface{}, candidates []interface{}, subset bool, message string) error {
+	unmatched := &unmatchedRequest{
+		Time:    time.Now(),
+		Method:  fullMethod,
+		Request: request,
+	}
+	for i, candidate := range candidates {
+		differences := diffJSON("", candidate, unmatched.Request, subset)
+		if i == 0 || len(differences) < len(unmatched.NearestDifferences) {
+			unmatched.NearestDifferences = differences
+		}
+	}
+
+	f.Lock()
+	unmatched.Scenario = f.scenario
+	f.coverage.unmatched[methodKey{f.scenario, fullMethod}]++
+	f.coverage.unmatchedRequests = append(f.coverage.unmatchedRequests, unmatched)
+	if len(f.coverage.unmatchedRequests) > maxUnmatchedRequests {
+		f.coverage.unmatchedRequests = f.coverage.unmatchedRequests[1:]
+	}
+	f.Unlock()
+
+	logger := f.logger.WithField("method", fullMethod).WithField("request", jsonString(unmatched.Request))
+	if len(unmatched.NearestDifferences) > 0 {
+		differences := strings.Join(unmatched.NearestDifferences, "; ")
+		logger = logger.WithField("nearest_differences", differences)
+		message = fmt.Sprintf("%s (nearest differs at %s)", message, differences)
+	}
+	logger.Warn("No matching saved response")
+	return status.Error(codes.Unavailable, message)
+}
+
+// decodeCandidates decodes the saved client messages that could have been matched
+func (f *fixtureInterceptor) decodeCandidates(fullMethod string, node *messageTree) []interface{} {
+	var candidates []interface{}
+	for _, next := range node.nextMessages {
+		if next.origin != internal.ClientMessage {
+			continue
+		}
+		candidate, err := f.decodeRequest(fullMethod, []byte(next.raw))
+		if err != nil {
+			continue
+		}
+		candidates = append(candidates, candidate)
+	}
+	return candidates
+}
+
+func (f *fixtureInterceptor) coverageReport() *coverageReport {
+	f.Lock()
+	defer f.Unlock()
+
+	report := &coverageReport{
+		Unmatched: append([]*unmatchedRequest{}, f.coverage.unmatchedRequests...),
+	}
+	var scenarios []string
+	for scenario := range f.scenarios {
+		scenarios = append(scenarios, scenario)
+	}
+	sort.Strings(scenarios)
+
+	for _, scenario := range scenarios {
+		methods := map[string]bool{}
+		for method := range f.scenarios[scenario] {
+			methods[method] = true
+		}
+		for method := range f.templates {
+			methods[method] = true
+		}
+		for key := range f.coverage.unmatched {
+			if key.scenario == scenario {
+				methods[key.method] = true
+			}
+		}
+		var sortedMethods []string
+		for method := range methods {
+			sortedMethods = append(sortedMethods, method)
+		}
+		sort.Strings(sortedMethods)
+
+		for _, method := range sortedMethods {
+			key := methodKey{scenario, method}
+			methodCoverage := &methodCoverage{
+				Scenario:  scenario,
+				Method:    method,
+				Matched:   f.coverage.matched[key],
+				Unmatched: f.coverage.unmatched[key],
+			}
+			if tree := f.scenarios[scenario][method]; tree != nil {
+				walkSavedRPCs(tree, nil, func(requests []string, end *messageTree) {
+					methodCoverage.Saved++
+					if f.coverage.used[usedKey{scenario, end}] {
+						methodCoverage.Used++
+					} else {
+						methodCoverage.Unused = append(methodCoverage.Unused, f.describeRequests(method, requests))
+					}
+				})
+			}
+			for _, template := range f.templates[method] {
+				methodCoverage.Saved++
+				if f.coverage.used[usedKey{scenario, template}] {
+					methodCoverage.Used++
+				} else {
+					methodCoverage.Unused = append(methodCoverage.Unused, "template matching "+jsonString(template.Match))
+				}
+			}
+			report.Methods = append(report.Methods, methodCoverage)
+		}
+	}
+	return report
+}
+
+// walkSavedRPCs calls fn with the client messages and end of each saved RPC
+func walkSavedRPCs(node *messageTree, requests []string, fn func(requests []string, end *messageTree)) {
+	for _, next := range node.nextMessages {
+		switch next.origin {
+		case internal.ClientMessage:
+			walkSavedRPCs(next, append(requests, next.raw), fn)
+		case rpcEnd:
+			fn(requests, next)
+		default:
+			walkSavedRPCs(next, requests, fn)
+		}
+	}
+}
+
+func (f *fixtureInterceptor) describeRequests(fullMethod string, requests []string) string {
+	var described []string
+	for _, request := range requests {
+		decoded, err := f.decodeRequest(fullMethod, []byte(request))
+		if err != nil {
+			described = append(described, fmt.Sprintf("%q", request))
+			continue
+		}
+		described = append(described, jsonString(decoded))
+	}
+	return strings.Join(described, ", ")
+}
+
+// writeCoverageReport prints the report in a human readable format
+func writeCoverageReport(w io.Writer, report *coverageReport) error {
+	table := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(table, "SCENARIO\tMETHOD\tSAVED\tUSED\tMATCHED\tUNMATCHED")
+	for _, method := range report.Methods {
+		scenario := method.Scenario
+		if scenario == "" {
+			scenario = "default"
+		}
+		fmt.Fprintf(table, "%s\t%s\t%d\t%d\t%d\t%d\n", scenario, method.Method, method.Saved, method.Used, method.Matched, method.Unmatched)
+	}
+	if err := table.Flush(); err != nil {
+		return err
+	}
+
+	for _, method := range report.Methods {
+		for _, unused := range method.Unused {
+			fmt.Fprintf(w, "Unused %s: %s\n", method.Method, unused)
+		}
+	}
+	for _, unmatched := range report.Unmatched {
+		fmt.Fprintf(w, "Unmatched %s: %s\n", unmatched.Method, jsonString(unmatched.Request))
+		for _, difference := range unmatched.NearestDifferences {
+			fmt.Fprintf(w, "  %s\n", difference)
+		}
+	}
+	return nil
+}
+
+// diffJSON describes the differences between two decoded JSON values.
+// If subset is set then fields missing from expected are ignored.
+func diffJSON(path string, expected, actual interface{}, subset bool) []string {
+	expectedMap, expectedIsMap := expected.(map[string]interface{})
+	actualMap, actualIsMap := actual.(map[string]interface{})
+	if expectedIsMap && (actualIsMap || actual == nil) {
+		keys := map[string]bool{}
+		for key := range expectedMap {
+			keys[key] = true
+		}
+		if !subset {
+			for key := range actualMap {
+				keys[key] = true
+			}
+		}
+		var sortedKeys []string
+		for key := range keys {
+			sortedKeys = append(sortedKeys, key)
+		}
+		sort.Strings(sortedKeys)
+
+		var differences []string
+		for _, key := range sortedKeys {
+			differences = append(differences, diffJSON(path+"."+key, expectedMap[key], actualMap[key], subset)...)
+		}
+		return differences
+	}
+
+	if reflect.DeepEqual(expected, actual) {
+		return nil
+	}
+	field := strings.TrimPrefix(path, ".")
+	if field == "" {
+		field = "message"
+	}
+	return []string{fmt.Sprintf("%s: expected %s, got %s", field, jsonString(expected), jsonString(actual))}
+}
+
+func jsonString(value interface{}) string {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(b)
+}
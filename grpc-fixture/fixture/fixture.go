@@ -1,41 +1,217 @@
 package fixture
 
 import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
 	"github.com/bradleyjkemp/grpc-tools/grpc-proxy"
 	"github.com/bradleyjkemp/grpc-tools/internal/proto_decoder"
-	"strings"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+)
+
+// Config holds the grpc-fixture settings (see the grpc-fixture flags for details).
+type Config struct {
+	ProtoRoots       string // comma separated
+	ProtoImportPaths string // comma separated
+	ProtoDescriptors string // comma separated
+	DumpPath         string
+	// hand written response templates (YAML or JSON files), comma separated
+	Templates string
+	// serve as a plain gRPC server rather than as a proxy
+	Direct bool
+	// answer gRPC server reflection requests using the loaded protos
+	Reflection bool
+	// additional dumps (keyed by scenario name) that can be switched to using the admin service or server
+	Scenarios map[string]string
+	Options
+}
+
+// SequenceMode controls which response is sent when several saved RPCs match a request.
+type SequenceMode string
+
+const (
+	// SequenceOff always sends the first saved response.
+	SequenceOff SequenceMode = ""
+	// SequenceWrap sends the Nth saved response to the Nth matching request, starting again from the first once they run out.
+	SequenceWrap SequenceMode = "wrap"
+	// SequenceStick sends the Nth saved response to the Nth matching request, repeating the last once they run out.
+	SequenceStick SequenceMode = "stick"
 )
 
+// Options control how the fixture responds to requests.
+type Options struct {
+	// delay before sending each saved response message. If the client's
+	// deadline is reached first then the RPC fails with DeadlineExceeded.
+	ResponseDelay time.Duration
+
+	// ReplayTiming waits the recorded time between messages before
+	// sending each response (reproducing the pacing of streams).
+	ReplayTiming bool
+	// multiplier applied to the recorded delays (0 removes them)
+	TimingScale float64
+	// a random amount up to +/- Jitter is added to each delay
+	Jitter time.Duration
+	// extra delay before the first response of each method (keyed by /package.Service/Method)
+	MethodLatency map[string]time.Duration
+
+	// Sequence replays matching saved RPCs in the order they were recorded
+	Sequence SequenceMode
+}
+
 // Run is exported for testing
-func Run(protoRoots, protoDescriptors, dumpPath string, proxyConfig ...grpc_proxy.Configurator) error {
-	var resolvers []proto_decoder.MessageResolver
-	if protoRoots != "" {
-		r, err := proto_decoder.NewFileResolver(strings.Split(protoRoots, ",")...)
-		if err != nil {
+func Run(config Config, proxyConfig ...grpc_proxy.Configurator) error {
+	logger := logrus.New()
+	resolvers, err := proto_decoder.LoadResolvers(logger, config.ProtoRoots, config.ProtoImportPaths, config.ProtoDescriptors)
+	if err != nil {
+		return err
+	}
+	encoder := proto_decoder.NewEncoder(resolvers...)
+	if config.DumpPath == "" && config.Templates == "" {
+		return fmt.Errorf("either a dump or templates must be specified")
+	}
+
+	interceptor := newFixtureInterceptor(logger, config.Options, encoder, proto_decoder.NewDecoder(logger, resolvers...))
+	interceptor.addServices(proto_decoder.FileDescriptors(resolvers...))
+	if config.DumpPath != "" {
+		if err := loadScenario(interceptor, "", config.DumpPath); err != nil {
 			return err
 		}
-		resolvers = append(resolvers, r)
 	}
-	if protoDescriptors != "" {
-		r, err := proto_decoder.NewDescriptorResolver(strings.Split(protoRoots, ",")...)
-		if err != nil {
-			return err
+	for name, dumpPath := range config.Scenarios {
+		if err := loadScenario(interceptor, name, dumpPath); err != nil {
+			return fmt.Errorf("failed to load scenario %s: %v", name, err)
 		}
-		resolvers = append(resolvers, r)
 	}
-	encoder := proto_decoder.NewEncoder(resolvers...)
 
-	interceptor, err := loadFixture(dumpPath, encoder)
-	if err != nil {
-		return err
+	for _, templatePath := range strings.Split(config.Templates, ",") {
+		if templatePath == "" {
+			continue
+		}
+		if err := loadTemplateFile(interceptor, templatePath); err != nil {
+			return fmt.Errorf("failed to load templates %s: %v", templatePath, err)
+		}
 	}
 
+	if config.Direct {
+		proxyConfig = append(proxyConfig, grpc_proxy.DirectServer())
+	}
+	if config.Reflection {
+		reflection := newReflectionServer(proto_decoder.FileDescriptors(resolvers...))
+		proxyConfig = append(proxyConfig, grpc_proxy.WithInterceptor(reflection.intercept))
+	}
 	proxy, err := grpc_proxy.New(
-		append(proxyConfig, grpc_proxy.WithInterceptor(interceptor.intercept))...,
+		append(proxyConfig,
+			grpc_proxy.WithInterceptor(adminService(interceptor)),
+			grpc_proxy.WithInterceptor(interceptor.intercept),
+			grpc_proxy.WithAdminHandler("/reset", resetHandler(interceptor)),
+			grpc_proxy.WithAdminHandler("/scenario", scenarioHandler(interceptor)),
+			grpc_proxy.WithAdminHandler("/coverage", coverageHandler(interceptor)),
+		)...,
 	)
 	if err != nil {
 		return err
 	}
 
-	return proxy.Start()
+	// stop gracefully on interrupt so that the coverage report can be printed
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer func() {
+		signal.Stop(sigs)
+		close(sigs)
+	}()
+	go func() {
+		if _, ok := <-sigs; ok {
+			proxy.Stop()
+		}
+	}()
+
+	err = proxy.Start()
+	if reportErr := writeCoverageReport(os.Stderr, interceptor.coverageReport()); reportErr != nil {
+		logger.WithError(reportErr).Warn("Failed to write coverage report")
+	}
+	return err
+}
+
+// Interceptor loads the RPCs from a grpc-dump output stream and returns
+// a grpc.StreamServerInterceptor that answers matching requests with
+// the saved responses instead of forwarding them.
+func Interceptor(dump io.Reader, encoder proto_decoder.MessageEncoder, options Options) (grpc.StreamServerInterceptor, error) {
+	logger := logrus.New()
+	interceptor := newFixtureInterceptor(logger, options, encoder, proto_decoder.NewDecoder(logger))
+	if err := interceptor.addScenario("", dump); err != nil {
+		return nil, err
+	}
+	return interceptor.intercept, nil
+}
+
+func loadScenario(interceptor *fixtureInterceptor, name, dumpPath string) error {
+	dumpFile, err := os.Open(dumpPath)
+	if err != nil {
+		return err
+	}
+	defer dumpFile.Close()
+	return interceptor.addScenario(name, dumpFile)
+}
+
+func loadTemplateFile(interceptor *fixtureInterceptor, templatePath string) error {
+	templateFile, err := os.Open(templatePath)
+	if err != nil {
+		return err
+	}
+	defer templateFile.Close()
+	return interceptor.addTemplates(templateFile)
+}
+
+// ParseSequenceMode parses the value of the --sequence flag.
+func ParseSequenceMode(mode string) (SequenceMode, error) {
+	switch SequenceMode(mode) {
+	case SequenceOff, SequenceWrap, SequenceStick:
+		return SequenceMode(mode), nil
+	default:
+		return SequenceOff, fmt.Errorf("invalid sequence mode %q: must be wrap or stick", mode)
+	}
+}
+
+// ParseScenarios parses a comma separated list of name=dump pairs
+// (as used by the --scenarios flag).
+func ParseScenarios(scenarios string) (map[string]string, error) {
+	parsed := map[string]string{}
+	for _, pair := range strings.Split(scenarios, ",") {
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid scenario %q: must be of the form name=dump.json", pair)
+		}
+		parsed[parts[0]] = parts[1]
+	}
+	return parsed, nil
+}
+
+// ParseMethodLatency parses a comma separated list of /package.Service/Method=duration pairs
+// (as used by the --method_latency flag).
+func ParseMethodLatency(methodLatency string) (map[string]time.Duration, error) {
+	parsed := map[string]time.Duration{}
+	for _, pair := range strings.Split(methodLatency, ",") {
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid method latency %q: must be of the form /package.Service/Method=duration", pair)
+		}
+		latency, err := time.ParseDuration(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid method latency %q: %v", pair, err)
+		}
+		parsed[parts[0]] = latency
+	}
+	return parsed, nil
 }
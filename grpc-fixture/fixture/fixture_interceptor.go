@@ -1,67 +1,460 @@
 package fixture
 
 import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
 	"github.com/bradleyjkemp/grpc-tools/internal"
+	"github.com/bradleyjkemp/grpc-tools/internal/proto_decoder"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 )
 
-// fixtureInterceptor implements a gRPC.StreamingServerInterceptor that replays saved responses
-func (f fixture) intercept(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, _ grpc.StreamHandler) error {
-	messageTreeNode := f[info.FullMethod]
+type fixtureInterceptor struct {
+	logger  logrus.FieldLogger
+	options Options
+	encoder proto_decoder.MessageEncoder
+	decoder proto_decoder.MessageDecoder
 
-	if messageTreeNode == nil {
-		return status.Error(codes.Unavailable, "no saved responses found for method "+info.FullMethod)
-	}
+	sync.Mutex
+	scenarios map[string]fixture   // the default scenario is ""
+	scenario  string               // the active scenario
+	sequence  map[*messageTree]int // number of times a response has been chosen after each message
 
-	for {
-		// possibility that server sends the first method
-		serverFirst := len(messageTreeNode.nextMessages) > 0
-		for _, message := range messageTreeNode.nextMessages {
-			serverFirst = serverFirst && message.origin == internal.ServerMessage
-		}
+	// hand written responses (keyed by method) take priority over the saved RPCs
+	templates      map[string][]*responseTemplate
+	templateCounts map[*responseTemplate]int
+	// methods (keyed by /package.Service/Method) that are bidirectional streams
+	bidiMethods map[string]bool
+
+	coverage coverage
+}
 
-		if serverFirst {
-			for _, message := range messageTreeNode.nextMessages {
-				if message.origin == internal.ServerMessage {
-					err := ss.SendMsg([]byte(message.raw))
-					if err != nil {
-						return err
-					}
+func newFixtureInterceptor(logger logrus.FieldLogger, options Options, encoder proto_decoder.MessageEncoder, decoder proto_decoder.MessageDecoder) *fixtureInterceptor {
+	return &fixtureInterceptor{
+		logger:         logger,
+		options:        options,
+		encoder:        encoder,
+		decoder:        decoder,
+		scenarios:      map[string]fixture{"": {}},
+		sequence:       map[*messageTree]int{},
+		templates:      map[string][]*responseTemplate{},
+		templateCounts: map[*responseTemplate]int{},
+		bidiMethods:    map[string]bool{},
+		coverage:       newCoverage(),
+	}
+}
 
-					// recurse deeper into the tree
-					messageTreeNode = message
+func (f *fixtureInterceptor) addScenario(name string, dump io.Reader) error {
+	loaded, err := loadFixture(dump, f.encoder, f.options.Sequence != SequenceOff)
+	if err != nil {
+		return err
+	}
+	f.Lock()
+	defer f.Unlock()
+	f.scenarios[name] = loaded
+	return nil
+}
 
-					// found the first server message so break
-					break
+func (f *fixtureInterceptor) addTemplates(r io.Reader) error {
+	loaded, err := loadTemplates(r)
+	if err != nil {
+		return err
+	}
+	f.Lock()
+	defer f.Unlock()
+	for method, templates := range loaded {
+		f.templates[method] = append(f.templates[method], templates...)
+	}
+	return nil
+}
+
+// addServices records which methods are bidirectional streams (so that
+// templates can respond without waiting for the client to finish)
+func (f *fixtureInterceptor) addServices(files []*desc.FileDescriptor) {
+	f.Lock()
+	defer f.Unlock()
+	for _, file := range files {
+		for _, service := range file.GetServices() {
+			for _, method := range service.GetMethods() {
+				if method.IsClientStreaming() && method.IsServerStreaming() {
+					f.bidiMethods[fmt.Sprintf("/%s/%s", service.GetFullyQualifiedName(), method.GetName())] = true
 				}
 			}
+		}
+	}
+}
+
+// setScenario switches the saved responses being served and resets the sequence state
+// (and coverage)
+func (f *fixtureInterceptor) setScenario(name string) error {
+	f.Lock()
+	defer f.Unlock()
+	if _, ok := f.scenarios[name]; !ok {
+		return fmt.Errorf("unknown scenario %q", name)
+	}
+	f.scenario = name
+	f.sequence = map[*messageTree]int{}
+	f.templateCounts = map[*responseTemplate]int{}
+	f.coverage = newCoverage()
+	return nil
+}
+
+// reset restarts sequenced playback from the first saved response
+// (and template counts and coverage from zero)
+func (f *fixtureInterceptor) reset() {
+	f.Lock()
+	defer f.Unlock()
+	f.sequence = map[*messageTree]int{}
+	f.templateCounts = map[*responseTemplate]int{}
+	f.coverage = newCoverage()
+}
+
+func (f *fixtureInterceptor) activeFixture() fixture {
+	f.Lock()
+	defer f.Unlock()
+	return f.scenarios[f.scenario]
+}
+
+// chooseResponse picks which of the saved responses to send after a message.
+// Unless playback is sequenced this is always the first one.
+func (f *fixtureInterceptor) chooseResponse(after *messageTree, responses []*messageTree) *messageTree {
+	if f.options.Sequence == SequenceOff {
+		return responses[0]
+	}
+	f.Lock()
+	defer f.Unlock()
+	n := f.sequence[after]
+	f.sequence[after] = n + 1
+	if n >= len(responses) {
+		if f.options.Sequence == SequenceWrap {
+			n = n % len(responses)
 		} else {
-			// wait for a client message and then proceed based on its contents
-			var receivedMessage []byte
-			err := ss.RecvMsg(&receivedMessage)
+			n = len(responses) - 1
+		}
+	}
+	return responses[n]
+}
+
+// fixtureInterceptor implements a gRPC.StreamingServerInterceptor that replays saved responses
+func (f *fixtureInterceptor) intercept(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, _ grpc.StreamHandler) error {
+	if templates := f.templates[info.FullMethod]; len(templates) > 0 {
+		return f.respondFromTemplates(ss, info.FullMethod, templates)
+	}
+	return f.respondFromFixture(ss, info.FullMethod)
+}
+
+// respondFromFixture walks the saved RPCs of a method sending the saved
+// responses for as long as the client's messages match
+func (f *fixtureInterceptor) respondFromFixture(ss grpc.ServerStream, fullMethod string) error {
+	messageTreeNode := f.activeFixture()[fullMethod]
+
+	if messageTreeNode == nil {
+		return f.unmatched(fullMethod, nil, nil, false, "no saved responses found for method "+fullMethod)
+	}
+
+	// response delays are relative to the previous message (or the start of the RPC)
+	lastMessage := time.Now()
+	sentResponse := false
+	headersSet := false
+	setHeaders := func(node *messageTree) error {
+		if headersSet || len(node.headers) == 0 {
+			return nil
+		}
+		headersSet = true
+		return ss.SetHeader(node.headers)
+	}
+	finish := func(node *messageTree) error {
+		if !headersSet && len(node.headers) > 0 {
+			// headers were saved so send them explicitly rather than
+			// letting them be merged into a trailers-only response
+			headersSet = true
+			if err := ss.SendHeader(node.headers); err != nil {
+				return err
+			}
+		}
+		if len(node.trailers) > 0 {
+			ss.SetTrailer(node.trailers)
+		}
+		f.recordUsed(fullMethod, node)
+		return node.status.Err()
+	}
+
+	for {
+		responses := messageTreeNode.responses()
+		if len(responses) > 0 && len(responses) == len(messageTreeNode.nextMessages) {
+			// the client doesn't send anything next so respond
+			response := f.chooseResponse(messageTreeNode, responses)
+			if response.origin == rpcEnd {
+				return finish(response)
+			}
+			if err := setHeaders(response); err != nil {
+				return err
+			}
+			delay := f.responseDelay(fullMethod, response.delay, !sentResponse)
+			err := f.sendMessage(ss, []byte(response.raw), lastMessage, delay)
 			if err != nil {
 				return err
 			}
-			var found bool
-			for _, message := range messageTreeNode.nextMessages {
-				if message.origin == internal.ClientMessage && message.raw == string(receivedMessage) {
-					// found the matching message so recurse deeper into the tree
-					messageTreeNode = message
-					found = true
-					break
+			lastMessage = time.Now()
+			sentResponse = true
+
+			// recurse deeper into the tree
+			messageTreeNode = response
+			continue
+		}
+
+		// wait for a client message and then proceed based on its contents
+		var receivedMessage []byte
+		err := ss.RecvMsg(&receivedMessage)
+		if err == io.EOF {
+			// client has finished sending so finish in the same way as a saved RPC
+			var ends []*messageTree
+			for _, response := range responses {
+				if response.origin == rpcEnd {
+					ends = append(ends, response)
 				}
 			}
+			if len(ends) > 0 {
+				return finish(f.chooseResponse(messageTreeNode, ends))
+			}
+		}
+		if err != nil {
+			return err
+		}
+		lastMessage = time.Now()
+		var found bool
+		for _, message := range messageTreeNode.nextMessages {
+			if message.origin == internal.ClientMessage && message.raw == string(receivedMessage) {
+				// found the matching message so recurse deeper into the tree
+				messageTreeNode = message
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			// decoding is best effort as it's only used to explain the mismatch
+			request, _ := f.decodeRequest(fullMethod, receivedMessage)
+			candidates := f.decodeCandidates(fullMethod, messageTreeNode)
+			return f.unmatched(fullMethod, request, candidates, false, fmt.Sprintf("no matching saved responses for method %s and message", fullMethod))
+		}
+	}
+}
+
+// sendMessage sends a saved response after the configured delay
+// (as long as the client's deadline isn't reached first)
+func (f *fixtureInterceptor) sendMessage(ss grpc.ServerStream, message []byte, since time.Time, delay time.Duration) error {
+	if wait := time.Until(since.Add(delay)); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ss.Context().Done():
+			return status.FromContextError(ss.Context().Err()).Err()
+		}
+	}
+	return ss.SendMsg(message)
+}
+
+// respondFromTemplates waits for the client to finish sending (or, for bidirectional
+// streams, for the first request) and then responds using the first template matching
+// the requests. If none match then the saved RPCs of the method are used instead.
+func (f *fixtureInterceptor) respondFromTemplates(ss grpc.ServerStream, fullMethod string, templates []*responseTemplate) error {
+	md, _ := metadata.FromIncomingContext(ss.Context())
+	var received [][]byte
+	var requests []interface{}
+	for !(f.bidiMethods[fullMethod] && len(requests) > 0) {
+		var receivedMessage []byte
+		err := ss.RecvMsg(&receivedMessage)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		request, err := f.decodeRequest(fullMethod, receivedMessage)
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "failed to decode request: %v", err)
+		}
+		received = append(received, receivedMessage)
+		requests = append(requests, request)
+	}
+	data := templateData{
+		Requests: requests,
+		Metadata: md,
+	}
+	if len(requests) > 0 {
+		data.Request = requests[0]
+	}
+
+	var candidates []interface{}
+	for _, template := range templates {
+		if template.matches(data.Request, md) {
+			data.Count = f.countTemplate(template)
+			f.recordUsed(fullMethod, template)
+			return f.sendTemplate(ss, fullMethod, template, data)
+		}
+		if match, err := normaliseJSON(template.Match); err == nil {
+			candidates = append(candidates, match)
+		}
+	}
+	if f.activeFixture()[fullMethod] != nil {
+		// the requests have already been read so they're passed on to be matched again
+		return f.respondFromFixture(&receivedStream{ServerStream: ss, received: received}, fullMethod)
+	}
+	return f.unmatched(fullMethod, data.Request, candidates, true, fmt.Sprintf("no matching templates for method %s and message", fullMethod))
+}
+
+// receivedStream is a grpc.ServerStream that receives messages which
+// have already been read from the underlying stream before any others
+type receivedStream struct {
+	grpc.ServerStream
+	received [][]byte
+}
+
+func (s *receivedStream) RecvMsg(m interface{}) error {
+	if len(s.received) == 0 {
+		return s.ServerStream.RecvMsg(m)
+	}
+	*(m.(*[]byte)) = s.received[0]
+	s.received = s.received[1:]
+	return nil
+}
+
+func (f *fixtureInterceptor) decodeRequest(fullMethod string, raw []byte) (interface{}, error) {
+	decoded, err := f.decoder.Decode(fullMethod, &internal.Message{
+		MessageOrigin: internal.ClientMessage,
+		RawMessage:    raw,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// the proto field names are used as they're what templates are written with
+	b, err := decoded.MarshalJSONPB(&jsonpb.Marshaler{OrigName: true})
+	if err != nil {
+		return nil, err
+	}
+	var request interface{}
+	if err := json.Unmarshal(b, &request); err != nil {
+		return nil, err
+	}
+	numberUnknownFields(decoded.GetMessageDescriptor(), request)
+	return request, nil
+}
 
-			if !found {
-				return status.Errorf(codes.Unavailable, "no matching saved responses for method %s and message", info.FullMethod)
+// numberUnknownFields renames the fields generated for unknown fields back
+// to their field numbers (their names are meaningless)
+func numberUnknownFields(descriptor *desc.MessageDescriptor, value interface{}) {
+	fields, ok := value.(map[string]interface{})
+	if !ok {
+		return
+	}
+	for _, field := range descriptor.GetFields() {
+		fieldValue, ok := fields[field.GetName()]
+		if !ok {
+			continue
+		}
+		if number := strconv.Itoa(int(field.GetNumber())); field.GetJSONName() == number {
+			delete(fields, field.GetName())
+			fields[number] = fieldValue
+		}
+		nested := field.GetMessageType()
+		if nested == nil || field.IsMap() {
+			continue
+		}
+		if repeated, ok := fieldValue.([]interface{}); ok {
+			for _, element := range repeated {
+				numberUnknownFields(nested, element)
 			}
+		} else {
+			numberUnknownFields(nested, fieldValue)
 		}
+	}
+}
 
-		if len(messageTreeNode.nextMessages) == 0 {
-			// end of the exchange
-			return nil
+func (f *fixtureInterceptor) countTemplate(template *responseTemplate) int {
+	f.Lock()
+	defer f.Unlock()
+	f.templateCounts[template]++
+	return f.templateCounts[template]
+}
+
+func (f *fixtureInterceptor) sendTemplate(ss grpc.ServerStream, fullMethod string, template *responseTemplate, data templateData) error {
+	headers, err := template.renderMetadata(template.Headers, data)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to render headers: %v", err)
+	}
+	if len(headers) > 0 {
+		// sent explicitly so they aren't merged into a trailers-only response
+		if err := ss.SendHeader(headers); err != nil {
+			return err
+		}
+	}
+
+	lastMessage := time.Now()
+	for i, response := range template.Responses {
+		data.Index = i
+		rendered, err := template.render(response, data)
+		if err != nil {
+			return status.Errorf(codes.Internal, "failed to render response %d: %v", i, err)
+		}
+		if rendered == nil {
+			rendered = map[string]interface{}{}
+		}
+		message, err := f.encoder.Encode(fullMethod, &internal.Message{
+			MessageOrigin: internal.ServerMessage,
+			Message:       rendered,
+		})
+		if err != nil {
+			return status.Errorf(codes.Internal, "failed to encode response %d: %v", i, err)
 		}
+		delay := f.responseDelay(fullMethod, 0, i == 0)
+		if err := f.sendMessage(ss, message, lastMessage, delay); err != nil {
+			return err
+		}
+		lastMessage = time.Now()
+	}
+
+	trailers, err := template.renderMetadata(template.Trailers, data)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to render trailers: %v", err)
+	}
+	if len(trailers) > 0 {
+		ss.SetTrailer(trailers)
+	}
+	finalStatus, err := template.renderStatus(data)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to render error: %v", err)
+	}
+	return finalStatus.Err()
+}
+
+// responseDelay calculates how long to wait before sending a response
+// given the recorded delay before it (zero for templated responses)
+func (f *fixtureInterceptor) responseDelay(fullMethod string, recorded time.Duration, first bool) time.Duration {
+	delay := f.options.ResponseDelay
+	if first {
+		delay += f.options.MethodLatency[fullMethod]
+	}
+	if f.options.ReplayTiming {
+		delay += time.Duration(float64(recorded) * f.options.TimingScale)
+	}
+	if f.options.Jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(2*f.options.Jitter))) - f.options.Jitter
+	}
+	if delay < 0 {
+		return 0
 	}
+	return delay
 }
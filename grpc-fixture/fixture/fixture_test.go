@@ -0,0 +1,370 @@
+package fixture
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bradleyjkemp/grpc-tools/grpc-proxy"
+	"github.com/bradleyjkemp/grpc-tools/internal/codec"
+	"github.com/bradleyjkemp/grpc-tools/internal/proto_decoder"
+	"github.com/jhump/protoreflect/grpcreflect"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+)
+
+// a server stream sending two messages 300ms apart
+const timedDump = `{"service":"test.Service","method":"Stream","messages":[` +
+	`{"message_origin":"client","raw_message":"","timestamp":"2020-01-01T00:00:00Z"},` +
+	`{"message_origin":"server","raw_message":"CgE=","timestamp":"2020-01-01T00:00:00.1Z"},` +
+	`{"message_origin":"server","raw_message":"CgI=","timestamp":"2020-01-01T00:00:00.4Z"}` +
+	`],"metadata":{}}`
+
+func TestResponseDelay(t *testing.T) {
+	f, err := loadFixture(strings.NewReader(timedDump), proto_decoder.NewEncoder(), false)
+	require.NoError(t, err)
+	clientMessage := f["/test.Service/Stream"].nextMessages[0]
+	first := clientMessage.nextMessages[0]
+	second := first.nextMessages[0]
+	require.Equal(t, 100*time.Millisecond, first.delay)
+	require.Equal(t, 300*time.Millisecond, second.delay)
+
+	interceptor := newFixtureInterceptor(logrus.New(), Options{
+		ResponseDelay: 10 * time.Millisecond,
+		ReplayTiming:  true,
+		TimingScale:   0.5,
+		MethodLatency: map[string]time.Duration{
+			"/test.Service/Stream": time.Second,
+		},
+	}, nil, nil)
+	require.Equal(t, 1060*time.Millisecond, interceptor.responseDelay("/test.Service/Stream", first.delay, true))
+	require.Equal(t, 160*time.Millisecond, interceptor.responseDelay("/test.Service/Stream", second.delay, false))
+
+	// a zero scale removes the recorded delays
+	interceptor.options = Options{ReplayTiming: true}
+	require.Zero(t, interceptor.responseDelay("/test.Service/Stream", second.delay, false))
+
+	interceptor.options = Options{Jitter: 50 * time.Millisecond}
+	for i := 0; i < 100; i++ {
+		require.True(t, interceptor.responseDelay("/test.Service/Stream", second.delay, false) < 50*time.Millisecond)
+	}
+}
+
+// the same request polled twice getting different responses
+const pollingDump = `{"service":"test.Service","method":"Poll","messages":[` +
+	`{"message_origin":"client","raw_message":""},{"message_origin":"server","raw_message":"CgE="}],"metadata":{}}
+{"service":"test.Service","method":"Poll","messages":[` +
+	`{"message_origin":"client","raw_message":""},{"message_origin":"server","raw_message":"CgI="}],"metadata":{}}`
+
+func TestSequencedResponses(t *testing.T) {
+	pollResponses := func(interceptor *fixtureInterceptor, n int) []string {
+		request := interceptor.activeFixture()["/test.Service/Poll"].nextMessages[0]
+		var responses []string
+		for i := 0; i < n; i++ {
+			responses = append(responses, interceptor.chooseResponse(request, request.responses()).raw)
+		}
+		return responses
+	}
+
+	unsequenced := newFixtureInterceptor(logrus.New(), Options{}, proto_decoder.NewEncoder(), nil)
+	require.NoError(t, unsequenced.addScenario("", strings.NewReader(pollingDump)))
+	require.Equal(t, []string{"\n\x01", "\n\x01", "\n\x01"}, pollResponses(unsequenced, 3))
+
+	wrap := newFixtureInterceptor(logrus.New(), Options{Sequence: SequenceWrap}, proto_decoder.NewEncoder(), nil)
+	require.NoError(t, wrap.addScenario("", strings.NewReader(pollingDump)))
+	require.Equal(t, []string{"\n\x01", "\n\x02", "\n\x01"}, pollResponses(wrap, 3))
+
+	stick := newFixtureInterceptor(logrus.New(), Options{Sequence: SequenceStick}, proto_decoder.NewEncoder(), nil)
+	require.NoError(t, stick.addScenario("", strings.NewReader(pollingDump)))
+	require.Equal(t, []string{"\n\x01", "\n\x02", "\n\x02"}, pollResponses(stick, 3))
+	stick.reset()
+	require.Equal(t, []string{"\n\x01"}, pollResponses(stick, 1))
+
+	require.NoError(t, stick.addScenario("other", strings.NewReader(timedDump)))
+	require.NoError(t, stick.setScenario("other"))
+	require.Nil(t, stick.activeFixture()["/test.Service/Poll"])
+	require.Error(t, stick.setScenario("unknown"))
+}
+
+func TestParseMethodLatency(t *testing.T) {
+	latency, err := ParseMethodLatency("/test.Service/A=100ms,/test.Service/B=2s")
+	require.NoError(t, err)
+	require.Equal(t, map[string]time.Duration{
+		"/test.Service/A": 100 * time.Millisecond,
+		"/test.Service/B": 2 * time.Second,
+	}, latency)
+
+	_, err = ParseMethodLatency("/test.Service/A")
+	require.Error(t, err)
+}
+
+const templates = `
+- service: test.Service
+  method: Get
+  match:
+    id: "123"
+  match_metadata:
+    tenant: acme
+  headers:
+    x-request-id: '{{metadata .Metadata "x-request-id"}}'
+  responses:
+    - id: '{{.Request.id}}'
+      name: fixed
+      count: '{{.Count}}'
+- service: test.Service
+  method: Get
+  error:
+    code: NotFound
+    message: '{{.Request.id}} not found'
+`
+
+func TestTemplates(t *testing.T) {
+	loaded, err := loadTemplates(strings.NewReader(templates))
+	require.NoError(t, err)
+	get := loaded["/test.Service/Get"]
+	require.Len(t, get, 2)
+
+	md := metadata.Pairs("tenant", "acme", "x-request-id", "abc")
+	request := map[string]interface{}{"id": "123", "other": 1.0}
+	require.True(t, get[0].matches(request, md))
+	require.False(t, get[0].matches(map[string]interface{}{"id": "456"}, md))
+	require.False(t, get[0].matches(request, metadata.Pairs("tenant", "other")))
+	require.True(t, get[1].matches(map[string]interface{}{"id": "456"}, nil))
+
+	// nested fields must be present even if no values are required
+	nested := &responseTemplate{Match: map[string]interface{}{"inner": map[string]interface{}{}}}
+	require.True(t, nested.matches(map[string]interface{}{"inner": map[string]interface{}{"id": "1"}}, nil))
+	require.False(t, nested.matches(map[string]interface{}{"id": "1"}, nil))
+	require.False(t, nested.matches(nil, nil))
+
+	data := templateData{Request: request, Metadata: md, Count: 2}
+	headers, err := get[0].renderMetadata(get[0].Headers, data)
+	require.NoError(t, err)
+	require.Equal(t, metadata.Pairs("x-request-id", "abc"), headers)
+	response, err := get[0].render(get[0].Responses[0], data)
+	require.NoError(t, err)
+	require.Equal(t, map[string]interface{}{"id": "123", "name": "fixed", "count": "2"}, response)
+
+	notFound, err := get[1].renderStatus(templateData{Request: map[string]interface{}{"id": "456"}})
+	require.NoError(t, err)
+	require.Equal(t, codes.NotFound, notFound.Code())
+	require.Equal(t, "456 not found", notFound.Message())
+
+	_, err = loadTemplates(strings.NewReader(`[{"service": "test.Service", "method": "Get", "responses": [{"id": "{{.Request.id"}]}]`))
+	require.Error(t, err)
+}
+
+// fakeStream is a grpc.ServerStream receiving the given requests
+type fakeStream struct {
+	grpc.ServerStream
+	requests  [][]byte
+	responses [][]byte
+	// the client of an open stream hasn't finished sending so receiving
+	// beyond the given requests fails (rather than blocking forever)
+	open bool
+}
+
+func (s *fakeStream) Context() context.Context {
+	return context.Background()
+}
+
+func (s *fakeStream) RecvMsg(m interface{}) error {
+	if len(s.requests) == 0 {
+		if s.open {
+			return errors.New("client is still sending")
+		}
+		return io.EOF
+	}
+	*(m.(*[]byte)) = s.requests[0]
+	s.requests = s.requests[1:]
+	return nil
+}
+
+func (s *fakeStream) SendMsg(m interface{}) error {
+	s.responses = append(s.responses, m.([]byte))
+	return nil
+}
+
+func TestAdminService(t *testing.T) {
+	interceptor := newFixtureInterceptor(logrus.New(), Options{Sequence: SequenceStick}, proto_decoder.NewEncoder(), nil)
+	require.NoError(t, interceptor.addScenario("", strings.NewReader(pollingDump)))
+	require.NoError(t, interceptor.addScenario("other", strings.NewReader(timedDump)))
+	admin := adminService(interceptor)
+	request := interceptor.activeFixture()["/test.Service/Poll"].nextMessages[0]
+	interceptor.chooseResponse(request, request.responses())
+
+	// an empty message (i.e. google.protobuf.Empty) is sent in response
+	stream := &fakeStream{requests: [][]byte{nil}}
+	require.NoError(t, admin(nil, stream, &grpc.StreamServerInfo{FullMethod: adminResetMethod}, nil))
+	require.Equal(t, [][]byte{{}}, stream.responses)
+	require.Equal(t, "\n\x01", interceptor.chooseResponse(request, request.responses()).raw)
+
+	// the scenario name is a google.protobuf.StringValue
+	err := admin(nil, &fakeStream{requests: [][]byte{[]byte("\n\x07missing")}}, &grpc.StreamServerInfo{FullMethod: adminSetScenarioMethod}, nil)
+	require.Equal(t, codes.NotFound, status.Code(err))
+	require.NoError(t, admin(nil, &fakeStream{requests: [][]byte{[]byte("\n\x05other")}}, &grpc.StreamServerInfo{FullMethod: adminSetScenarioMethod}, nil))
+	require.Nil(t, interceptor.activeFixture()["/test.Service/Poll"])
+	require.NoError(t, admin(nil, &fakeStream{requests: [][]byte{nil}}, &grpc.StreamServerInfo{FullMethod: adminSetScenarioMethod}, nil))
+	require.NotNil(t, interceptor.activeFixture()["/test.Service/Poll"])
+
+	// other RPCs are passed on
+	handled := false
+	require.NoError(t, admin(nil, &fakeStream{}, &grpc.StreamServerInfo{FullMethod: "/test.Service/Poll"}, func(interface{}, grpc.ServerStream) error {
+		handled = true
+		return nil
+	}))
+	require.True(t, handled)
+}
+
+const coverageDump = `{"service":"test.Service","method":"Method","messages":[{"message_origin":"client","raw_message":"CgNmb28="},{"message_origin":"server","raw_message":"CgNiYXI="}],"metadata":{}}
+{"service":"test.Service","method":"Method","messages":[{"message_origin":"client","raw_message":"CgNiYXo="},{"message_origin":"server","raw_message":"CgNiYXI="}],"metadata":{}}`
+
+func TestCoverage(t *testing.T) {
+	interceptor := newFixtureInterceptor(logrus.New(), Options{}, proto_decoder.NewEncoder(), proto_decoder.NewDecoder(logrus.New()))
+	require.NoError(t, interceptor.addScenario("", strings.NewReader(coverageDump)))
+	info := &grpc.StreamServerInfo{FullMethod: "/test.Service/Method"}
+
+	stream := &fakeStream{requests: [][]byte{[]byte("\n\x03foo")}}
+	require.NoError(t, interceptor.intercept(nil, stream, info, nil))
+	require.Equal(t, [][]byte{[]byte("\n\x03bar")}, stream.responses)
+
+	err := interceptor.intercept(nil, &fakeStream{requests: [][]byte{[]byte("\n\x03fob")}}, info, nil)
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	require.Contains(t, status.Convert(err).Message(), "nearest differs at")
+
+	report := interceptor.coverageReport()
+	require.Len(t, report.Methods, 1)
+	method := report.Methods[0]
+	require.Equal(t, 2, method.Saved)
+	require.Equal(t, 1, method.Used)
+	require.Len(t, method.Unused, 1)
+	require.Equal(t, 1, method.Matched)
+	require.Equal(t, 1, method.Unmatched)
+	require.Len(t, report.Unmatched, 1)
+	require.Equal(t, []string{`1: expected "foo", got "fob"`}, report.Unmatched[0].NearestDifferences)
+
+	output := &bytes.Buffer{}
+	require.NoError(t, writeCoverageReport(output, report))
+	require.Contains(t, output.String(), `Unused /test.Service/Method: {"1":"baz"}`)
+
+	// resetting (or switching scenario) starts the coverage again
+	interceptor.reset()
+	require.Zero(t, interceptor.coverageReport().Methods[0].Used)
+	require.Empty(t, interceptor.coverageReport().Unmatched)
+	require.NoError(t, interceptor.intercept(nil, &fakeStream{requests: [][]byte{[]byte("\n\x03foo")}}, info, nil))
+	require.NoError(t, interceptor.setScenario(""))
+	require.Zero(t, interceptor.coverageReport().Methods[0].Matched)
+}
+
+func TestDirectServerWithReflection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grpc-fixture")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "fixture.sock")
+
+	resolvers, err := proto_decoder.LoadResolvers(logrus.New(), "../../integration_test", "", "")
+	require.NoError(t, err)
+	interceptor := newFixtureInterceptor(logrus.New(), Options{}, proto_decoder.NewEncoder(resolvers...), proto_decoder.NewDecoder(logrus.New(), resolvers...))
+	require.NoError(t, interceptor.addScenario("", strings.NewReader(coverageDump)))
+	reflection := newReflectionServer(proto_decoder.FileDescriptors(resolvers...))
+
+	server, err := grpc_proxy.New(
+		grpc_proxy.UnixSocket(socket),
+		grpc_proxy.DirectServer(),
+		grpc_proxy.WithInterceptor(reflection.intercept),
+		grpc_proxy.WithInterceptor(interceptor.intercept),
+	)
+	require.NoError(t, err)
+	require.NoError(t, server.Listen())
+	go server.Serve()
+	defer server.Stop()
+
+	dialer := func(ctx context.Context, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+	}
+	for name, transport := range map[string]grpc.DialOption{
+		"plaintext": grpc.WithInsecure(),
+		"tls":       grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{InsecureSkipVerify: true})),
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			conn, err := grpc.DialContext(ctx, "fixture", transport, grpc.WithContextDialer(dialer), grpc.WithBlock())
+			require.NoError(t, err)
+			defer conn.Close()
+
+			var resp []byte
+			err = conn.Invoke(ctx, "/test.Service/Method", []byte("\n\x03foo"), &resp, grpc.ForceCodec(codec.NoopCodec{}))
+			require.NoError(t, err)
+			require.Equal(t, "\n\x03bar", string(resp))
+
+			client := grpcreflect.NewClient(ctx, rpb.NewServerReflectionClient(conn))
+			defer client.Reset()
+			services, err := client.ListServices()
+			require.NoError(t, err)
+			require.Equal(t, []string{"bradleyjkemp.github.io.TestService"}, services)
+			service, err := client.ResolveService("bradleyjkemp.github.io.TestService")
+			require.NoError(t, err)
+			require.Len(t, service.GetMethods(), 2)
+		})
+	}
+}
+
+func TestTemplateResponses(t *testing.T) {
+	resolvers, err := proto_decoder.LoadResolvers(logrus.New(), "../../integration_test", "", "")
+	require.NoError(t, err)
+	interceptor := newFixtureInterceptor(logrus.New(), Options{}, proto_decoder.NewEncoder(resolvers...), proto_decoder.NewDecoder(logrus.New(), resolvers...))
+	require.NoError(t, interceptor.addScenario("", strings.NewReader(coverageDump)))
+	require.NoError(t, interceptor.addTemplates(strings.NewReader(`
+- service: bradleyjkemp.github.io.TestService
+  method: TestUnaryClientRequest
+  match:
+    outer_num: "5"
+  responses:
+    - outer_num: '{{.Request.outer_num}}0'
+- service: test.Service
+  method: Method
+  match:
+    "1": other
+  error:
+    code: NotFound
+`)))
+
+	t.Run("proto field names", func(t *testing.T) {
+		stream := &fakeStream{requests: [][]byte{{0x10, 5}}}
+		info := &grpc.StreamServerInfo{FullMethod: "/bradleyjkemp.github.io.TestService/TestUnaryClientRequest"}
+		require.NoError(t, interceptor.intercept(nil, stream, info, nil))
+		require.Equal(t, [][]byte{{0x10, 50}}, stream.responses)
+	})
+
+	t.Run("falls back to saved RPCs", func(t *testing.T) {
+		stream := &fakeStream{requests: [][]byte{[]byte("\n\x03foo")}}
+		info := &grpc.StreamServerInfo{FullMethod: "/test.Service/Method"}
+		require.NoError(t, interceptor.intercept(nil, stream, info, nil))
+		require.Equal(t, [][]byte{[]byte("\n\x03bar")}, stream.responses)
+	})
+
+	t.Run("bidirectional streams respond to the first request", func(t *testing.T) {
+		fullMethod := "/bradleyjkemp.github.io.TestService/TestUnaryClientRequest"
+		interceptor.bidiMethods[fullMethod] = true
+		defer delete(interceptor.bidiMethods, fullMethod)
+		stream := &fakeStream{requests: [][]byte{{0x10, 5}}, open: true}
+		require.NoError(t, interceptor.intercept(nil, stream, &grpc.StreamServerInfo{FullMethod: fullMethod}, nil))
+		require.Equal(t, [][]byte{{0x10, 50}}, stream.responses)
+	})
+}
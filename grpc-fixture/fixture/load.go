@@ -1,35 +1,55 @@
 package fixture
 
 import (
-	"encoding/json"
 	"github.com/bradleyjkemp/grpc-tools/internal"
 	"github.com/bradleyjkemp/grpc-tools/internal/proto_decoder"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 	"io"
-	"os"
+	"time"
 )
 
 // map of service name to message tree
 type fixture map[string]*messageTree
 
+// rpcEnd marks the end of a saved RPC in the message tree
+const rpcEnd internal.MessageOrigin = "end"
+
 type messageTree struct {
 	origin       internal.MessageOrigin
 	raw          string
 	nextMessages []*messageTree
+	// the recorded time between the previous message (or the start of the RPC)
+	// and this message. Only set for server messages.
+	delay time.Duration
+	// the response headers sent before this message (for server messages)
+	// or before finishing the RPC (for the end of an RPC)
+	headers metadata.MD
+	// the trailers and status the RPC finished with (status is nil for OK)
+	trailers metadata.MD
+	status   *status.Status
 }
 
-// load fixture creates a Trie-like structure of messages
-func loadFixture(dumpPath string, encoder proto_decoder.MessageEncoder) (fixture, error) {
-	dumpFile, err := os.Open(dumpPath)
-	if err != nil {
-		return nil, err
+// responses returns the server messages and RPC ends that can follow this message
+func (m *messageTree) responses() []*messageTree {
+	var responses []*messageTree
+	for _, next := range m.nextMessages {
+		if next.origin != internal.ClientMessage {
+			responses = append(responses, next)
+		}
 	}
+	return responses
+}
 
-	dumpDecoder := json.NewDecoder(dumpFile)
+// load fixture creates a Trie-like structure of messages.
+// If sequenced is set, responses are never merged so that each saved RPC
+// has its own branch after the last matching client message.
+func loadFixture(dump io.Reader, encoder proto_decoder.MessageEncoder, sequenced bool) (fixture, error) {
+	dumpReader := internal.NewDumpReader(dump)
 	fixture := map[string]*messageTree{}
 
 	for {
-		rpc := internal.RPC{}
-		err := dumpDecoder.Decode(&rpc)
+		rpc, err := dumpReader.Read()
 		if err == io.EOF {
 			break
 		}
@@ -41,16 +61,26 @@ func loadFixture(dumpPath string, encoder proto_decoder.MessageEncoder) (fixture
 			fixture[rpc.StreamName()] = &messageTree{}
 		}
 		messageTreeNode := fixture[rpc.StreamName()]
+		var previous time.Time
+		if rpc.Timing != nil {
+			previous = rpc.Timing.Received
+		}
+		headers := proto_decoder.EncodeBinaryMetadata(internal.ResponseHeaders, rpc.MetadataRespHeaders, rpc.BinaryMetadata)
+		// declares the HTTP trailers so is added by the transport itself
+		delete(headers, "trailer")
+		trailers := proto_decoder.EncodeBinaryMetadata(internal.ResponseTrailers, rpc.MetadataRespTrailers, rpc.BinaryMetadata)
 		for _, msg := range rpc.Messages {
 			msgBytes, err := encoder.Encode(rpc.StreamName(), msg)
 			if err != nil {
 				return nil, err
 			}
 			var foundExisting *messageTree
-			for _, nextMessage := range messageTreeNode.nextMessages {
-				if nextMessage.origin == msg.MessageOrigin && nextMessage.raw == string(msgBytes) {
-					foundExisting = nextMessage
-					break
+			if !sequenced || msg.MessageOrigin == internal.ClientMessage {
+				for _, nextMessage := range messageTreeNode.nextMessages {
+					if nextMessage.origin == msg.MessageOrigin && nextMessage.raw == string(msgBytes) {
+						foundExisting = nextMessage
+						break
+					}
 				}
 			}
 			if foundExisting == nil {
@@ -59,12 +89,51 @@ func loadFixture(dumpPath string, encoder proto_decoder.MessageEncoder) (fixture
 					raw:          string(msgBytes),
 					nextMessages: nil,
 				}
+				if msg.MessageOrigin == internal.ServerMessage {
+					foundExisting.delay = recordedDelay(previous, msg.Timestamp)
+					foundExisting.headers = headers
+				}
 				messageTreeNode.nextMessages = append(messageTreeNode.nextMessages, foundExisting)
 			}
 
 			messageTreeNode = foundExisting
+			previous = msg.Timestamp
 		}
+
+		if !sequenced && hasEnd(messageTreeNode) {
+			// an identical RPC has already been saved
+			continue
+		}
+		end := &messageTree{
+			origin:   rpcEnd,
+			headers:  headers,
+			trailers: trailers,
+		}
+		if rpc.Status != nil && rpc.Status.Code != "OK" {
+			end.status, err = proto_decoder.EncodeStatus(rpc.Status)
+			if err != nil {
+				return nil, err
+			}
+		}
+		messageTreeNode.nextMessages = append(messageTreeNode.nextMessages, end)
 	}
 
 	return fixture, nil
 }
+
+func hasEnd(m *messageTree) bool {
+	for _, next := range m.nextMessages {
+		if next.origin == rpcEnd {
+			return true
+		}
+	}
+	return false
+}
+
+// dumps without timestamps (or with clock changes) have no delay
+func recordedDelay(previous, timestamp time.Time) time.Duration {
+	if previous.IsZero() || timestamp.IsZero() || timestamp.Before(previous) {
+		return 0
+	}
+	return timestamp.Sub(previous)
+}
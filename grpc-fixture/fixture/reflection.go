@@ -0,0 +1,216 @@
+package fixture
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/jhump/protoreflect/desc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+)
+
+const reflectionMethod = "/grpc.reflection.v1alpha.ServerReflection/ServerReflectionInfo"
+
+// reflectionServer implements gRPC server reflection using the loaded proto files
+// (rather than the compiled in services that grpc/reflection uses)
+type reflectionServer struct {
+	files    map[string]*desc.FileDescriptor // all of the loaded files and their imports
+	services []string
+}
+
+func newReflectionServer(files []*desc.FileDescriptor) *reflectionServer {
+	r := &reflectionServer{
+		files: map[string]*desc.FileDescriptor{},
+	}
+	var addFile func(file *desc.FileDescriptor)
+	addFile = func(file *desc.FileDescriptor) {
+		if r.files[file.GetName()] != nil {
+			return
+		}
+		r.files[file.GetName()] = file
+		for _, dependency := range file.GetDependencies() {
+			addFile(dependency)
+		}
+	}
+	services := map[string]bool{}
+	for _, file := range files {
+		addFile(file)
+		for _, service := range file.GetServices() {
+			services[service.GetFullyQualifiedName()] = true
+		}
+	}
+	for service := range services {
+		r.services = append(r.services, service)
+	}
+	sort.Strings(r.services)
+	return r
+}
+
+// intercept answers reflection requests and passes all other RPCs on to the next handler
+func (r *reflectionServer) intercept(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if info.FullMethod != reflectionMethod {
+		return handler(srv, ss)
+	}
+
+	// files are only sent once per stream (as in grpc/reflection)
+	sent := map[string]bool{}
+	for {
+		var receivedMessage []byte
+		err := ss.RecvMsg(&receivedMessage)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		request := &rpb.ServerReflectionRequest{}
+		if err := proto.Unmarshal(receivedMessage, request); err != nil {
+			return status.Errorf(codes.InvalidArgument, "invalid reflection request: %v", err)
+		}
+		response, err := proto.Marshal(r.respond(request, sent))
+		if err != nil {
+			return err
+		}
+		if err := ss.SendMsg(response); err != nil {
+			return err
+		}
+	}
+}
+
+func (r *reflectionServer) respond(request *rpb.ServerReflectionRequest, sent map[string]bool) *rpb.ServerReflectionResponse {
+	response := &rpb.ServerReflectionResponse{
+		ValidHost:       request.GetHost(),
+		OriginalRequest: request,
+	}
+	var file *desc.FileDescriptor
+	switch req := request.GetMessageRequest().(type) {
+	case *rpb.ServerReflectionRequest_FileByFilename:
+		file = r.files[req.FileByFilename]
+	case *rpb.ServerReflectionRequest_FileContainingSymbol:
+		file = r.findSymbol(req.FileContainingSymbol)
+	case *rpb.ServerReflectionRequest_FileContainingExtension:
+		file = r.findExtension(req.FileContainingExtension.GetContainingType(), req.FileContainingExtension.GetExtensionNumber())
+	case *rpb.ServerReflectionRequest_AllExtensionNumbersOfType:
+		response.MessageResponse = &rpb.ServerReflectionResponse_AllExtensionNumbersResponse{
+			AllExtensionNumbersResponse: &rpb.ExtensionNumberResponse{
+				BaseTypeName:    req.AllExtensionNumbersOfType,
+				ExtensionNumber: r.extensionNumbers(req.AllExtensionNumbersOfType),
+			},
+		}
+		return response
+	case *rpb.ServerReflectionRequest_ListServices:
+		listServices := &rpb.ListServiceResponse{}
+		for _, service := range r.services {
+			listServices.Service = append(listServices.Service, &rpb.ServiceResponse{Name: service})
+		}
+		response.MessageResponse = &rpb.ServerReflectionResponse_ListServicesResponse{
+			ListServicesResponse: listServices,
+		}
+		return response
+	default:
+		return errorResponse(response, codes.InvalidArgument, fmt.Sprintf("invalid MessageRequest: %v", request.GetMessageRequest()))
+	}
+
+	if file == nil {
+		return errorResponse(response, codes.NotFound, "file not found")
+	}
+	fileDescriptors, err := r.fileWithDependencies(file, sent)
+	if err != nil {
+		return errorResponse(response, codes.Internal, err.Error())
+	}
+	response.MessageResponse = &rpb.ServerReflectionResponse_FileDescriptorResponse{
+		FileDescriptorResponse: &rpb.FileDescriptorResponse{
+			FileDescriptorProto: fileDescriptors,
+		},
+	}
+	return response
+}
+
+func errorResponse(response *rpb.ServerReflectionResponse, code codes.Code, message string) *rpb.ServerReflectionResponse {
+	response.MessageResponse = &rpb.ServerReflectionResponse_ErrorResponse{
+		ErrorResponse: &rpb.ErrorResponse{
+			ErrorCode:    int32(code),
+			ErrorMessage: message,
+		},
+	}
+	return response
+}
+
+func (r *reflectionServer) findSymbol(symbol string) *desc.FileDescriptor {
+	for _, file := range r.files {
+		if file.FindSymbol(symbol) != nil {
+			return file
+		}
+	}
+	return nil
+}
+
+func (r *reflectionServer) findExtension(containingType string, number int32) *desc.FileDescriptor {
+	for _, file := range r.files {
+		for _, extension := range allExtensions(file) {
+			if extension.GetOwner().GetFullyQualifiedName() == containingType && extension.GetNumber() == number {
+				return file
+			}
+		}
+	}
+	return nil
+}
+
+func (r *reflectionServer) extensionNumbers(containingType string) []int32 {
+	var numbers []int32
+	for _, file := range r.files {
+		for _, extension := range allExtensions(file) {
+			if extension.GetOwner().GetFullyQualifiedName() == containingType {
+				numbers = append(numbers, extension.GetNumber())
+			}
+		}
+	}
+	sort.Slice(numbers, func(i, j int) bool {
+		return numbers[i] < numbers[j]
+	})
+	return numbers
+}
+
+// allExtensions returns the extensions declared in a file (including those nested in messages)
+func allExtensions(file *desc.FileDescriptor) []*desc.FieldDescriptor {
+	extensions := file.GetExtensions()
+	var addNested func(messages []*desc.MessageDescriptor)
+	addNested = func(messages []*desc.MessageDescriptor) {
+		for _, message := range messages {
+			extensions = append(extensions, message.GetNestedExtensions()...)
+			addNested(message.GetNestedMessageTypes())
+		}
+	}
+	addNested(file.GetMessageTypes())
+	return extensions
+}
+
+// fileWithDependencies serializes a file and any of its (transitive) imports that haven't already been sent
+func (r *reflectionServer) fileWithDependencies(file *desc.FileDescriptor, sent map[string]bool) ([][]byte, error) {
+	var serialized [][]byte
+	var add func(file *desc.FileDescriptor, force bool) error
+	add = func(file *desc.FileDescriptor, force bool) error {
+		if sent[file.GetName()] && !force {
+			return nil
+		}
+		sent[file.GetName()] = true
+		b, err := proto.Marshal(file.AsFileDescriptorProto())
+		if err != nil {
+			return err
+		}
+		serialized = append(serialized, b)
+		for _, dependency := range file.GetDependencies() {
+			if err := add(dependency, false); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	// the requested file is always sent
+	err := add(file, true)
+	return serialized, err
+}
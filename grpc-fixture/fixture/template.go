@@ -0,0 +1,272 @@
+package fixture
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/bradleyjkemp/grpc-tools/internal"
+	"github.com/bradleyjkemp/grpc-tools/internal/proto_decoder"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"gopkg.in/yaml.v3"
+)
+
+// responseTemplate is a hand written fixture entry. String values in its
+// responses, headers, trailers and error are rendered as text/templates
+// for each request it matches.
+type responseTemplate struct {
+	Service string `yaml:"service"`
+	Method  string `yaml:"method"`
+	// decoded request fields that must be present (with the same values) for the template to match
+	Match map[string]interface{} `yaml:"match"`
+	// request metadata values that must be present for the template to match
+	MatchMetadata map[string]string `yaml:"match_metadata"`
+
+	Responses []interface{}     `yaml:"responses"`
+	Headers   map[string]string `yaml:"headers"`
+	Trailers  map[string]string `yaml:"trailers"`
+	Error     *templateError    `yaml:"error"`
+
+	// the templates for all string values (named by the string itself)
+	parsed *template.Template
+}
+
+type templateError struct {
+	Code    string `yaml:"code"`
+	Message string `yaml:"message"`
+	Details []struct {
+		TypeURL string      `yaml:"type_url"`
+		Value   interface{} `yaml:"value"`
+	} `yaml:"details"`
+}
+
+// templateData is available to the templates as "."
+type templateData struct {
+	// the first request message (decoded) and all request messages
+	Request  interface{}
+	Requests []interface{}
+	Metadata metadata.MD
+	// the number of times this template has matched (starting from 1)
+	Count int
+	// the index of the response being rendered
+	Index int
+}
+
+var templateFuncs = template.FuncMap{
+	"now": func() string {
+		return time.Now().Format(time.RFC3339Nano)
+	},
+	"unix": func() int64 {
+		return time.Now().Unix()
+	},
+	"metadata": func(md metadata.MD, key string) string {
+		if values := md.Get(key); len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	},
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// loadTemplates reads a list of response templates (in either YAML or JSON format)
+func loadTemplates(r io.Reader) (map[string][]*responseTemplate, error) {
+	var templates []*responseTemplate
+	if err := yaml.NewDecoder(r).Decode(&templates); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	loaded := map[string][]*responseTemplate{}
+	for i, t := range templates {
+		if t.Service == "" || t.Method == "" {
+			return nil, fmt.Errorf("template %d: service and method are required", i)
+		}
+		fullMethod := fmt.Sprintf("/%s/%s", t.Service, t.Method)
+		t.parsed = template.New(fullMethod).Funcs(templateFuncs).Option("missingkey=zero")
+		values := []interface{}{t.Responses, t.Headers, t.Trailers}
+		if t.Error != nil {
+			values = append(values, t.Error.Message)
+		}
+		if err := t.parseStrings(values...); err != nil {
+			return nil, fmt.Errorf("template %d (%s/%s): %v", i, t.Service, t.Method, err)
+		}
+		loaded[fullMethod] = append(loaded[fullMethod], t)
+	}
+	return loaded, nil
+}
+
+// isTemplate checks whether a string contains any actions (other strings are used as is)
+func isTemplate(s string) bool {
+	return strings.Contains(s, "{{")
+}
+
+// parseStrings adds every string found in the values to the template set
+// so that syntax errors are found on startup
+func (t *responseTemplate) parseStrings(values ...interface{}) error {
+	for _, value := range values {
+		switch v := value.(type) {
+		case string:
+			if !isTemplate(v) || t.parsed.Lookup(v) != nil {
+				continue
+			}
+			if _, err := t.parsed.New(v).Parse(v); err != nil {
+				return err
+			}
+		case map[string]interface{}:
+			for _, nested := range v {
+				if err := t.parseStrings(nested); err != nil {
+					return err
+				}
+			}
+		case map[string]string:
+			for _, nested := range v {
+				if err := t.parseStrings(nested); err != nil {
+					return err
+				}
+			}
+		case []interface{}:
+			if err := t.parseStrings(v...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// matches checks whether the template applies to a request
+func (t *responseTemplate) matches(request interface{}, md metadata.MD) bool {
+	for key, value := range t.MatchMetadata {
+		if !containsString(md.Get(key), value) {
+			return false
+		}
+	}
+	if len(t.Match) == 0 {
+		return true
+	}
+	match, err := normaliseJSON(t.Match)
+	if err != nil {
+		return false
+	}
+	return matchesSubset(match, request)
+}
+
+// matchesSubset checks that every field of expected has the same value in actual
+func matchesSubset(expected, actual interface{}) bool {
+	expectedMap, ok := expected.(map[string]interface{})
+	if !ok {
+		return reflect.DeepEqual(expected, actual)
+	}
+	actualMap, ok := actual.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	for key, value := range expectedMap {
+		if !matchesSubset(value, actualMap[key]) {
+			return false
+		}
+	}
+	return true
+}
+
+// render executes the templates in a value returning a copy with all strings replaced
+func (t *responseTemplate) render(value interface{}, data templateData) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		if !isTemplate(v) {
+			return v, nil
+		}
+		var rendered bytes.Buffer
+		if err := t.parsed.ExecuteTemplate(&rendered, v, data); err != nil {
+			return nil, err
+		}
+		return rendered.String(), nil
+	case map[string]interface{}:
+		renderedMap := map[string]interface{}{}
+		for key, nested := range v {
+			rendered, err := t.render(nested, data)
+			if err != nil {
+				return nil, err
+			}
+			renderedMap[key] = rendered
+		}
+		return renderedMap, nil
+	case []interface{}:
+		var renderedList []interface{}
+		for _, nested := range v {
+			rendered, err := t.render(nested, data)
+			if err != nil {
+				return nil, err
+			}
+			renderedList = append(renderedList, rendered)
+		}
+		return renderedList, nil
+	default:
+		return v, nil
+	}
+}
+
+func (t *responseTemplate) renderMetadata(md map[string]string, data templateData) (metadata.MD, error) {
+	rendered := metadata.MD{}
+	for key, value := range md {
+		renderedValue, err := t.render(value, data)
+		if err != nil {
+			return nil, err
+		}
+		rendered.Append(key, renderedValue.(string))
+	}
+	return rendered, nil
+}
+
+func (t *responseTemplate) renderStatus(data templateData) (*status.Status, error) {
+	if t.Error == nil {
+		return nil, nil
+	}
+	message, err := t.render(t.Error.Message, data)
+	if err != nil {
+		return nil, err
+	}
+	dumped := &internal.Status{
+		Code:    t.Error.Code,
+		Message: message.(string),
+	}
+	for _, detail := range t.Error.Details {
+		value, err := normaliseJSON(detail.Value)
+		if err != nil {
+			return nil, err
+		}
+		dumped.Details = append(dumped.Details, &internal.StatusDetail{
+			TypeURL: detail.TypeURL,
+			Value:   value,
+		})
+	}
+	return proto_decoder.EncodeStatus(dumped)
+}
+
+// normaliseJSON converts a value (e.g. parsed from YAML) into the form
+// encoding/json would have parsed so they can be compared
+func normaliseJSON(value interface{}) (interface{}, error) {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var normalised interface{}
+	err = json.Unmarshal(b, &normalised)
+	return normalised, err
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
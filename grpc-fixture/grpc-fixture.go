@@ -12,13 +12,59 @@ import (
 func main() {
 	var (
 		dumpPath         = flag.String("dump", "", "gRPC dump to serve requests from")
+		direct           = flag.Bool("direct", false, "Serve as a plain gRPC server (plaintext or TLS) that clients connect to directly instead of as a proxy.")
+		reflection       = flag.Bool("reflection", false, "Answer gRPC server reflection requests using the loaded protos.")
+		templates        = flag.String("templates", "", "A comma separated list of YAML or JSON files of hand written response templates.")
 		protoRoots       = flag.String("proto_roots", "", "A comma separated list of directories to search for gRPC service definitions.")
-		protoDescriptors = flag.String("proto_descriptors", "", "A comma separated list of proto descriptors to load gRPC service definitions from.")
+		protoImportPaths = flag.String("proto_import_paths", "", "A comma separated list of directories to search for imports of the files in --proto_roots.")
+		protoDescriptors = flag.String("proto_descriptors", "", "A comma separated list of descriptor set files (protoc --descriptor_set_out or buf image) to load gRPC service definitions from.")
+		responseDelay    = flag.Duration("response_delay", 0, "Delay (e.g. 100ms) before sending each response. RPCs fail with DeadlineExceeded if the client's deadline is reached first.")
+		replayTiming     = flag.Bool("replay_timing", false, "Wait the recorded time between messages before sending each response.")
+		timingScale      = flag.Float64("timing_scale", 1, "Multiplier applied to the recorded delays when using --replay_timing.")
+		timingJitter     = flag.Duration("timing_jitter", 0, "Add a random amount up to +/- this duration to each response delay.")
+		methodLatency    = flag.String("method_latency", "", "A comma separated list of /package.Service/Method=duration pairs of extra latency before the first response of a method.")
+		sequence         = flag.String("sequence", "", "Send the Nth saved response to the Nth identical request. Either wrap (start again from the first) or stick (repeat the last) once the saved responses run out.")
+		scenarios        = flag.String("scenarios", "", "A comma separated list of name=dump pairs of alternative dumps that can be switched to using the admin service or server.")
 	)
 
 	grpc_proxy.RegisterDefaultFlags()
 	flag.Parse()
-	err := fixture.Run(*protoRoots, *protoDescriptors, *dumpPath, grpc_proxy.DefaultFlags())
+	methodLatencies, err := fixture.ParseMethodLatency(*methodLatency)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		os.Exit(1)
+	}
+	sequenceMode, err := fixture.ParseSequenceMode(*sequence)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		os.Exit(1)
+	}
+	scenarioDumps, err := fixture.ParseScenarios(*scenarios)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		os.Exit(1)
+	}
+	err = fixture.Run(fixture.Config{
+		ProtoRoots:       *protoRoots,
+		ProtoImportPaths: *protoImportPaths,
+		ProtoDescriptors: *protoDescriptors,
+		DumpPath:         *dumpPath,
+		Templates:        *templates,
+		Direct:           *direct,
+		Reflection:       *reflection,
+		Scenarios:        scenarioDumps,
+		Options: fixture.Options{
+			ResponseDelay: *responseDelay,
+			ReplayTiming:  *replayTiming,
+			TimingScale:   *timingScale,
+			Jitter:        *timingJitter,
+			MethodLatency: methodLatencies,
+			Sequence:      sequenceMode,
+		},
+	}, grpc_proxy.DefaultFlags())
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		flag.Usage()
@@ -0,0 +1,65 @@
+package grpc_proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+)
+
+// WithAdminHandler registers a handler on the admin HTTP server.
+// The admin server is only started if an address is set (see AdminAddress).
+func WithAdminHandler(pattern string, handler http.Handler) Configurator {
+	return func(s *server) {
+		s.adminHandlers[pattern] = handler
+	}
+}
+
+// AdminAddress sets the address (host:port) that the admin HTTP server listens on.
+func AdminAddress(address string) Configurator {
+	return func(s *server) {
+		s.adminAddress = address
+	}
+}
+
+func (s *server) newAdminServer() *http.Server {
+	mux := http.NewServeMux()
+	var patterns []string
+	for pattern, handler := range s.adminHandlers {
+		mux.Handle(pattern, handler)
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+
+	if _, ok := s.adminHandlers["/"]; !ok {
+		// list the available endpoints
+		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/" {
+				http.NotFound(w, r)
+				return
+			}
+			for _, pattern := range patterns {
+				fmt.Fprintln(w, pattern)
+			}
+		})
+	}
+	return &http.Server{Handler: mux}
+}
+
+func (s *server) startAdminServer(errChan chan<- error) error {
+	if s.adminAddress == "" {
+		return nil
+	}
+	listener, err := net.Listen("tcp", s.adminAddress)
+	if err != nil {
+		return fmt.Errorf("failed to listen on admin address (%s): %v", s.adminAddress, err)
+	}
+	s.logger.Infof("Admin server listening on %s", listener.Addr())
+
+	adminServer := s.newAdminServer()
+	s.httpServers = append(s.httpServers, adminServer)
+	go func() {
+		errChan <- adminServer.Serve(listener)
+	}()
+	return nil
+}
@@ -0,0 +1,197 @@
+package grpc_proxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/bradleyjkemp/grpc-tools/internal/connstate"
+	"github.com/sirupsen/logrus"
+)
+
+// ProxyAuth requires clients to authenticate (using Proxy-Authorization basic auth
+// or SOCKS5 username/password authentication) before the proxy can be used.
+// It can be used multiple times to add several users.
+func ProxyAuth(username, password string) Configurator {
+	return func(s *server) {
+		if s.auth.users == nil {
+			s.auth.users = map[string]string{}
+		}
+		s.auth.users[username] = password
+	}
+}
+
+// AllowClients only accepts connections from clients with addresses in the
+// given CIDRs (or IP addresses). Clients connecting to unix sockets are local
+// so are only accepted if the loopback address is allowed.
+func AllowClients(cidrs ...string) Configurator {
+	return func(s *server) {
+		s.allowedClients = append(s.allowedClients, cidrs...)
+	}
+}
+
+// proxyAuth checks the credentials of clients using the proxy
+type proxyAuth struct {
+	users   map[string]string // passwords by username (nil if authentication isn't required)
+	allowed []*net.IPNet      // the client addresses allowed to connect (empty allows all)
+}
+
+func (a *proxyAuth) required() bool {
+	return len(a.users) > 0
+}
+
+func (a *proxyAuth) check(username, password string) bool {
+	expected, ok := a.users[username]
+	// compare anyway so that the time taken doesn't reveal whether the user exists
+	matches := subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1
+	return ok && matches
+}
+
+// checkHeader checks a Proxy-Authorization header returning the user
+func (a *proxyAuth) checkHeader(header string) (string, bool) {
+	const prefix = "Basic "
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(header[len(prefix):])
+	if err != nil {
+		return "", false
+	}
+	credentials := strings.SplitN(string(decoded), ":", 2)
+	if len(credentials) != 2 || !a.check(credentials[0], credentials[1]) {
+		return "", false
+	}
+	return credentials[0], true
+}
+
+// proxyAuthenticator checks whether a request may use the proxy returning the proxy user (if any).
+// grpcRequest is set for gRPC requests which, unlike CONNECT and HTTP proxy requests,
+// only need authenticating if they choose their own destination.
+type proxyAuthenticator func(r *http.Request, grpcRequest bool) (string, bool)
+
+func (s *server) authenticator(l *listener) proxyAuthenticator {
+	return func(r *http.Request, grpcRequest bool) (string, bool) {
+		if state := connstate.FromContext(r.Context()); state != nil && state.Tunnelled {
+			// the client authenticated (if required) when opening the tunnel
+			return state.ProxyUser, true
+		}
+		if !s.auth.required() {
+			return "", true
+		}
+		switch l.config.Mode {
+		case TransparentMode:
+			// redirected requests go to their original destination
+			// but the listener can still be used as an HTTP proxy
+			if !proxyRequest(r) {
+				return "", true
+			}
+		case DestinationMode:
+			if grpcRequest {
+				return "", true
+			}
+		}
+		return s.auth.checkHeader(r.Header.Get("Proxy-Authorization"))
+	}
+}
+
+// proxyRequest checks whether a request uses the proxy as an HTTP proxy (i.e. CONNECT
+// or an absolute URI) rather than being sent to its destination
+func proxyRequest(r *http.Request) bool {
+	if r.Method == http.MethodConnect {
+		return true
+	}
+	requestURL, err := url.ParseRequestURI(r.RequestURI)
+	return err == nil && requestURL.IsAbs()
+}
+
+func proxyAuthRequired(w http.ResponseWriter) {
+	w.Header().Set("Proxy-Authenticate", `Basic realm="grpc-proxy"`)
+	http.Error(w, http.StatusText(http.StatusProxyAuthRequired), http.StatusProxyAuthRequired)
+}
+
+func parseAllowedClients(cidrs []string) ([]*net.IPNet, error) {
+	var allowed []*net.IPNet
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			// a single address
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid client address %q", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			allowed = append(allowed, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client CIDR %q: %v", cidr, err)
+		}
+		allowed = append(allowed, network)
+	}
+	return allowed, nil
+}
+
+func (a *proxyAuth) allowedClient(addr net.Addr) bool {
+	if len(a.allowed) == 0 {
+		return true
+	}
+	var ips []net.IP
+	switch addr := connstate.Unwrap(addr).(type) {
+	case *net.TCPAddr:
+		ips = []net.IP{addr.IP}
+	default:
+		// e.g. unix sockets which can only be connected to locally
+		ips = []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	}
+	for _, network := range a.allowed {
+		for _, ip := range ips {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// allowlistListener closes connections from clients that aren't allowed
+type allowlistListener struct {
+	logger logrus.FieldLogger
+	auth   *proxyAuth
+	net.Listener
+}
+
+func (l allowlistListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.auth.allowedClient(conn.RemoteAddr()) {
+			return conn, nil
+		}
+		l.logger.Warnf("Rejected connection from %v (not in the allowed clients)", conn.RemoteAddr())
+		_ = conn.Close()
+	}
+}
+
+type proxyUserKey struct{}
+
+func withProxyUser(ctx context.Context, user string) context.Context {
+	if user == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, proxyUserKey{}, user)
+}
+
+func proxyUserFromContext(ctx context.Context) string {
+	user, _ := ctx.Value(proxyUserKey{}).(string)
+	return user
+}
@@ -2,13 +2,19 @@ package grpc_proxy
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/bradleyjkemp/grpc-tools/internal/codec"
+	"github.com/bradleyjkemp/grpc-tools/internal/connlog"
+	"github.com/bradleyjkemp/grpc-tools/internal/connstate"
 	"github.com/bradleyjkemp/grpc-tools/internal/marker"
+	"github.com/bradleyjkemp/grpc-tools/internal/proxydialer"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
@@ -22,7 +28,7 @@ var proxyStreamDesc = &grpc.StreamDesc{
 }
 
 // Originally based on github.com/mwitkow/grpc-proxy/proxy/handler.go
-func (s *server) proxyHandler(srv interface{}, ss grpc.ServerStream) error {
+func (s *server) proxyHandler(l *listener, srv interface{}, ss grpc.ServerStream) error {
 	md, ok := metadata.FromIncomingContext(ss.Context())
 	if !ok {
 		return status.Error(codes.Unknown, "could not extract metadata from request")
@@ -33,36 +39,53 @@ func (s *server) proxyHandler(srv interface{}, ss grpc.ServerStream) error {
 		grpc.WithBlock(),
 	)
 	if marker.IsTLSRPC(md) {
-		options = append(options, grpc.WithTransportCredentials(credentials.NewTLS(nil)))
+		options = append(options, grpc.WithTransportCredentials(s.upstreamCredentials()))
 	} else {
 		options = append(options, grpc.WithInsecure())
 	}
 
-	destinationAddr, err := s.calculateDestination(md)
+	destinationAddr, err := s.calculateDestination(ss.Context(), md, l)
 	if err != nil {
 		return err
 	}
+	if proxydialer.IsUnixTarget(destinationAddr) {
+		// otherwise the socket path would be sent as the :authority
+		options = append(options, grpc.WithAuthority("localhost"))
+	}
+	stats := rpcStatsFromContext(ss.Context())
 	destination, err := s.connPool.GetClientConn(ss.Context(), destinationAddr, options...)
 	if err != nil {
 		return err
 	}
+	stats.updateTiming(func(timing *RPCTiming) {
+		timing.UpstreamConnected = time.Now()
+	})
 	// little bit of gRPC internals never hurt anyone
 	fullMethodName, ok := grpc.MethodFromServerStream(ss)
 	if !ok {
 		return status.Errorf(codes.Internal, "no method exists in context")
 	}
 
+	var callOptions []grpc.CallOption
+	if requestEncoding := stats.RequestEncoding(); requestEncoding != "" {
+		// compress requests in the same way the client did
+		callOptions = append(callOptions, grpc.UseCompressor(requestEncoding))
+	}
+
 	clientCtx, clientCancel := getClientCtx(ss.Context())
-	clientStream, err := destination.NewStream(clientCtx, proxyStreamDesc, fullMethodName)
+	clientStream, err := destination.NewStream(clientCtx, proxyStreamDesc, fullMethodName, callOptions...)
 	if err != nil {
 		return err
 	}
+	stats.updateTiming(func(timing *RPCTiming) {
+		timing.UpstreamRequestSent = time.Now()
+	})
 
 	// Explicitly *do not close* s2cErrChan and c2sErrChan, otherwise the select below will not terminate.
 	// Channels do not have to be closed, it is just a control flow mechanism, see
 	// https://groups.google.com/forum/#!msg/golang-nuts/pZwdYRGxCIk/qpbHxRRPJdUJ
 	s2cErrChan := forwardServerToClient(ss, clientStream)
-	c2sErrChan := forwardClientToServer(clientStream, ss)
+	c2sErrChan := forwardClientToServer(clientStream, ss, stats)
 	// We don't know which side is going to stop sending first, so we need a select between the two.
 	for i := 0; i < 2; i++ {
 		select {
@@ -84,6 +107,13 @@ func (s *server) proxyHandler(srv interface{}, ss grpc.ServerStream) error {
 			// This happens when the clientStream has nothing else to offer (io.EOF), returned a gRPC error. In those two
 			// cases we may have received Trailers as part of the call. In case of other errors (stream closed) the trailers
 			// will be nil.
+			stats.updateTiming(func(timing *RPCTiming) {
+				timing.UpstreamFinished = time.Now()
+				if timing.FirstResponse.IsZero() {
+					// a trailers-only response
+					timing.FirstResponse = timing.UpstreamFinished
+				}
+			})
 			ss.SetTrailer(clientStream.Trailer())
 			// c2sErr will contain RPC error from client code. If not io.EOF return the RPC error as server stream error.
 			if c2sErr != io.EOF {
@@ -95,13 +125,49 @@ func (s *server) proxyHandler(srv interface{}, ss grpc.ServerStream) error {
 	return status.Errorf(codes.Internal, "gRPC proxying should never reach this stage.")
 }
 
-func (s *server) calculateDestination(md metadata.MD) (string, error) {
+// upstreamCredentials are used to connect to TLS upstream servers
+func (s *server) upstreamCredentials() credentials.TransportCredentials {
+	if s.capture == nil {
+		return credentials.NewTLS(nil)
+	}
+	return capturedCredentials{credentials.NewTLS(&tls.Config{
+		KeyLogWriter: s.capture.KeyLogWriter(),
+	})}
+}
+
+// capturedCredentials captures the frames sent over upstream connections once
+// the TLS handshake is done
+type capturedCredentials struct {
+	credentials.TransportCredentials
+}
+
+func (c capturedCredentials) ClientHandshake(ctx context.Context, authority string, rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	conn, authInfo, err := c.TransportCredentials.ClientHandshake(ctx, authority, rawConn)
+	if err != nil {
+		return nil, nil, err
+	}
+	return connlog.UpstreamTLS(rawConn, conn), authInfo, nil
+}
+
+func (c capturedCredentials) Clone() credentials.TransportCredentials {
+	return capturedCredentials{c.TransportCredentials.Clone()}
+}
+
+func (s *server) calculateDestination(ctx context.Context, md metadata.MD, l *listener) (string, error) {
 	authority := md.Get(":authority")
+	state := connstate.FromContext(ctx)
 	var destinationAddr string
 	switch {
-	case s.destination != "":
+	case l.config.Destination != "":
 		// used hardcoded destination if set (used by clients not supporting HTTP proxies)
-		destinationAddr = s.destination
+		destinationAddr = l.config.Destination
+
+	case l.config.Mode == TransparentMode:
+		// the client connected to the destination (the :authority could be anything)
+		if state == nil || state.Destination == "" {
+			return "", status.Error(codes.PermissionDenied, "the connection wasn't redirected to the proxy so has no destination")
+		}
+		destinationAddr = state.Destination
 
 	case len(authority) > 0:
 		// use authority from request
@@ -113,21 +179,27 @@ func (s *server) calculateDestination(md metadata.MD) (string, error) {
 	}
 
 	// if this a gRPC-Web connection then it doesn't have a port so we add the default
-	if !strings.Contains(destinationAddr, ":") {
+	// (unix sockets don't have ports)
+	if _, _, err := net.SplitHostPort(destinationAddr); err != nil && !proxydialer.IsUnixTarget(destinationAddr) {
+		host := strings.TrimSuffix(strings.TrimPrefix(destinationAddr, "["), "]")
 		if marker.IsTLSRPC(md) {
-			destinationAddr = destinationAddr + ":443"
+			destinationAddr = net.JoinHostPort(host, "443")
 		} else {
-			destinationAddr = destinationAddr + ":80"
+			destinationAddr = net.JoinHostPort(host, "80")
 		}
 	}
 
-	if err := marker.AddLoopCheck(md, s.listener.Addr().String()); err != nil {
+	if err := marker.AddLoopCheck(md, l.Addr().String()); err != nil {
 		return "", err
 	}
 
 	return destinationAddr, nil
 }
 
+// getClientCtx derives the context for the upstream request from the client's.
+// The derived context inherits the client's deadline (which gRPC calculates from
+// grpc-timeout when the request arrives) so the time spent in the proxy is
+// deducted from the grpc-timeout sent upstream.
 func getClientCtx(serverCtx context.Context) (context.Context, context.CancelFunc) {
 	clientCtx, clientCancel := context.WithCancel(serverCtx)
 
@@ -139,7 +211,7 @@ func getClientCtx(serverCtx context.Context) (context.Context, context.CancelFun
 	return clientCtx, clientCancel
 }
 
-func forwardClientToServer(src grpc.ClientStream, dst grpc.ServerStream) chan error {
+func forwardClientToServer(src grpc.ClientStream, dst grpc.ServerStream, stats *rpcStats) chan error {
 	ret := make(chan error, 1)
 	go func() {
 		var f []byte
@@ -149,6 +221,9 @@ func forwardClientToServer(src grpc.ClientStream, dst grpc.ServerStream) chan er
 				break
 			}
 			if i == 0 {
+				stats.updateTiming(func(timing *RPCTiming) {
+					timing.FirstResponse = time.Now()
+				})
 				// This is a bit of a hack, but client to server headers are only readable after first client msg is
 				// received but must be written to server stream before the first msg is flushed.
 				// This is the only place to do it nicely.
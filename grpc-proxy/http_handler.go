@@ -1,12 +1,18 @@
 package grpc_proxy
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"strings"
 
+	"github.com/bradleyjkemp/grpc-tools/internal"
+	"github.com/bradleyjkemp/grpc-tools/internal/connlog"
+	"github.com/bradleyjkemp/grpc-tools/internal/connstate"
 	"github.com/bradleyjkemp/grpc-tools/internal/marker"
 
 	"github.com/sirupsen/logrus"
@@ -19,15 +25,33 @@ type grpcWebServer interface {
 	IsGrpcWebRequest(req *http.Request) bool
 }
 
-func newHttpServer(logger logrus.FieldLogger, grpcHandler grpcWebServer, internalRedirect func(net.Conn, string), reverseProxy http.Handler) *http.Server {
+func newHttpServer(logger logrus.FieldLogger, grpcHandler grpcWebServer, internalRedirect func(net.Conn, string, string), reverseProxy http.Handler, authenticate proxyAuthenticator) *http.Server {
+	if authenticate == nil {
+		authenticate = func(*http.Request, bool) (string, bool) {
+			return "", true
+		}
+	}
 	return &http.Server{
-		Handler: h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// makes the state of the connection available to the gRPC handler
+		ConnContext: connstate.ConnContext,
+		Handler: h2cHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			grpcRequest := r.Method != http.MethodConnect && isGrpcRequest(grpcHandler, r)
+			user, ok := authenticate(r, grpcRequest)
+			if !ok {
+				logger.Debugf("Rejecting unauthenticated %s request from %s", r.Method, r.RemoteAddr)
+				proxyAuthRequired(w)
+				return
+			}
+			// the credentials are for this proxy so mustn't be forwarded (or dumped)
+			r.Header.Del("Proxy-Authorization")
+
 			switch {
 			case r.Method == http.MethodConnect:
 				logger.Debug("Handling HTTP CONNECT request for destination ", r.URL)
-				handleConnect(w, r, internalRedirect)
-			case isGrpcRequest(grpcHandler, r):
+				handleConnect(w, r, internalRedirect, user)
+			case grpcRequest:
 				logger.Debug("Handling gRPC request ", r.URL)
+				r = r.WithContext(withProxyUser(r.Context(), user))
 				// This request may be a gRPC-Web request that came in on HTTP/1.X
 				// So delete any legacy headers that will cause gRPC to break
 				// I don't really know why this works but without these lines the integration tests fail
@@ -54,11 +78,57 @@ func newHttpServer(logger logrus.FieldLogger, grpcHandler grpcWebServer, interna
 				logger.Debugf("Reverse proxying request %s %s", r.Method, r.URL)
 				reverseProxy.ServeHTTP(w, r)
 			}
-		}), &http2.Server{}),
+		})),
 	}
 }
 
-func handleConnect(w http.ResponseWriter, r *http.Request, internalRedirect func(net.Conn, string)) {
+// h2cHandler serves HTTP/2 without TLS (h2c) as well as HTTP/1.
+// Unlike h2c.NewHandler, connections using prior knowledge (i.e. gRPC clients)
+// are served with the request's context so that RPCs see the connection's state.
+func h2cHandler(handler http.Handler) http.Handler {
+	upgradeHandler := h2c.NewHandler(handler, &http2.Server{})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PRI" || r.URL.Path != "*" || r.Proto != "HTTP/2.0" {
+			upgradeHandler.ServeHTTP(w, r)
+			return
+		}
+		hijacker, ok := w.(http.Hijacker)
+		if !ok {
+			http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+			return
+		}
+		conn, rw, err := hijacker.Hijack()
+		if err != nil {
+			return
+		}
+		// the rest of the connection preface follows the "request"
+		const prefaceBody = "SM\r\n\r\n"
+		body := make([]byte, len(prefaceBody))
+		if _, err := io.ReadFull(rw, body); err != nil || string(body) != prefaceBody {
+			_ = conn.Close()
+			return
+		}
+		(&http2.Server{}).ServeConn(bufferedConn{
+			Conn:   conn,
+			reader: io.MultiReader(strings.NewReader(http2.ClientPreface), rw),
+		}, &http2.ServeConnOpts{
+			Context: r.Context(),
+			Handler: handler,
+		})
+	})
+}
+
+// bufferedConn reads data buffered before the connection was hijacked
+type bufferedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func handleConnect(w http.ResponseWriter, r *http.Request, internalRedirect func(net.Conn, string, string), user string) {
 	hijacker, ok := w.(http.Hijacker)
 	if !ok {
 		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
@@ -71,13 +141,20 @@ func handleConnect(w http.ResponseWriter, r *http.Request, internalRedirect func
 	}
 	_, err = fmt.Fprintf(clientConn, "%s 200 OK\r\n\r\n", r.Proto)
 	if err == nil {
-		internalRedirect(clientConn, r.Host)
+		connlog.Log(clientConn, &internal.ConnectionEvent{
+			Event:       internal.ConnectionConnect,
+			Destination: r.Host,
+			Protocol:    "http",
+		})
+		internalRedirect(clientConn, r.Host, user)
 	} else {
 		_ = clientConn.Close()
 	}
 }
 
-func newReverseProxy(logger logrus.FieldLogger, harFile string) *httputil.ReverseProxy {
+// newReverseProxy forwards HTTP requests to their destination using dial
+// (so that they go through the same upstream proxy as RPCs)
+func newReverseProxy(logger logrus.FieldLogger, harFile string, dial ContextDialer) *httputil.ReverseProxy {
 	logger = logger.WithField("", "http_reverse_proxy")
 	return &httputil.ReverseProxy{
 		Director: func(request *http.Request) {
@@ -93,7 +170,11 @@ func newReverseProxy(logger logrus.FieldLogger, harFile string) *httputil.Revers
 			}
 			request.URL.Host = request.Host
 		},
-		Transport: NewHTTPTransport(&http.Transport{}, harFile),
+		Transport: NewHTTPTransport(&http.Transport{
+			DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+				return dial(ctx, addr)
+			},
+		}, harFile),
 		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
 			logger.WithError(err).Debug("http proxy error")
 			w.WriteHeader(http.StatusBadGateway)
@@ -101,6 +182,19 @@ func newReverseProxy(logger logrus.FieldLogger, harFile string) *httputil.Revers
 	}
 }
 
+// originalDestinationOnly refuses requests on connections to a transparent listener
+// that weren't redirected to it, unless the listener is being used as an HTTP proxy
+// (otherwise anyone could use it to reach any host)
+func originalDestinationOnly(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if state := connstate.FromContext(r.Context()); !proxyRequest(r) && (state == nil || state.Destination == "") {
+			http.Error(w, "the connection wasn't redirected to the proxy so has no destination", http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
 func isGrpcRequest(server grpcWebServer, r *http.Request) bool {
 	return server.IsGrpcWebRequest(r) || // gRPC-Web request from browser
 		r.ProtoMajor == 2 && strings.Contains(r.Header.Get("Content-Type"), "application/grpc") // Standard gRPC request
@@ -114,10 +208,24 @@ func isGrpcRequest(server grpcWebServer, r *http.Request) bool {
 // (not actually unencrypted because we're using a TLS listener)
 func withHttpsMiddleware(server *http.Server) *http.Server {
 	wrappedHandler := server.Handler
-	server.Handler = h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	server.Handler = h2cHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		marker.AddHTTPSMarker(r.Header)
 		wrappedHandler.ServeHTTP(w, r)
-	}), &http2.Server{})
+	}))
 
 	return server
 }
+
+// withHTTP2ConnectionLog serves HTTP/2 over TLS itself (rather than leaving it to net/http)
+// so that the HTTP/2 frames of each connection can be logged.
+func withHTTP2ConnectionLog(server *http.Server) {
+	server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){
+		http2.NextProtoTLS: func(server *http.Server, conn *tls.Conn, handler http.Handler) {
+			(&http2.Server{}).ServeConn(connlog.HTTP2(conn, true), &http2.ServeConnOpts{
+				Context:    connstate.ConnContext(context.Background(), conn),
+				BaseConfig: server,
+				Handler:    handler,
+			})
+		},
+	}
+}
@@ -1,6 +1,7 @@
 package grpc_proxy
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net"
 	"net/http"
@@ -8,7 +9,10 @@ import (
 	"sync"
 	"testing"
 
+	"github.com/bradleyjkemp/grpc-tools/internal/connstate"
 	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
 )
 
 var (
@@ -34,11 +38,11 @@ func TestHTTPHandler_RedirectsCONNECT(t *testing.T) {
 	destination := make(chan string, 1)
 	handlerFinished := sync.WaitGroup{}
 	handlerFinished.Add(1)
-	s := httptest.NewServer(newHttpServer(logger, nil, func(conn net.Conn, dest string) {
+	s := httptest.NewServer(newHttpServer(logger, nil, func(conn net.Conn, dest string, _ string) {
 		proxiedConn <- conn
 		destination <- dest
 		handlerFinished.Done()
-	}, nil).Handler)
+	}, nil, nil).Handler)
 
 	clientConn, err := net.Dial(s.Listener.Addr().Network(), s.Listener.Addr().String())
 	if err != nil {
@@ -88,7 +92,7 @@ func TestHTTPHandler_InterceptsGRPC(t *testing.T) {
 		isGRPC: func(_ *http.Request) bool {
 			return true
 		},
-	}, nil, nil).Handler)
+	}, nil, nil, nil).Handler)
 
 	_, err := http.Post(s.URL, "", nil)
 	if err != nil {
@@ -111,7 +115,7 @@ func TestHTTPHandler_ReverseProxiesUnknown(t *testing.T) {
 		},
 	}, nil, http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {
 		reverseProxyCalled = true
-	})).Handler)
+	}), nil).Handler)
 
 	_, err := http.Get(s.URL)
 	if err != nil {
@@ -121,3 +125,31 @@ func TestHTTPHandler_ReverseProxiesUnknown(t *testing.T) {
 		panic("gRPC Handler not called")
 	}
 }
+
+func TestHTTPHandler_ConnectionState(t *testing.T) {
+	states := make(chan *connstate.State, 1)
+	server := newHttpServer(logrus.New(), stubGRPCWebHandler{
+		handler: func(_ http.ResponseWriter, r *http.Request) {
+			states <- connstate.FromContext(r.Context())
+		},
+		isGRPC: func(_ *http.Request) bool {
+			return true
+		},
+	}, nil, nil, nil)
+	ln, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	go server.Serve(connstate.Listener(ln))
+	defer server.Close()
+
+	// gRPC clients send HTTP/2 without TLS using prior knowledge
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	resp, err := client.Post("http://"+ln.Addr().String(), "application/grpc", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.NotNil(t, <-states, "the handler should see the state of the connection")
+}
@@ -0,0 +1,166 @@
+package grpc_proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bradleyjkemp/grpc-tools/internal/connstate"
+	"github.com/sirupsen/logrus"
+)
+
+// InterceptionPolicy chooses which TLS connections tunnelled through the proxy
+// are intercepted. All other connections are forwarded to their destination untouched.
+// Connections made directly to the proxy (i.e. without a destination) are always intercepted.
+type InterceptionPolicy struct {
+	// Hosts are globs (e.g. *.example.com) of the hosts to intercept (empty intercepts all hosts)
+	Hosts []string
+	// SkipHosts are globs of the hosts never to intercept (checked after Hosts)
+	SkipHosts []string
+	// Ports are the destination ports to intercept (empty intercepts all ports)
+	Ports []int
+	// BypassRejected stops intercepting a client's connections to a destination for an hour
+	// once it has rejected our certificate for it (e.g. because it pins the real certificate)
+	BypassRejected bool
+}
+
+// how long a client's connections to a destination aren't intercepted after it rejects our certificate
+const bypassDuration = time.Hour
+
+// WithInterceptionPolicy restricts which TLS connections are intercepted.
+// By default all connections are intercepted (if a certificate is available).
+func WithInterceptionPolicy(policy InterceptionPolicy) Configurator {
+	return func(s *server) {
+		s.interceptionPolicy = policy
+	}
+}
+
+// interception implements tlsmux.Interception for an InterceptionPolicy
+type interception struct {
+	InterceptionPolicy
+	logger logrus.FieldLogger
+	now    func() time.Time
+	lock   sync.Mutex
+	// when the bypass of each client and destination whose certificate was rejected expires
+	rejected map[bypassKey]time.Time
+}
+
+type bypassKey struct {
+	client      string
+	destination string
+}
+
+// newBypassKey identifies clients by their IP address
+// (unix socket clients are all local so are indistinguishable)
+func newBypassKey(client net.Addr, destination string) bypassKey {
+	if tcpAddr, ok := connstate.Unwrap(client).(*net.TCPAddr); ok {
+		return bypassKey{tcpAddr.IP.String(), destination}
+	}
+	return bypassKey{client.Network(), destination}
+}
+
+func newInterception(logger logrus.FieldLogger, policy InterceptionPolicy) (*interception, error) {
+	for _, pattern := range append(append([]string{}, policy.Hosts...), policy.SkipHosts...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid interception host pattern %q: %v", pattern, err)
+		}
+	}
+	for _, port := range policy.Ports {
+		if port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("invalid interception port %d", port)
+		}
+	}
+	return &interception{
+		InterceptionPolicy: policy,
+		logger:             logger,
+		now:                time.Now,
+		rejected:           map[bypassKey]time.Time{},
+	}, nil
+}
+
+func (i *interception) Intercept(client net.Addr, destination string) bool {
+	if i.bypassed(newBypassKey(client, destination)) {
+		i.logger.Debugf("Not intercepting %s for %v as it rejected our certificate", destination, client)
+		return false
+	}
+	host, port, err := net.SplitHostPort(destination)
+	if err != nil {
+		host = destination
+	}
+	host = strings.ToLower(host)
+	if len(i.Hosts) > 0 && !matchesHost(i.Hosts, host) {
+		return false
+	}
+	if matchesHost(i.SkipHosts, host) {
+		return false
+	}
+	if len(i.Ports) == 0 {
+		return true
+	}
+	portNumber, _ := strconv.Atoi(port)
+	for _, p := range i.Ports {
+		if p == portNumber {
+			return true
+		}
+	}
+	return false
+}
+
+func (i *interception) bypassed(key bypassKey) bool {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	expiry, ok := i.rejected[key]
+	if ok && !i.now().Before(expiry) {
+		delete(i.rejected, key)
+		return false
+	}
+	return ok
+}
+
+func (i *interception) Rejected(client net.Addr, destination string, err error) {
+	if !i.BypassRejected || !rejectedCertificate(err) {
+		return
+	}
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	now := i.now()
+	for key, expiry := range i.rejected {
+		if !now.Before(expiry) {
+			delete(i.rejected, key)
+		}
+	}
+	key := newBypassKey(client, destination)
+	if _, alreadyRejected := i.rejected[key]; !alreadyRejected {
+		i.logger.WithError(err).Warnf("Client %v rejected the certificate for %s (is it pinned?): its connections to it won't be intercepted for %v", client, destination, bypassDuration)
+	}
+	i.rejected[key] = now.Add(bypassDuration)
+}
+
+// rejectedCertificate checks whether a handshake failed because the client sent an alert
+// rejecting our certificate (rather than e.g. hanging up or not supporting our TLS version)
+func rejectedCertificate(err error) bool {
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Op != "remote error" {
+		return false
+	}
+	switch opErr.Err.Error() {
+	case "tls: bad certificate", "tls: unknown certificate", "tls: unknown certificate authority":
+		return true
+	default:
+		return false
+	}
+}
+
+func matchesHost(patterns []string, host string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(strings.ToLower(pattern), host); matched {
+			return true
+		}
+	}
+	return false
+}
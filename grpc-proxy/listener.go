@@ -1,20 +1,15 @@
 package grpc_proxy
 
 import (
+	"errors"
 	"net"
 	"sync"
 
+	"github.com/bradleyjkemp/grpc-tools/internal/connstate"
 	"github.com/sirupsen/logrus"
 )
 
-type proxiedConn struct {
-	net.Conn
-	originalDest string
-}
-
-func (p proxiedConn) OriginalDestination() string {
-	return p.originalDest
-}
+var errListenerClosed = errors.New("proxy listener closed")
 
 // listens on a net.Listener as well as a channel for internal redirects
 // while preserving original destination
@@ -23,7 +18,12 @@ type proxyListener struct {
 	channel chan net.Conn
 	errs    chan error
 	net.Listener
-	once sync.Once
+	once      sync.Once
+	closed    chan struct{}
+	closeOnce sync.Once
+	// whether SOCKS handshakes are accepted as well as HTTP proxy requests
+	socks bool
+	auth  *proxyAuth
 }
 
 func newProxyListener(logger logrus.FieldLogger, listener net.Listener) *proxyListener {
@@ -33,11 +33,33 @@ func newProxyListener(logger logrus.FieldLogger, listener net.Listener) *proxyLi
 		errs:     make(chan error),
 		Listener: listener,
 		once:     sync.Once{},
+		closed:   make(chan struct{}),
+	}
+}
+
+// internalRedirect handles a connection tunnelled through the proxy (e.g. using HTTP CONNECT)
+// as if it had been made directly. user is the proxy user the client authenticated as (if any).
+func (l *proxyListener) internalRedirect(conn net.Conn, originalDestination string, user string) {
+	conn, state := connstate.New(conn)
+	state.Destination = originalDestination
+	state.Tunnelled = true
+	state.ProxyUser = user
+	select {
+	case l.channel <- conn:
+	case <-l.closed:
+		_ = conn.Close()
 	}
 }
 
-func (l *proxyListener) internalRedirect(conn net.Conn, originalDestination string) {
-	l.channel <- proxiedConn{conn, originalDestination}
+// redirect passes a connection to Accept, returning false if the listener has been closed
+func (l *proxyListener) redirect(conn net.Conn) bool {
+	select {
+	case l.channel <- conn:
+		return true
+	case <-l.closed:
+		_ = conn.Close()
+		return false
+	}
 }
 
 func (l *proxyListener) Accept() (net.Conn, error) {
@@ -47,11 +69,26 @@ func (l *proxyListener) Accept() (net.Conn, error) {
 			for {
 				conn, err := l.Listener.Accept()
 				if err != nil {
-					l.errs <- err
-					continue
+					select {
+					case l.errs <- err:
+						continue
+					case <-l.closed:
+						return
+					}
 				}
 				l.logger.Debugf("Got connection from address %v", conn.RemoteAddr())
-				l.channel <- conn
+				if l.socks {
+					// the handshake must be read before the connection can be handled
+					go func() {
+						if conn, handled := l.acceptSOCKS(conn); !handled {
+							l.redirect(conn)
+						}
+					}()
+					continue
+				}
+				if !l.redirect(conn) {
+					return
+				}
 			}
 		}()
 	})
@@ -61,5 +98,16 @@ func (l *proxyListener) Accept() (net.Conn, error) {
 		return conn, nil
 	case err := <-l.errs:
 		return nil, err
+	case <-l.closed:
+		return nil, errListenerClosed
 	}
 }
+
+func (l *proxyListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		err = l.Listener.Close()
+	})
+	return err
+}
@@ -0,0 +1,235 @@
+package grpc_proxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/bradleyjkemp/grpc-tools/internal/connlog"
+	"github.com/bradleyjkemp/grpc-tools/internal/connstate"
+	"github.com/bradleyjkemp/grpc-tools/internal/tlsmux"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+)
+
+// ListenerMode controls how a listener determines where requests are forwarded to
+type ListenerMode string
+
+const (
+	// ProxyMode listeners act as HTTP proxies, forwarding requests to the destination the client requested
+	ProxyMode ListenerMode = "proxy"
+	// DestinationMode listeners forward all gRPC requests to a fixed destination
+	// (for clients that connect to the proxy directly instead of using it as a proxy)
+	DestinationMode ListenerMode = "destination"
+	// TransparentMode listeners accept connections redirected to them by the firewall
+	// (e.g. iptables REDIRECT) and forward them to the connection's original destination
+	TransparentMode ListenerMode = "transparent"
+)
+
+// TLSMode controls which connections made directly to a listener are accepted
+type TLSMode string
+
+const (
+	TLSAuto TLSMode = "auto" // both plaintext and TLS connections
+	TLSOnly TLSMode = "only" // only TLS connections
+	TLSOff  TLSMode = "off"  // only plaintext connections
+)
+
+// ListenerConfig describes one of the addresses the proxy listens on.
+// All listeners share the same interceptors and observers.
+type ListenerConfig struct {
+	Network     string // tcp (the default) or unix
+	Address     string
+	Mode        ListenerMode
+	Destination string // the destination of a DestinationMode listener
+	TLS         TLSMode
+}
+
+func (c ListenerConfig) String() string {
+	description := fmt.Sprintf("%s %s (%s mode", c.Network, c.Address, c.Mode)
+	if c.Destination != "" {
+		description += " to " + c.Destination
+	}
+	if c.TLS != TLSAuto {
+		description += ", TLS " + string(c.TLS)
+	}
+	return description + ")"
+}
+
+// ParseListener parses a listener from its command line form:
+// an address (host:port, [ipv6]:port, unix:/path or unix:@abstract)
+// optionally followed by comma separated options mode=proxy|destination|transparent,
+// destination=host:port and tls=auto|only|off.
+// e.g. "[::1]:8443,tls=only,destination=api.internal:443"
+func ParseListener(spec string) (ListenerConfig, error) {
+	parts := strings.Split(spec, ",")
+	config := ListenerConfig{
+		Network: "tcp",
+		Address: parts[0],
+		TLS:     TLSAuto,
+	}
+	if strings.HasPrefix(config.Address, "unix:") {
+		config.Network, config.Address = "unix", strings.TrimPrefix(config.Address, "unix:")
+	} else if _, _, err := net.SplitHostPort(config.Address); err != nil {
+		return ListenerConfig{}, fmt.Errorf("invalid listener address %q: %v", config.Address, err)
+	}
+	if config.Address == "" {
+		return ListenerConfig{}, fmt.Errorf("listener %q has no address", spec)
+	}
+
+	for _, option := range parts[1:] {
+		kv := strings.SplitN(option, "=", 2)
+		if len(kv) != 2 {
+			return ListenerConfig{}, fmt.Errorf("invalid listener option %q (should be key=value)", option)
+		}
+		switch kv[0] {
+		case "mode":
+			config.Mode = ListenerMode(kv[1])
+		case "destination":
+			config.Destination = kv[1]
+		case "tls":
+			config.TLS = TLSMode(kv[1])
+		default:
+			return ListenerConfig{}, fmt.Errorf("unknown listener option %q", kv[0])
+		}
+	}
+	if config.Mode == "" {
+		config.Mode = ProxyMode
+		if config.Destination != "" {
+			config.Mode = DestinationMode
+		}
+	}
+
+	switch config.Mode {
+	case ProxyMode, TransparentMode:
+		if config.Destination != "" {
+			return ListenerConfig{}, fmt.Errorf("destination can only be set for %s mode listeners", DestinationMode)
+		}
+	case DestinationMode:
+		if config.Destination == "" {
+			return ListenerConfig{}, fmt.Errorf("%s mode listeners need a destination", DestinationMode)
+		}
+	default:
+		return ListenerConfig{}, fmt.Errorf("unknown listener mode %q", config.Mode)
+	}
+	switch config.TLS {
+	case TLSAuto, TLSOnly, TLSOff:
+	default:
+		return ListenerConfig{}, fmt.Errorf("unknown listener TLS mode %q", config.TLS)
+	}
+	return config, nil
+}
+
+// WithListener adds an address for the proxy to listen on.
+// If any listeners are added then the --interface, --port and --unix_socket
+// settings are ignored.
+func WithListener(config ListenerConfig) Configurator {
+	return func(s *server) {
+		if config.Network == "" {
+			config.Network = "tcp"
+		}
+		if config.Mode == "" {
+			config.Mode = ProxyMode
+		}
+		if config.TLS == "" {
+			config.TLS = TLSAuto
+		}
+		s.listenerConfigs = append(s.listenerConfigs, config)
+	}
+}
+
+// listener is an open listener along with the servers handling its connections
+type listener struct {
+	config ListenerConfig
+	net.Listener
+	proxyLis   *proxyListener
+	grpcServer *grpc.Server
+}
+
+// defaultListenerConfig describes the single listener set by --interface, --port,
+// --unix_socket and --destination
+func (s *server) defaultListenerConfig() ListenerConfig {
+	config := ListenerConfig{
+		Network: "tcp",
+		Address: fmt.Sprintf("%s:%d", s.networkInterface, s.port),
+		Mode:    ProxyMode,
+		TLS:     TLSAuto,
+	}
+	if s.unixSocket != "" {
+		config.Network, config.Address = "unix", s.unixSocket
+	}
+	if s.destination != "" {
+		config.Mode, config.Destination = DestinationMode, s.destination
+	}
+	return config
+}
+
+func listen(logger logrus.FieldLogger, config ListenerConfig, auth *proxyAuth, connections *connlog.Logger) (*listener, error) {
+	if config.Network == "unix" {
+		// remove any socket left behind by a previous run (abstract sockets, starting with @, have no file)
+		if info, err := os.Stat(config.Address); err == nil && info.Mode()&os.ModeSocket != 0 && !strings.HasPrefix(config.Address, "@") {
+			_ = os.Remove(config.Address)
+		}
+	}
+	netListener, err := net.Listen(config.Network, config.Address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s address (%s): %v", config.Network, config.Address, err)
+	}
+	if config.Mode == TransparentMode {
+		// the original destination is looked up on the accepted *net.TCPConn
+		netListener = transparentListener{logger, netListener}
+	}
+	netListener = connstate.Listener(netListener)
+	// track connections before any are rejected so that every connection is logged
+	netListener = allowlistListener{logger, auth, connections.Listener(netListener)}
+	return &listener{
+		config:   config,
+		Listener: netListener,
+	}, nil
+}
+
+func (l *listener) tlsPolicy() tlsmux.Policy {
+	switch l.config.TLS {
+	case TLSOnly:
+		return tlsmux.TLSOnly
+	case TLSOff:
+		return tlsmux.PlaintextOnly
+	default:
+		return tlsmux.AllowBoth
+	}
+}
+
+// close closes the listener (through the proxyListener if there is one)
+func (l *listener) close() error {
+	if l.proxyLis != nil {
+		return l.proxyLis.Close()
+	}
+	return l.Listener.Close()
+}
+
+// transparentListener looks up the original destination of connections
+// redirected to it (recording it in their state) so that they can be forwarded there
+type transparentListener struct {
+	logger logrus.FieldLogger
+	net.Listener
+}
+
+func (l transparentListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	destination, err := originalDestination(conn)
+	if err != nil {
+		l.logger.WithError(err).Debugf("Failed to find original destination of connection from %v", conn.RemoteAddr())
+		return conn, nil
+	}
+	if destination == conn.LocalAddr().String() {
+		// connected to the listener directly rather than being redirected
+		return conn, nil
+	}
+	conn, state := connstate.New(conn)
+	state.Destination = destination
+	return conn, nil
+}
@@ -0,0 +1,127 @@
+package grpc_proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bradleyjkemp/grpc-tools/internal/connstate"
+	"github.com/bradleyjkemp/grpc-tools/internal/tlsmux"
+	"github.com/bradleyjkemp/grpc-tools/testutils"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestParseListener(t *testing.T) {
+	valid := map[string]ListenerConfig{
+		"localhost:8080": {Network: "tcp", Address: "localhost:8080", Mode: ProxyMode, TLS: TLSAuto},
+		"[::1]:8443,tls=only,destination=api:443": {Network: "tcp", Address: "[::1]:8443", Mode: DestinationMode, Destination: "api:443", TLS: TLSOnly},
+		"0.0.0.0:15001,mode=transparent":          {Network: "tcp", Address: "0.0.0.0:15001", Mode: TransparentMode, TLS: TLSAuto},
+		"unix:@proxy,tls=off":                     {Network: "unix", Address: "@proxy", Mode: ProxyMode, TLS: TLSOff},
+	}
+	for spec, expected := range valid {
+		config, err := ParseListener(spec)
+		require.NoError(t, err, spec)
+		require.Equal(t, expected, config, spec)
+	}
+
+	invalid := []string{
+		"8080",
+		"unix:",
+		"localhost:8080,mode=destination",
+		"localhost:8080,mode=proxy,destination=api:443",
+		"localhost:8080,mode=reverse",
+		"localhost:8080,tls=maybe",
+		"localhost:8080,verbose",
+	}
+	for _, spec := range invalid {
+		_, err := ParseListener(spec)
+		require.Error(t, err, spec)
+	}
+}
+
+// redirectedListener simulates connections transparently redirected to the listener
+type redirectedListener struct {
+	net.Listener
+	destination string
+}
+
+func (l redirectedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	conn, state := connstate.New(conn)
+	state.Destination = l.destination
+	return conn, nil
+}
+
+func TestTransparentListenerDestination(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	s := &server{}
+	l := &listener{config: ListenerConfig{Mode: TransparentMode}, Listener: ln}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	server, state := connstate.New(server)
+	state.Destination = "10.0.0.1:443"
+	ctx := connstate.ConnContext(context.Background(), server)
+
+	// RPCs are sent to where the client was connecting to, not their :authority
+	destination, err := s.calculateDestination(ctx, metadata.Pairs(":authority", "example.com"), l)
+	require.NoError(t, err)
+	require.Equal(t, "10.0.0.1:443", destination)
+
+	// connections made to the listener directly have no destination
+	_, err = s.calculateDestination(context.Background(), metadata.Pairs(":authority", "example.com"), l)
+	require.Error(t, err)
+}
+
+func TestTransparentListenerTLSPolicy(t *testing.T) {
+	cert, err := testutils.NewSelfSignedKeyPair()
+	require.NoError(t, err)
+	getCert := func(string) (*tls.Certificate, error) {
+		return &cert, nil
+	}
+	// accepted reports whether the listener accepts a connection (or closes it)
+	accepted := func(policy tlsmux.Policy, useTLS bool) bool {
+		ln, err := net.Listen("tcp", "localhost:0")
+		require.NoError(t, err)
+		httpLis, httpsLis := tlsmux.NewWithPolicy(logrus.New(), redirectedListener{ln, "localhost:1"}, getCert, &tls.Config{}, policy, nil, nil)
+		defer httpLis.Close()
+		conns := make(chan net.Conn, 1)
+		for _, l := range []net.Listener{httpLis, httpsLis} {
+			go func(l net.Listener) {
+				if conn, err := l.Accept(); err == nil {
+					conns <- conn
+				}
+			}(l)
+		}
+
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		// the connection must look like HTTP or else it is passed through to the destination
+		if useTLS {
+			go tls.Client(conn, &tls.Config{InsecureSkipVerify: true}).Write([]byte("POST / HTTP/1.1\r\n\r\n"))
+		} else {
+			go conn.Write([]byte("POST / HTTP/1.1\r\n\r\n"))
+		}
+		select {
+		case <-conns:
+			return true
+		case <-time.After(500 * time.Millisecond):
+			return false
+		}
+	}
+
+	require.True(t, accepted(tlsmux.TLSOnly, true))
+	require.False(t, accepted(tlsmux.TLSOnly, false))
+	require.True(t, accepted(tlsmux.PlaintextOnly, false))
+	require.False(t, accepted(tlsmux.PlaintextOnly, true))
+}
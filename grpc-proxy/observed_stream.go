@@ -0,0 +1,171 @@
+package grpc_proxy
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/bradleyjkemp/grpc-tools/internal"
+	"github.com/bradleyjkemp/grpc-tools/internal/connlog"
+	"github.com/bradleyjkemp/grpc-tools/internal/connstate"
+	"github.com/bradleyjkemp/grpc-tools/internal/proto_decoder"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// observedServerStream wraps a grpc.ServerStream and notifies observers of all sent/received messages
+type observedServerStream struct {
+	sync.Mutex
+	grpc.ServerStream
+	logger    logrus.FieldLogger
+	info      *RPCInfo
+	observers []RPCObserver
+	decoder   proto_decoder.MessageDecoder
+	stats     *rpcStats
+}
+
+// the length of the compressed flag and message length that prefix each message
+const messagePrefixLength = 5
+
+func (ss *observedServerStream) notify(f func(observer RPCObserver)) {
+	ss.Lock()
+	defer ss.Unlock()
+	for _, observer := range ss.observers {
+		f(observer)
+	}
+}
+
+// wireSize is the size of the (possibly compressed) message on the wire or 0 if unknown
+func (ss *observedServerStream) observeMessage(origin internal.MessageOrigin, raw []byte, timestamp time.Time, wireSize int) {
+	message := &internal.Message{
+		MessageOrigin: origin,
+		RawMessage:    raw,
+		Timestamp:     timestamp,
+	}
+	if wireSize > 0 {
+		message.WireSize = wireSize
+	}
+	// grpc-go doesn't expose the compressed flag of each message so it's taken from the
+	// grpc-encoding of the message's direction: the proxy (like grpc-go clients) compresses
+	// every message once an encoding is chosen and the flag can only be set if there is one
+	message.Compressed = ss.encoding(origin) != ""
+	if ss.decoder != nil {
+		decoded, err := ss.decoder.Decode(ss.info.FullMethod, message)
+		if err != nil {
+			ss.logger.WithError(err).Warn("Failed to decode message")
+		} else {
+			message.Message = decoded
+		}
+	}
+	ss.stats.updateTiming(func(timing *RPCTiming) {
+		timing.LastMessage = time.Now()
+	})
+	ss.notify(func(observer RPCObserver) {
+		observer.MessageObserved(ss.info, message)
+	})
+}
+
+// encoding is the grpc-encoding of the messages sent by origin (empty if uncompressed)
+func (ss *observedServerStream) encoding(origin internal.MessageOrigin) string {
+	if origin == internal.ClientMessage {
+		return ss.info.RequestEncoding
+	}
+	return ss.info.ResponseEncoding
+}
+
+func (ss *observedServerStream) SendHeader(headers metadata.MD) error {
+	ss.notify(func(observer RPCObserver) {
+		observer.HeadersObserved(ss.info, headers)
+	})
+	return ss.ServerStream.SendHeader(headers)
+}
+
+func (ss *observedServerStream) SetHeader(headers metadata.MD) error {
+	ss.notify(func(observer RPCObserver) {
+		observer.HeadersObserved(ss.info, headers)
+	})
+	return ss.ServerStream.SetHeader(headers)
+}
+
+func (ss *observedServerStream) SetTrailer(trailers metadata.MD) {
+	ss.notify(func(observer RPCObserver) {
+		observer.TrailersObserved(ss.info, trailers)
+	})
+	ss.ServerStream.SetTrailer(trailers)
+}
+
+func (ss *observedServerStream) SendMsg(m interface{}) error {
+	message := m.([]byte)
+	if message == nil {
+		// although the message is nil here, we actually want to save it as the empty message ("")
+		message = []byte{}
+	}
+	timestamp := time.Now()
+	err := ss.ServerStream.SendMsg(m)
+	var wireSize int
+	if out := ss.stats.LastOut(); err == nil && out != nil {
+		// unlike InPayload, OutPayload includes the message prefix
+		wireSize = out.WireLength - messagePrefixLength
+	}
+	ss.observeMessage(internal.ServerMessage, message, timestamp, wireSize)
+	return err
+}
+
+func (ss *observedServerStream) RecvMsg(m interface{}) error {
+	err := ss.ServerStream.RecvMsg(m)
+	if err != nil {
+		return err
+	}
+	// now m is populated
+	var wireSize int
+	if in := ss.stats.LastIn(); in != nil {
+		wireSize = in.WireLength
+	}
+	ss.observeMessage(internal.ClientMessage, *(m.(*[]byte)), time.Now(), wireSize)
+	return nil
+}
+
+func (s *server) observeStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	md, _ := metadata.FromIncomingContext(ss.Context())
+	stats := rpcStatsFromContext(ss.Context())
+	deadline, _ := ss.Context().Deadline()
+	oss := &observedServerStream{
+		ServerStream: ss,
+		logger:       s.logger,
+		info: &RPCInfo{
+			FullMethod:       info.FullMethod,
+			Metadata:         md,
+			StartTime:        time.Now(),
+			Deadline:         deadline,
+			ProxyUser:        proxyUserFromContext(ss.Context()),
+			TLS:              tlsHandshake(ss.Context()),
+			ConnectionID:     connlog.ID(ss.Context()),
+			RequestEncoding:  stats.RequestEncoding(),
+			ResponseEncoding: stats.ResponseEncoding(),
+		},
+		observers: s.observers,
+		decoder:   s.decoder,
+		stats:     stats,
+	}
+	oss.notify(func(observer RPCObserver) {
+		observer.RPCStarted(oss.info)
+	})
+	err := handler(srv, oss)
+	stats.updateTiming(func(timing *RPCTiming) {
+		timing.Finished = time.Now()
+	})
+	oss.info.Timing = stats.Timing()
+	oss.notify(func(observer RPCObserver) {
+		observer.RPCFinished(oss.info, err)
+	})
+	return err
+}
+
+// tlsHandshake is the handshake of the intercepted TLS connection the RPC was received on (if any)
+func tlsHandshake(ctx context.Context) *TLSHandshake {
+	if state := connstate.FromContext(ctx); state != nil {
+		return state.TLS
+	}
+	return nil
+}
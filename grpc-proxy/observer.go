@@ -0,0 +1,132 @@
+package grpc_proxy
+
+import (
+	"time"
+
+	"github.com/bradleyjkemp/grpc-tools/internal"
+	"google.golang.org/grpc/metadata"
+)
+
+// Message is a single message sent by either the client or the server of an RPC.
+type Message = internal.Message
+
+// MessageOrigin identifies whether a message was sent by the client or the server.
+type MessageOrigin = internal.MessageOrigin
+
+const (
+	ClientMessage = internal.ClientMessage
+	ServerMessage = internal.ServerMessage
+)
+
+// TLSHandshake describes the TLS handshake of an intercepted client connection.
+type TLSHandshake = internal.TLSHandshake
+
+// ConnectionEvent is something that happened on a client connection to the proxy.
+type ConnectionEvent = internal.ConnectionEvent
+
+// ConnectionEventType identifies the kind of a ConnectionEvent.
+type ConnectionEventType = internal.ConnectionEventType
+
+// RPCInfo describes an RPC handled by the proxy.
+// The same *RPCInfo is passed to every callback for an RPC
+// so it can be used to correlate events.
+type RPCInfo struct {
+	FullMethod string      // the gRPC method name in the form /package.Service/Method
+	Metadata   metadata.MD // the request metadata sent by the client
+	StartTime  time.Time
+	Deadline   time.Time // the client's deadline (zero if it didn't set one)
+	ProxyUser  string    // the user the client authenticated to the proxy as (if authentication is required)
+	// the TLS handshake of the client's connection (nil if the connection wasn't intercepted TLS)
+	TLS *TLSHandshake
+	// the ID of the connection the RPC was received on (zero unless there is a ConnectionObserver or a frame capture)
+	ConnectionID uint64
+
+	// the grpc-encoding used in each direction (empty if uncompressed)
+	RequestEncoding  string
+	ResponseEncoding string
+
+	// Timing is only complete once RPCFinished is called
+	Timing RPCTiming
+}
+
+// RPCTiming records when each stage of an RPC happened.
+// Upstream events are zero if the RPC wasn't forwarded (e.g. it was answered by an interceptor).
+type RPCTiming struct {
+	Received            time.Time // the request headers were received from the client
+	UpstreamConnected   time.Time // a connection to the upstream server was acquired
+	UpstreamRequestSent time.Time // the request headers were sent to the upstream server
+	FirstResponse       time.Time // the first response (message or trailers) was received from the upstream server
+	UpstreamFinished    time.Time // the upstream server sent its trailers
+	LastMessage         time.Time // the last message in either direction was sent
+	Finished            time.Time // the RPC finished
+}
+
+// UpstreamLatency is the time the upstream server spent handling the RPC
+// (or 0 if the RPC wasn't forwarded).
+func (t RPCTiming) UpstreamLatency() time.Duration {
+	if t.UpstreamRequestSent.IsZero() || t.UpstreamFinished.IsZero() {
+		return 0
+	}
+	return t.UpstreamFinished.Sub(t.UpstreamRequestSent)
+}
+
+// ProxyOverhead is the total time of the RPC not spent in the upstream server
+// (e.g. acquiring connections and forwarding messages).
+func (t RPCTiming) ProxyOverhead() time.Duration {
+	return t.Total() - t.UpstreamLatency()
+}
+
+func (t RPCTiming) Total() time.Duration {
+	if t.Received.IsZero() || t.Finished.IsZero() {
+		return 0
+	}
+	return t.Finished.Sub(t.Received)
+}
+
+// RPCObserver is notified of events during each RPC handled by the proxy.
+// Callbacks for a single RPC are never made concurrently but callbacks
+// for different RPCs may be.
+type RPCObserver interface {
+	// RPCStarted is called before any messages are sent or received.
+	RPCStarted(rpc *RPCInfo)
+
+	// MessageObserved is called for each message sent by either side.
+	// If the proxy has a decoder (see WithDecoder) then message.Message
+	// contains the decoded message. Server messages are observed once
+	// they have been sent so that their compressed size is known.
+	MessageObserved(rpc *RPCInfo, message *Message)
+
+	// HeadersObserved is called when the server sends response headers.
+	HeadersObserved(rpc *RPCInfo, headers metadata.MD)
+
+	// TrailersObserved is called when the server sends response trailers.
+	TrailersObserved(rpc *RPCInfo, trailers metadata.MD)
+
+	// RPCFinished is called once the RPC has completed with the
+	// error returned to the client (nil if the RPC was successful).
+	RPCFinished(rpc *RPCInfo, err error)
+}
+
+// NoopObserver implements RPCObserver by ignoring all events.
+// It can be embedded by observers that only need some of the callbacks.
+type NoopObserver struct{}
+
+func (NoopObserver) RPCStarted(*RPCInfo)                    {}
+func (NoopObserver) MessageObserved(*RPCInfo, *Message)     {}
+func (NoopObserver) HeadersObserved(*RPCInfo, metadata.MD)  {}
+func (NoopObserver) TrailersObserved(*RPCInfo, metadata.MD) {}
+func (NoopObserver) RPCFinished(*RPCInfo, error)            {}
+
+// ConnectionObserver is notified of events on the client connections accepted by the proxy
+// (e.g. accepted, TLS intercepted, HTTP/2 GOAWAY and closed). RPCs received on a connection
+// record its ID as RPCInfo.ConnectionID. Callbacks are never made concurrently.
+type ConnectionObserver interface {
+	ConnectionEvent(event *ConnectionEvent)
+}
+
+// ConnectionObserverFunc adapts a function to a ConnectionObserver
+type ConnectionObserverFunc func(event *ConnectionEvent)
+
+func (f ConnectionObserverFunc) ConnectionEvent(event *ConnectionEvent) {
+	f(event)
+}
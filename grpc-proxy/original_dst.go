@@ -0,0 +1,13 @@
+//+build !linux
+
+package grpc_proxy
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+func originalDestination(net.Conn) (string, error) {
+	return "", fmt.Errorf("transparent mode is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,73 @@
+package grpc_proxy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// from linux/netfilter_ipv4.h
+	soOriginalDst = 80
+	// from linux/netfilter_ipv6/ip6_tables.h
+	ip6tSoOriginalDst = 80
+)
+
+// originalDestination finds the address a connection redirected by
+// iptables or ip6tables (REDIRECT or DNAT) was originally sent to.
+func originalDestination(conn net.Conn) (string, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return "", fmt.Errorf("not a TCP connection")
+	}
+	local, ok := tcpConn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return "", fmt.Errorf("unknown local address %v", tcpConn.LocalAddr())
+	}
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+	var destination string
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		if local.IP.To4() != nil {
+			destination, sockErr = originalDestinationIPv4(int(fd))
+		} else {
+			destination, sockErr = originalDestinationIPv6(int(fd))
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+	return destination, sockErr
+}
+
+func originalDestinationIPv4(fd int) (string, error) {
+	// the sockaddr_in result fits in the (larger) ipv6_mreq struct
+	addr, err := syscall.GetsockoptIPv6Mreq(fd, syscall.IPPROTO_IP, soOriginalDst)
+	if err != nil {
+		return "", err
+	}
+	// sockaddr_in: family (2 bytes), port (2 bytes, big endian), IPv4 address (4 bytes)
+	port := int(addr.Multiaddr[2])<<8 | int(addr.Multiaddr[3])
+	ip := net.IPv4(addr.Multiaddr[4], addr.Multiaddr[5], addr.Multiaddr[6], addr.Multiaddr[7])
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port)), nil
+}
+
+func originalDestinationIPv6(fd int) (string, error) {
+	// the sockaddr_in6 result is the first field of the ip6_mtuinfo struct
+	info, err := syscall.GetsockoptIPv6MTUInfo(fd, syscall.IPPROTO_IPV6, ip6tSoOriginalDst)
+	if err != nil {
+		return "", err
+	}
+	if info.Addr.Family != syscall.AF_INET6 {
+		return "", fmt.Errorf("unexpected address family %d", info.Addr.Family)
+	}
+	// the port is big endian
+	port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+	ip := net.IP(info.Addr.Addr[:])
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port[0])<<8|int(port[1]))), nil
+}
@@ -4,15 +4,21 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
+	"io"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/bradleyjkemp/grpc-tools/internal"
 	"github.com/bradleyjkemp/grpc-tools/internal/codec"
+	_ "github.com/bradleyjkemp/grpc-tools/internal/compression"
+	"github.com/bradleyjkemp/grpc-tools/internal/connlog"
 	"github.com/bradleyjkemp/grpc-tools/internal/detectcert"
+	"github.com/bradleyjkemp/grpc-tools/internal/proto_decoder"
 	"github.com/bradleyjkemp/grpc-tools/internal/proxy_settings"
 	"github.com/bradleyjkemp/grpc-tools/internal/proxydialer"
 	"github.com/bradleyjkemp/grpc-tools/internal/tlsmux"
@@ -21,18 +27,30 @@ import (
 	"github.com/sirupsen/logrus"
 	"golang.org/x/net/http/httpproxy"
 	"google.golang.org/grpc"
-	_ "google.golang.org/grpc/encoding/gzip"
 )
 
 type ContextDialer = func(context.Context, string) (net.Conn, error)
 
 type server struct {
 	serverOptions []grpc.ServerOption
-	grpcServer    *grpc.Server
 	logger        logrus.FieldLogger
+	interceptors  []grpc.StreamServerInterceptor
+	observers     []RPCObserver
+	decoder       proto_decoder.MessageDecoder
+
+	connectionObservers []ConnectionObserver
+	connections         *connlog.Logger // nil unless there are connection observers or a capture
+	connectionsLock     sync.Mutex
+
+	frameLog, pcap         io.Writer
+	frameLogFile, pcapFile string
+	captureFiles           []*os.File // the files opened for frameLogFile and pcapFile
+	capture                *connlog.Capture
 
 	networkInterface   string
 	port               int
+	unixSocket         string
+	direct             bool
 	certFile           string
 	keyFile            string
 	harFile            string
@@ -44,37 +62,113 @@ type server struct {
 	dialOptions []grpc.DialOption
 	dialer      ContextDialer
 
+	upstreamProxy proxydialer.Config
+
+	auth           proxyAuth
+	allowedClients []string
+
+	interceptionPolicy InterceptionPolicy
+	interception       *interception
+
 	enableSystemProxy bool
 
+	adminAddress  string
+	adminHandlers map[string]http.Handler
+
 	tlsSecretsFile string
 
-	listener net.Listener
+	listenerConfigs []ListenerConfig
+	listeners       []*listener
+
+	// guards the fields used to stop the proxy
+	stopLock     sync.Mutex
+	stopped      bool
+	httpServers  []*http.Server
+	disableProxy func() error
 }
 
 func New(configurators ...Configurator) (*server, error) {
 	logger := logrus.New()
 	s := &server{
 		logger:           logger,
-		dialer:           proxydialer.NewProxyDialer(httpproxy.FromEnvironment().ProxyFunc()),
 		networkInterface: "localhost", // default to just localhost if no other interface is chosen
+		adminHandlers:    map[string]http.Handler{},
 	}
 	s.serverOptions = []grpc.ServerOption{
-		grpc.MaxRecvMsgSize(64 * 1024 * 1024),      // Up the max message size from 4MB to 64MB (to give headroom for intercepting services who've upped theirs)
-		grpc.CustomCodec(codec.NoopCodec{}),        // Allows for passing raw []byte messages around
-		grpc.UnknownServiceHandler(s.proxyHandler), // All services are unknown so will be proxied
+		grpc.MaxRecvMsgSize(64 * 1024 * 1024), // Up the max message size from 4MB to 64MB (to give headroom for intercepting services who've upped theirs)
+		grpc.CustomCodec(codec.NoopCodec{}),   // Allows for passing raw []byte messages around
+		grpc.StatsHandler(statsHandler{}),     // Collects details (e.g. compression) not exposed by grpc.ServerStream
 	}
 
 	for _, configurator := range configurators {
 		configurator(s)
 	}
 
+	interceptors := s.interceptors
+	if len(s.observers) > 0 {
+		// observers must see the stream before any interceptor can answer the RPC
+		interceptors = append([]grpc.StreamServerInterceptor{s.observeStream}, interceptors...)
+	}
+	if len(interceptors) > 0 {
+		s.serverOptions = append(s.serverOptions, grpc.StreamInterceptor(recoverWrapper(s, chainInterceptors(interceptors))))
+	}
+
+	var err error
+	s.auth.allowed, err = parseAllowedClients(s.allowedClients)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case s.upstreamProxy.Configured() && s.dialer != nil:
+		return nil, errors.New("an upstream proxy can't be used with a custom dialer")
+	case s.upstreamProxy.Configured():
+		proxyFunc, err := s.upstreamProxy.ProxyFunc()
+		if err != nil {
+			return nil, err
+		}
+		s.dialer = proxydialer.NewProxyDialer(proxyFunc)
+	case s.dialer == nil:
+		s.dialer = proxydialer.NewProxyDialer(httpproxy.FromEnvironment().ProxyFunc())
+	}
+
+	s.interception, err = newInterception(logger, s.interceptionPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.openCaptureFiles(); err != nil {
+		return nil, err
+	}
+	if s.frameLog != nil || s.pcap != nil {
+		s.capture, err = connlog.NewCapture(logger, s.frameLog, s.pcap)
+		if err != nil {
+			_ = s.closeCaptureFiles()
+			return nil, err
+		}
+	}
+	var emit func(*internal.ConnectionEvent)
+	if len(s.connectionObservers) > 0 {
+		emit = func(event *internal.ConnectionEvent) {
+			s.connectionsLock.Lock()
+			defer s.connectionsLock.Unlock()
+			for _, observer := range s.connectionObservers {
+				observer.ConnectionEvent(event)
+			}
+		}
+	}
+	if emit != nil || s.capture != nil {
+		s.connections = connlog.New(emit, s.capture)
+	}
+
 	// Have to initialise the connpool now because
 	// the dialer may been changed by options
-	s.connPool = internal.NewConnPool(logger, s.dialer)
+	s.connPool = internal.NewConnPool(logger, s.connections.Dialer(s.dialer))
 
 	if fLogLevel != "" {
 		level, err := logrus.ParseLevel(fLogLevel)
 		if err != nil {
+			_ = s.closeCaptureFiles()
 			return nil, err
 		}
 		logger.SetLevel(level)
@@ -100,6 +194,7 @@ func New(configurators ...Configurator) (*server, error) {
 		var err error
 		s.tlsCert, err = tls.LoadX509KeyPair(s.certFile, s.keyFile)
 		if err != nil {
+			_ = s.closeCaptureFiles()
 			return nil, err
 		}
 
@@ -111,65 +206,285 @@ func New(configurators ...Configurator) (*server, error) {
 	return s, nil
 }
 
+// Start listens on the configured addresses and serves connections,
+// blocking until the proxy stops.
 func (s *server) Start() error {
-	var err error
-	s.listener, err = net.Listen("tcp", fmt.Sprintf("%s:%d", s.networkInterface, s.port))
-	if err != nil {
-		return fmt.Errorf("failed to listen on interface (%s:%d): %v", s.networkInterface, s.port, err)
+	if err := s.Listen(); err != nil {
+		return err
+	}
+	return s.Serve()
+}
+
+// Listen opens the proxy's listeners without serving any connections.
+// This allows callers to find the addresses (e.g. when using port 0)
+// before calling Serve.
+func (s *server) Listen() error {
+	if len(s.listeners) > 0 {
+		return nil
+	}
+	configs := s.listenerConfigs
+	if len(configs) == 0 {
+		configs = []ListenerConfig{s.defaultListenerConfig()}
+	}
+	for _, config := range configs {
+		l, err := listen(s.logger, config, &s.auth, s.connections)
+		if err != nil {
+			for _, opened := range s.listeners {
+				_ = opened.Close()
+			}
+			s.listeners = nil
+			return err
+		}
+		s.logger.Infof("Listening on %s %s (%s mode)", config.Network, l.Addr(), config.Mode)
+		s.listeners = append(s.listeners, l)
+	}
+	return nil
+}
+
+// Addr returns the address of the proxy's first listener
+// or nil if Listen has not yet been called.
+func (s *server) Addr() net.Addr {
+	if len(s.listeners) == 0 {
+		return nil
+	}
+	return s.listeners[0].Addr()
+}
+
+// Addrs returns the addresses of all of the proxy's listeners
+// (in the order they were configured).
+func (s *server) Addrs() []net.Addr {
+	var addrs []net.Addr
+	for _, l := range s.listeners {
+		addrs = append(addrs, l.Addr())
+	}
+	return addrs
+}
+
+// Serve handles connections on the listeners opened by Listen,
+// blocking until the proxy stops.
+func (s *server) Serve() error {
+	if len(s.listeners) == 0 {
+		return fmt.Errorf("proxy is not listening")
 	}
-	s.logger.Infof("Listening on %s", s.listener.Addr())
 	if s.getX509Certificate != nil {
 		s.logger.Infof("Start Intercepting TLS connections")
 	} else {
 		s.logger.Infof("Not intercepting TLS connections")
 	}
 
+	errChan, err := s.startServers()
+	if err != nil {
+		return err
+	}
+
+	err = <-errChan
+	s.stopLock.Lock()
+	defer s.stopLock.Unlock()
+	if s.stopped {
+		// errors are expected from closing the listeners
+		return nil
+	}
+	return err
+}
+
+func (s *server) startServers() (chan error, error) {
+	s.stopLock.Lock()
+	defer s.stopLock.Unlock()
+	if s.stopped {
+		return nil, fmt.Errorf("proxy has been stopped")
+	}
+
+	tlsConf, err := s.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	// each listener has up to two servers plus the admin server and system proxy
+	errChan := make(chan error, 2*len(s.listeners)+2)
+	if s.enableSystemProxy && !s.direct {
+		s.disableProxy, err = proxy_settings.EnableProxy(s.systemProxyAddr())
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to enable system proxy")
+		}
+		s.logger.Info("Enabled system proxy.")
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			<-sigs
+			errChan <- s.disableProxy()
+		}()
+	}
+
+	if err := s.startAdminServer(errChan); err != nil {
+		return nil, err
+	}
+
+	httpReverseProxy := newReverseProxy(s.logger, s.harFile, s.dialer)
+	for _, l := range s.listeners {
+		l := l
+		// every listener shares the same interceptors and observers,
+		// only the way the destination is chosen differs
+		options := append([]grpc.ServerOption{
+			grpc.UnknownServiceHandler(func(srv interface{}, ss grpc.ServerStream) error {
+				return s.proxyHandler(l, srv, ss)
+			}), // All services are unknown so will be proxied
+		}, s.serverOptions...)
+		l.grpcServer = grpc.NewServer(options...)
+		if s.direct {
+			s.startDirectServer(l, tlsConf, errChan)
+		} else {
+			s.startProxyServer(l, tlsConf, httpReverseProxy, errChan)
+		}
+	}
+	return errChan, nil
+}
+
+// systemProxyAddr is the address of the first listener acting as an HTTP proxy
+func (s *server) systemProxyAddr() string {
+	for _, l := range s.listeners {
+		if l.config.Mode == ProxyMode {
+			return l.Addr().String()
+		}
+	}
+	return s.listeners[0].Addr().String()
+}
+
+// startProxyServer serves HTTP proxy requests, gRPC and gRPC-Web on the listener
+func (s *server) startProxyServer(l *listener, tlsConf *tls.Config, httpReverseProxy http.Handler, errChan chan<- error) {
 	grpcWebHandler := grpcweb.WrapServer(
-		grpc.NewServer(s.serverOptions...),
+		l.grpcServer,
 		grpcweb.WithCorsForRegisteredEndpointsOnly(false), // because we are proxying
 		grpcweb.WithOriginFunc(func(_ string) bool { return true }),
 	)
 
-	proxyLis := newProxyListener(s.logger, s.listener)
-	httpReverseProxy := newReverseProxy(s.logger, s.harFile)
-	httpServer := newHttpServer(s.logger, grpcWebHandler, proxyLis.internalRedirect, httpReverseProxy)
-	httpsServer := withHttpsMiddleware(newHttpServer(s.logger, grpcWebHandler, proxyLis.internalRedirect, httpReverseProxy))
+	l.proxyLis = newProxyListener(s.logger, l.Listener)
+	// HTTP proxy listeners also accept SOCKS clients
+	l.proxyLis.socks = l.config.Mode == ProxyMode
+	l.proxyLis.auth = &s.auth
+	authenticate := s.authenticator(l)
+	if l.config.Mode == TransparentMode {
+		httpReverseProxy = originalDestinationOnly(httpReverseProxy)
+	}
+	httpServer := newHttpServer(s.logger, grpcWebHandler, l.proxyLis.internalRedirect, httpReverseProxy, authenticate)
+	httpsServer := withHttpsMiddleware(newHttpServer(s.logger, grpcWebHandler, l.proxyLis.internalRedirect, httpReverseProxy, authenticate))
+	s.httpServers = append(s.httpServers, httpServer, httpsServer)
 
-	tlsConf := tls.Config{
+	httpLis, httpsLis := tlsmux.NewWithPolicy(s.logger, l.proxyLis, s.getX509Certificate, tlsConf, l.tlsPolicy(), s.interception, s.dialer)
+	if s.connections != nil {
+		httpLis = connlog.HTTP2Listener(httpLis, false)
+		withHTTP2ConnectionLog(httpsServer)
+	}
+	go func() {
+		errChan <- httpServer.Serve(httpLis)
+	}()
+	go func() {
+		// the TLSMux unwraps TLS for us so we use Serve instead of ServeTLS
+		errChan <- httpsServer.Serve(httpsLis)
+	}()
+}
+
+func (s *server) tlsConfig() (*tls.Config, error) {
+	tlsConf := &tls.Config{
 		Certificates: []tls.Certificate{s.tlsCert},
 	}
 
 	// Use file path for Master Secrets file is specified. Send to /dev/null if not.
 	if s.tlsSecretsFile != "" {
+		var err error
 		tlsConf.KeyLogWriter, err = os.OpenFile(s.tlsSecretsFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 		if err != nil {
-			return fmt.Errorf("failed opening secrets file on path: %s", s.tlsSecretsFile)
+			return nil, fmt.Errorf("failed opening secrets file on path: %s", s.tlsSecretsFile)
+		}
+	}
+	// the pcapng needs the secrets to decrypt intercepted connections
+	if keyLog := s.capture.KeyLogWriter(); keyLog != nil {
+		if tlsConf.KeyLogWriter != nil {
+			keyLog = io.MultiWriter(tlsConf.KeyLogWriter, keyLog)
 		}
+		tlsConf.KeyLogWriter = keyLog
 	}
-	httpLis, httpsLis := tlsmux.New(s.logger, proxyLis, s.getX509Certificate, tlsConf)
+	return tlsConf, nil
+}
 
-	errChan := make(chan error)
-	if s.enableSystemProxy {
-		disableProxy, err := proxy_settings.EnableProxy(s.listener.Addr().String())
+// openCaptureFiles opens the files set by the --frame_log and --pcap flags
+func (s *server) openCaptureFiles() error {
+	if s.frameLogFile != "" {
+		frameLog, err := os.Create(s.frameLogFile)
 		if err != nil {
-			return errors.Wrap(err, "failed to enable system proxy")
+			return fmt.Errorf("failed to create frame log: %v", err)
+		}
+		s.frameLog = frameLog
+		s.captureFiles = append(s.captureFiles, frameLog)
+	}
+	if s.pcapFile != "" {
+		pcap, err := os.Create(s.pcapFile)
+		if err != nil {
+			_ = s.closeCaptureFiles()
+			return fmt.Errorf("failed to create pcap: %v", err)
+		}
+		s.pcap = pcap
+		s.captureFiles = append(s.captureFiles, pcap)
+	}
+	return nil
+}
+
+// closeCaptureFiles closes the files opened by openCaptureFiles
+func (s *server) closeCaptureFiles() error {
+	var err error
+	for _, file := range s.captureFiles {
+		if closeErr := file.Close(); closeErr != nil && err == nil {
+			err = closeErr
 		}
-		s.logger.Info("Enabled system proxy.")
-		sigs := make(chan os.Signal, 1)
-		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-		go func() {
-			<-sigs
-			errChan <- disableProxy()
-		}()
 	}
+	s.captureFiles = nil
+	return err
+}
 
+// startDirectServer serves gRPC (either plaintext or TLS) directly on the listener
+func (s *server) startDirectServer(l *listener, tlsConf *tls.Config, errChan chan<- error) {
+	plaintextLis, tlsLis := tlsmux.NewWithPolicy(s.logger, l.Listener, s.getX509Certificate, tlsConf, l.tlsPolicy(), s.interception, s.dialer)
+	if s.connections != nil {
+		// gRPC is always HTTP/2
+		plaintextLis, tlsLis = connlog.HTTP2Listener(plaintextLis, true), connlog.HTTP2Listener(tlsLis, true)
+	}
 	go func() {
-		errChan <- httpServer.Serve(httpLis)
+		errChan <- l.grpcServer.Serve(plaintextLis)
 	}()
 	go func() {
-		// the TLSMux unwraps TLS for us so we use Serve instead of ServeTLS
-		errChan <- httpsServer.Serve(httpsLis)
+		errChan <- l.grpcServer.Serve(tlsLis)
 	}()
+}
+
+// Stop closes the listeners, all active connections and the capture files
+// causing Serve to return.
+func (s *server) Stop() error {
+	s.stopLock.Lock()
+	defer s.stopLock.Unlock()
+	s.stopped = true
 
-	return <-errChan
+	var err error
+	for _, httpServer := range s.httpServers {
+		if closeErr := httpServer.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	for _, l := range s.listeners {
+		if l.grpcServer != nil {
+			l.grpcServer.Stop()
+		}
+		if closeErr := l.close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	if s.disableProxy != nil {
+		if disableErr := s.disableProxy(); disableErr != nil && err == nil {
+			err = disableErr
+		}
+	}
+	// connections still open (e.g. tunnels passed through) are closed in the pcapng
+	s.capture.Close()
+	if closeErr := s.closeCaptureFiles(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	return err
 }
@@ -0,0 +1,453 @@
+package grpc_proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bradleyjkemp/grpc-tools/internal"
+	"github.com/bradleyjkemp/grpc-tools/internal/codec"
+	"github.com/bradleyjkemp/grpc-tools/internal/proxydialer"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/proxy"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// the address clients ask the proxy to connect to (test servers answer every RPC themselves)
+const testUpstream = "upstream.invalid:80"
+
+// finishedObserver sends the info of each finished RPC to a channel
+type finishedObserver chan *RPCInfo
+
+func (o finishedObserver) RPCStarted(*RPCInfo)                    {}
+func (o finishedObserver) MessageObserved(*RPCInfo, *Message)     {}
+func (o finishedObserver) HeadersObserved(*RPCInfo, metadata.MD)  {}
+func (o finishedObserver) TrailersObserved(*RPCInfo, metadata.MD) {}
+func (o finishedObserver) RPCFinished(info *RPCInfo, _ error) {
+	o <- info
+}
+
+// startTestServer starts a proxy (which the caller must stop) that answers every RPC
+// itself instead of forwarding it and sends the info of each RPC to the returned channel
+func startTestServer(t *testing.T, configurators ...Configurator) (*server, chan *RPCInfo) {
+	finished := make(finishedObserver, 10)
+	s, err := New(append(configurators,
+		WithObserver(finished),
+		WithInterceptor(func(_ interface{}, ss grpc.ServerStream, _ *grpc.StreamServerInfo, _ grpc.StreamHandler) error {
+			var request []byte
+			if err := ss.RecvMsg(&request); err != nil {
+				return err
+			}
+			return ss.SendMsg(request)
+		}),
+	)...)
+	require.NoError(t, err)
+	require.NoError(t, s.Listen())
+	go s.Serve()
+	return s, finished
+}
+
+// invokeTestServer calls a method on a test server (via the target) which echoes the request
+func invokeTestServer(target string, options ...grpc.DialOption) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, target, append(options, grpc.WithBlock(),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(codec.NoopCodec{})))...)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var resp []byte
+	return conn.Invoke(ctx, "/test.Service/Method", []byte("\n\x03foo"), &resp)
+}
+
+func waitForFinished(t *testing.T, finished chan *RPCInfo) *RPCInfo {
+	select {
+	case info := <-finished:
+		return info
+	case <-time.After(5 * time.Second):
+		t.Fatal("RPC did not finish")
+		return nil
+	}
+}
+
+// httpProxyDialer tunnels connections through the proxy using HTTP CONNECT
+func httpProxyDialer(proxyAddr string, user *url.Userinfo) grpc.DialOption {
+	return grpc.WithContextDialer(proxydialer.NewProxyDialer(func(*url.URL) (*url.URL, error) {
+		return &url.URL{Scheme: "http", User: user, Host: proxyAddr}, nil
+	}))
+}
+
+// socks5Dialer tunnels connections through the proxy using SOCKS5
+func socks5Dialer(t *testing.T, proxyAddr string, auth *proxy.Auth) grpc.DialOption {
+	socks5, err := proxy.SOCKS5("tcp", proxyAddr, auth, proxy.Direct)
+	require.NoError(t, err)
+	return grpc.WithContextDialer(func(_ context.Context, address string) (net.Conn, error) {
+		return socks5.Dial("tcp", address)
+	})
+}
+
+func TestProxyAuthentication(t *testing.T) {
+	s, finished := startTestServer(t, Port(0), ProxyAuth("alice", "secret"))
+	defer s.Stop()
+	addr := s.Addr().String()
+
+	require.NoError(t, invokeTestServer(testUpstream, grpc.WithInsecure(), httpProxyDialer(addr, url.UserPassword("alice", "secret"))))
+	require.Equal(t, "alice", waitForFinished(t, finished).ProxyUser)
+	require.NoError(t, invokeTestServer(testUpstream, grpc.WithInsecure(), socks5Dialer(t, addr, &proxy.Auth{User: "alice", Password: "secret"})))
+	require.Equal(t, "alice", waitForFinished(t, finished).ProxyUser)
+
+	// wrong or missing credentials
+	require.Error(t, invokeTestServer(testUpstream, grpc.WithInsecure(), httpProxyDialer(addr, url.UserPassword("alice", "wrong"))))
+	require.Error(t, invokeTestServer(testUpstream, grpc.WithInsecure(), httpProxyDialer(addr, nil)))
+	require.Error(t, invokeTestServer(testUpstream, grpc.WithInsecure(), socks5Dialer(t, addr, nil)))
+	require.Error(t, invokeTestServer(addr, grpc.WithInsecure(), grpc.WithAuthority(testUpstream)))
+}
+
+func TestTransparentListenerAuthentication(t *testing.T) {
+	s, finished := startTestServer(t, WithListener(ListenerConfig{Network: "tcp", Address: "localhost:0", Mode: TransparentMode}), ProxyAuth("alice", "secret"))
+	defer s.Stop()
+	addr := s.Addr().String()
+
+	// the listener can still be used as an HTTP proxy but only with credentials
+	require.Error(t, invokeTestServer(testUpstream, grpc.WithInsecure(), httpProxyDialer(addr, nil)))
+	require.NoError(t, invokeTestServer(testUpstream, grpc.WithInsecure(), httpProxyDialer(addr, url.UserPassword("alice", "secret"))))
+	require.Equal(t, "alice", waitForFinished(t, finished).ProxyUser)
+
+	// requests on connections that weren't redirected have no destination
+	response, err := http.Get("http://" + addr + "/")
+	require.NoError(t, err)
+	_ = response.Body.Close()
+	require.Equal(t, http.StatusForbidden, response.StatusCode)
+	response, err = (&http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(&url.URL{Host: addr})}}).Get("http://upstream.invalid/")
+	require.NoError(t, err)
+	_ = response.Body.Close()
+	require.Equal(t, http.StatusProxyAuthRequired, response.StatusCode)
+}
+
+func TestAllowClients(t *testing.T) {
+	allowed, _ := startTestServer(t, Port(0), AllowClients("127.0.0.0/8"))
+	defer allowed.Stop()
+	require.NoError(t, invokeTestServer(allowed.Addr().String(), grpc.WithInsecure(), grpc.WithAuthority(testUpstream)))
+
+	restricted, _ := startTestServer(t, Port(0), AllowClients("10.0.0.0/8"))
+	defer restricted.Stop()
+	require.Error(t, invokeTestServer(restricted.Addr().String(), grpc.WithInsecure(), grpc.WithAuthority(testUpstream)))
+
+	// clients of unix sockets count as the loopback address
+	dir, err := ioutil.TempDir("", "grpc-proxy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	for cidr, allowed := range map[string]bool{"127.0.0.1": true, "::1": true, "10.0.0.0/8": false} {
+		socket := filepath.Join(dir, "proxy.sock")
+		s, _ := startTestServer(t, UnixSocket(socket), AllowClients(cidr))
+		err := invokeTestServer("unix://"+socket, grpc.WithInsecure(), grpc.WithAuthority(testUpstream))
+		s.Stop()
+		if allowed {
+			require.NoError(t, err, cidr)
+		} else {
+			require.Error(t, err, cidr)
+		}
+	}
+}
+
+func TestUnixListenerAuthentication(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grpc-proxy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "proxy.sock")
+	s, finished := startTestServer(t, UnixSocket(socket), ProxyAuth("alice", "secret"))
+	defer s.Stop()
+	// connectUnix opens an authenticated tunnel through the proxy
+	connectUnix := func(_ context.Context, address string) (net.Conn, error) {
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			return nil, err
+		}
+		_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nProxy-Authorization: Basic %s\r\n\r\n", address, basicAuth("alice", "secret"))
+		if err != nil {
+			return nil, err
+		}
+		// the proxy doesn't send anything else until the client does
+		response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			return nil, err
+		}
+		if response.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected response %s", response.Status)
+		}
+		return conn, nil
+	}
+
+	tunnel, err := connectUnix(context.Background(), testUpstream)
+	require.NoError(t, err)
+	defer tunnel.Close()
+	// the open tunnel doesn't authenticate other clients of the socket (which all have the same address)
+	require.Error(t, invokeTestServer(testUpstream, grpc.WithInsecure(), grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+	})))
+
+	require.NoError(t, invokeTestServer(testUpstream, grpc.WithInsecure(), grpc.WithContextDialer(connectUnix)))
+	require.Equal(t, "alice", waitForFinished(t, finished).ProxyUser)
+}
+
+func basicAuth(user, password string) string {
+	return base64.StdEncoding.EncodeToString([]byte(user + ":" + password))
+}
+
+func TestListenerTLSPolicy(t *testing.T) {
+	s, _ := startTestServer(t,
+		WithListener(ListenerConfig{Address: "localhost:0", TLS: TLSOnly}),
+		WithListener(ListenerConfig{Address: "localhost:0", TLS: TLSOff}),
+	)
+	defer s.Stop()
+	addrs := s.Addrs()
+
+	// plaintext connections to the TLS only listener are closed
+	require.Error(t, invokeTestServer(addrs[0].String(), grpc.WithInsecure(), grpc.WithAuthority(testUpstream)))
+	require.NoError(t, invokeTestServer(addrs[1].String(), grpc.WithInsecure(), grpc.WithAuthority(testUpstream)))
+}
+
+func TestUnixListenerPassthrough(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grpc-proxy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "proxy.sock")
+	s, _ := startTestServer(t, UnixSocket(socket))
+	defer s.Stop()
+
+	// a TCP server echoing a line (i.e. not gRPC or even HTTP)
+	echo, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer echo.Close()
+	go func() {
+		conn, err := echo.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		_, _ = conn.Write([]byte(line))
+	}()
+
+	conn, err := net.Dial("unix", socket)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\n\r\n", echo.Addr())
+	require.NoError(t, err)
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, response.StatusCode)
+
+	// the tunnelled connection is passed through to the destination over TCP
+	_, err = conn.Write([]byte("hello world\n"))
+	require.NoError(t, err)
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "hello world\n", line)
+}
+
+func TestUnixListenerConnectionLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grpc-proxy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "proxy.sock")
+	connects := make(chan *ConnectionEvent, 10)
+	s, finished := startTestServer(t, UnixSocket(socket), WithConnectionObserver(ConnectionObserverFunc(func(event *ConnectionEvent) {
+		if event.Event == internal.ConnectionConnect {
+			connects <- event
+		}
+	})))
+	defer s.Stop()
+	// connectUnix opens a tunnel through the proxy
+	connectUnix := func(_ context.Context, address string) (net.Conn, error) {
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\n\r\n", address); err != nil {
+			return nil, err
+		}
+		response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			return nil, err
+		}
+		if response.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected response %s", response.Status)
+		}
+		return conn, nil
+	}
+
+	// clients of the socket all have the same address but are still told apart
+	ids := map[uint64]bool{}
+	for i := 0; i < 2; i++ {
+		require.NoError(t, invokeTestServer(testUpstream, grpc.WithInsecure(), grpc.WithContextDialer(connectUnix)))
+		info := waitForFinished(t, finished)
+		require.NotZero(t, info.ConnectionID)
+		select {
+		case event := <-connects:
+			require.Equal(t, event.ConnectionID, info.ConnectionID)
+		case <-time.After(5 * time.Second):
+			t.Fatal("tunnel was not logged")
+		}
+		ids[info.ConnectionID] = true
+	}
+	require.Len(t, ids, 2)
+}
+
+func TestStopClosesCapture(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grpc-proxy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	pcapFile := filepath.Join(dir, "capture.pcapng")
+	accepted := make(chan struct{}, 1)
+	s, _ := startTestServer(t, Port(0), func(s *server) {
+		s.pcapFile = pcapFile
+	}, WithConnectionObserver(ConnectionObserverFunc(func(event *ConnectionEvent) {
+		if event.Event == internal.ConnectionAccepted {
+			accepted <- struct{}{}
+		}
+	})))
+
+	// a client that is still connected when the proxy stops
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	select {
+	case <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection was not accepted")
+	}
+	require.NoError(t, s.Stop())
+	_, err = s.pcap.Write([]byte{0})
+	require.Error(t, err, "the pcap file should be closed")
+
+	pcap, err := ioutil.ReadFile(pcapFile)
+	require.NoError(t, err)
+	var flags []byte
+	for b := pcap; len(b) > 0; {
+		blockType, length := binary.LittleEndian.Uint32(b), binary.LittleEndian.Uint32(b[4:])
+		if blockType == 6 { // an enhanced packet block
+			flags = append(flags, b[28+33]) // the TCP flags of the IPv4 packet
+		}
+		b = b[length:]
+	}
+	// the connection is opened and then closed
+	require.Equal(t, []byte{0x02, 0x12, 0x10, 0x11, 0x11, 0x10}, flags)
+}
+
+func TestUpstreamProxy(t *testing.T) {
+	connects := make(chan *ConnectionEvent, 10)
+	upstream, finished := startTestServer(t, Port(0), ProxyAuth("alice", "secret"), WithConnectionObserver(ConnectionObserverFunc(func(event *ConnectionEvent) {
+		if event.Event == internal.ConnectionConnect {
+			connects <- event
+		}
+	})))
+	defer upstream.Stop()
+	upstreamAddr := upstream.Addr().String()
+
+	// startProxy starts a proxy forwarding RPCs (and other connections) through the upstream proxy
+	startProxy := func(upstreamProxy Configurator) *server {
+		s, err := New(Port(0), upstreamProxy)
+		require.NoError(t, err)
+		require.NoError(t, s.Listen())
+		go s.Serve()
+		return s
+	}
+	// tunnelDestination is where the upstream proxy was asked to connect to
+	tunnelDestination := func() string {
+		select {
+		case event := <-connects:
+			return event.Destination
+		case <-time.After(5 * time.Second):
+			t.Fatal("the upstream proxy wasn't connected through")
+			return ""
+		}
+	}
+
+	for _, scheme := range []string{"http", "socks5h"} {
+		s := startProxy(UpstreamProxy(scheme+"://alice:secret@"+upstreamAddr, ""))
+		require.NoError(t, invokeTestServer(s.Addr().String(), grpc.WithInsecure(), grpc.WithAuthority(testUpstream)), scheme)
+		require.Equal(t, "alice", waitForFinished(t, finished).ProxyUser, scheme)
+		require.Equal(t, testUpstream, tunnelDestination(), scheme)
+		s.Stop()
+	}
+
+	// socks5:// proxies are sent the destination's IP address
+	// (loopback destinations are only proxied when chosen by a rule)
+	s := startProxy(UpstreamProxyRule("localhost", "socks5://alice:secret@"+upstreamAddr))
+	require.NoError(t, invokeTestServer(s.Addr().String(), grpc.WithInsecure(), grpc.WithAuthority("localhost:80")))
+	require.Equal(t, "alice", waitForFinished(t, finished).ProxyUser)
+	require.Contains(t, []string{"127.0.0.1:80", "[::1]:80"}, tunnelDestination())
+	s.Stop()
+
+	// the upstream proxy rejects the wrong credentials
+	s = startProxy(UpstreamProxy("http://alice:wrong@"+upstreamAddr, ""))
+	require.Error(t, invokeTestServer(s.Addr().String(), grpc.WithInsecure(), grpc.WithAuthority(testUpstream)))
+	s.Stop()
+
+	// connections that aren't intercepted are also passed through the upstream proxy
+	echo, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer echo.Close()
+	go func() {
+		conn, err := echo.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		_, _ = conn.Write([]byte(line))
+	}()
+	s = startProxy(UpstreamProxyRule("127.0.0.0/8", "http://alice:secret@"+upstreamAddr))
+	defer s.Stop()
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\n\r\n", echo.Addr())
+	require.NoError(t, err)
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	_, err = conn.Write([]byte("hello world\n"))
+	require.NoError(t, err)
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "hello world\n", line)
+	require.Equal(t, echo.Addr().String(), tunnelDestination())
+
+	// as are HTTP requests that are reverse proxied
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	}))
+	defer web.Close()
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(&url.URL{Host: s.Addr().String()})}}
+	response, err = client.Get(web.URL)
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(response.Body)
+	_ = response.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(body))
+	require.Equal(t, web.Listener.Addr().String(), tunnelDestination())
+}
+
+func TestUpstreamProxyWithDialer(t *testing.T) {
+	_, err := New(UpstreamProxy("http://proxy:3128", ""), WithDialer(proxydialer.DialTarget))
+	require.Error(t, err)
+}
@@ -0,0 +1,309 @@
+package grpc_proxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/bradleyjkemp/grpc-tools/internal"
+	"github.com/bradleyjkemp/grpc-tools/internal/connlog"
+	"github.com/bradleyjkemp/grpc-tools/internal/peekconn"
+)
+
+// This file implements a SOCKS5 (RFC 1928) and SOCKS4a front end for
+// clients that don't support HTTP proxies. Only the CONNECT command is
+// supported: the connection is then handled as if it had been tunnelled
+// with an HTTP CONNECT request.
+
+const (
+	socks4Version = 0x04
+	socks5Version = 0x05
+
+	socksConnect = 0x01
+
+	socks5NoAuth           = 0x00
+	socks5UsernamePassword = 0x02
+	socks5NoAcceptable     = 0xff
+
+	// RFC 1929 username/password authentication
+	socks5AuthVersion   = 0x01
+	socks5AuthSucceeded = 0x00
+	socks5AuthFailed    = 0x01
+
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+
+	socks5Succeeded          = 0x00
+	socks5GeneralFailure     = 0x01
+	socks5CommandUnsupported = 0x07
+	socks5AddrUnsupported    = 0x08
+
+	socks4Granted  = 0x5a
+	socks4Rejected = 0x5b
+)
+
+// the first byte of a SOCKS handshake is the version
+// (which can't be confused with HTTP methods, the HTTP/2 preface or a TLS handshake)
+var socksPattern = regexp.MustCompile(`^[\x04\x05]`)
+
+// the time allowed for clients to send their first byte and complete a SOCKS handshake
+var socksHandshakeTimeout = 30 * time.Second
+
+// the longest SOCKS4 user ID or SOCKS4a domain name accepted
+const socks4MaxStringLength = 255
+
+// acceptSOCKS checks whether a new connection is a SOCKS handshake. If it is then
+// the handshake is completed and the connection redirected to its destination,
+// otherwise the connection is returned to be handled as normal.
+func (l *proxyListener) acceptSOCKS(rawConn net.Conn) (net.Conn, bool) {
+	conn := peekconn.New(rawConn)
+	// clients that never send anything mustn't hold on to the connection (and goroutine) forever
+	_ = conn.SetReadDeadline(time.Now().Add(socksHandshakeTimeout))
+	isSOCKS, err := conn.PeekMatch(socksPattern, 1)
+	if err != nil {
+		l.logger.WithError(err).Debugf("Failed peeking connection from %v", rawConn.RemoteAddr())
+		_ = conn.Close()
+		return nil, true
+	}
+	if !isSOCKS {
+		_ = conn.SetReadDeadline(time.Time{})
+		return conn, false
+	}
+
+	destination, user, err := socksHandshake(conn, l.auth)
+	if err != nil {
+		l.logger.WithError(err).Debugf("Failed SOCKS handshake from %v", rawConn.RemoteAddr())
+		_ = conn.Close()
+		return nil, true
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	l.logger.Debugf("Handling SOCKS CONNECT request for destination %s", destination)
+	connlog.Log(rawConn, &internal.ConnectionEvent{
+		Event:       internal.ConnectionConnect,
+		Destination: destination,
+		Protocol:    "socks",
+	})
+	l.internalRedirect(conn, destination, user)
+	return nil, true
+}
+
+// socksHandshake reads a SOCKS4(a) or SOCKS5 CONNECT request and replies to it
+// returning the requested destination and the authenticated user (if any)
+func socksHandshake(conn net.Conn, auth *proxyAuth) (string, string, error) {
+	// the handshake is small so doesn't need buffering on the write side
+	reader := bufio.NewReaderSize(conn, 512)
+	version, err := reader.ReadByte()
+	if err != nil {
+		return "", "", err
+	}
+	var destination, user string
+	switch version {
+	case socks5Version:
+		user, err = socks5Authenticate(reader, conn, auth)
+		if err == nil {
+			destination, err = socks5Handshake(reader, conn)
+		}
+	case socks4Version:
+		if auth != nil && auth.required() {
+			// SOCKS4 has no passwords
+			_, _ = conn.Write([]byte{0x00, socks4Rejected, 0, 0, 0, 0, 0, 0})
+			return "", "", errors.New("SOCKS4 clients can't authenticate")
+		}
+		destination, err = socks4Handshake(reader, conn)
+	default:
+		err = fmt.Errorf("unsupported SOCKS version %d", version)
+	}
+	if err == nil && reader.Buffered() > 0 {
+		// clients must wait for the reply before sending anything else
+		err = errors.New("unexpected data sent before the SOCKS reply")
+	}
+	return destination, user, err
+}
+
+// socks5Authenticate negotiates the authentication method
+// (username/password if authentication is required) and returns the user
+func socks5Authenticate(reader *bufio.Reader, conn io.Writer, auth *proxyAuth) (string, error) {
+	methods, err := readBytes(reader, 1)
+	if err != nil {
+		return "", err
+	}
+	offered, err := readBytes(reader, int(methods[0]))
+	if err != nil {
+		return "", err
+	}
+	if auth == nil || !auth.required() {
+		if !containsByte(offered, socks5NoAuth) {
+			_, _ = conn.Write([]byte{socks5Version, socks5NoAcceptable})
+			return "", errors.New("client doesn't support unauthenticated SOCKS5")
+		}
+		_, err = conn.Write([]byte{socks5Version, socks5NoAuth})
+		return "", err
+	}
+
+	if !containsByte(offered, socks5UsernamePassword) {
+		_, _ = conn.Write([]byte{socks5Version, socks5NoAcceptable})
+		return "", errors.New("client doesn't support SOCKS5 username/password authentication")
+	}
+	if _, err := conn.Write([]byte{socks5Version, socks5UsernamePassword}); err != nil {
+		return "", err
+	}
+	// VER ULEN UNAME PLEN PASSWD
+	header, err := readBytes(reader, 2)
+	if err != nil {
+		return "", err
+	}
+	if header[0] != socks5AuthVersion {
+		return "", fmt.Errorf("unexpected SOCKS5 authentication version %d", header[0])
+	}
+	username, err := readBytes(reader, int(header[1]))
+	if err != nil {
+		return "", err
+	}
+	passwordLength, err := readBytes(reader, 1)
+	if err != nil {
+		return "", err
+	}
+	password, err := readBytes(reader, int(passwordLength[0]))
+	if err != nil {
+		return "", err
+	}
+	if !auth.check(string(username), string(password)) {
+		_, _ = conn.Write([]byte{socks5AuthVersion, socks5AuthFailed})
+		return "", fmt.Errorf("invalid SOCKS5 credentials for user %q", username)
+	}
+	_, err = conn.Write([]byte{socks5AuthVersion, socks5AuthSucceeded})
+	return string(username), err
+}
+
+func socks5Handshake(reader *bufio.Reader, conn io.Writer) (string, error) {
+	// VER CMD RSV ATYP
+	header, err := readBytes(reader, 4)
+	if err != nil {
+		return "", err
+	}
+	if header[0] != socks5Version {
+		return "", fmt.Errorf("unexpected SOCKS5 request version %d", header[0])
+	}
+	var host string
+	switch header[3] {
+	case socks5AddrIPv4:
+		ip, err := readBytes(reader, net.IPv4len)
+		if err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socks5AddrIPv6:
+		ip, err := readBytes(reader, net.IPv6len)
+		if err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socks5AddrDomain:
+		length, err := readBytes(reader, 1)
+		if err != nil {
+			return "", err
+		}
+		if length[0] == 0 {
+			_ = socks5Reply(conn, socks5GeneralFailure)
+			return "", errors.New("empty SOCKS5 domain name")
+		}
+		domain, err := readBytes(reader, int(length[0]))
+		if err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		_ = socks5Reply(conn, socks5AddrUnsupported)
+		return "", fmt.Errorf("unsupported SOCKS5 address type %d", header[3])
+	}
+	port, err := readBytes(reader, 2)
+	if err != nil {
+		return "", err
+	}
+	if header[1] != socksConnect {
+		_ = socks5Reply(conn, socks5CommandUnsupported)
+		return "", fmt.Errorf("unsupported SOCKS5 command %d", header[1])
+	}
+	if err := socks5Reply(conn, socks5Succeeded); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+func socks5Reply(conn io.Writer, reply byte) error {
+	// the bound address isn't meaningful as the proxy connects lazily so is left empty
+	_, err := conn.Write([]byte{socks5Version, reply, 0x00, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+func socks4Handshake(reader *bufio.Reader, conn io.Writer) (string, error) {
+	// CMD DSTPORT DSTIP
+	header, err := readBytes(reader, 7)
+	if err != nil {
+		return "", err
+	}
+	// the user ID isn't used
+	if _, err := readNullTerminated(reader); err != nil {
+		return "", err
+	}
+	host := net.IP(header[3:7]).String()
+	if header[3] == 0 && header[4] == 0 && header[5] == 0 && header[6] != 0 {
+		// SOCKS4a: an invalid IP of 0.0.0.x means a domain name follows
+		host, err = readNullTerminated(reader)
+		if err != nil {
+			return "", err
+		}
+		if host == "" {
+			_, _ = conn.Write([]byte{0x00, socks4Rejected, 0, 0, 0, 0, 0, 0})
+			return "", errors.New("empty SOCKS4a domain name")
+		}
+	}
+	if header[0] != socksConnect {
+		_, _ = conn.Write([]byte{0x00, socks4Rejected, 0, 0, 0, 0, 0, 0})
+		return "", fmt.Errorf("unsupported SOCKS4 command %d", header[0])
+	}
+	if _, err := conn.Write([]byte{0x00, socks4Granted, 0, 0, 0, 0, 0, 0}); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(header[1:3])))), nil
+}
+
+func readBytes(reader io.Reader, n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := io.ReadFull(reader, b)
+	return b, err
+}
+
+// readNullTerminated reads a SOCKS4 string (without its terminating null byte)
+func readNullTerminated(reader *bufio.Reader) (string, error) {
+	var b []byte
+	for {
+		c, err := reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if c == 0 {
+			return string(b), nil
+		}
+		if len(b) == socks4MaxStringLength {
+			return "", fmt.Errorf("SOCKS4 string longer than %d bytes", socks4MaxStringLength)
+		}
+		b = append(b, c)
+	}
+}
+
+func containsByte(b []byte, c byte) bool {
+	for _, v := range b {
+		if v == c {
+			return true
+		}
+	}
+	return false
+}
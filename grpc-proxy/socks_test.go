@@ -0,0 +1,90 @@
+package grpc_proxy
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+// scriptedConn reads a fixed handshake and records the replies
+type scriptedConn struct {
+	net.Conn
+	request *bytes.Reader
+	replies bytes.Buffer
+}
+
+func (c *scriptedConn) Read(b []byte) (int, error) {
+	return c.request.Read(b)
+}
+
+func (c *scriptedConn) Write(b []byte) (int, error) {
+	return c.replies.Write(b)
+}
+
+func TestSOCKSHandshake(t *testing.T) {
+	valid := map[string]string{
+		"\x05\x01\x00\x05\x01\x00\x01\x0a\x00\x00\x01\x01\xbb":                                "10.0.0.1:443",
+		"\x05\x01\x00\x05\x01\x00\x03\x0bexample.com\x00\x50":                                 "example.com:80",
+		"\x04\x01\x00\x50\x0a\x00\x00\x01user\x00":                                            "10.0.0.1:80",
+		"\x04\x01\x00\x50\x00\x00\x00\x01\x00example.com\x00":                                 "example.com:80",
+		"\x04\x01\x00\x50\x00\x00\x00\x01" + strings.Repeat("u", 255) + "\x00example.com\x00": "example.com:80",
+	}
+	for request, expected := range valid {
+		destination, _, err := socksHandshake(&scriptedConn{request: bytes.NewReader([]byte(request))}, nil)
+		require.NoError(t, err, "%q", request)
+		require.Equal(t, expected, destination, "%q", request)
+	}
+
+	invalid := []string{
+		// empty SOCKS5 domain
+		"\x05\x01\x00\x05\x01\x00\x03\x00\x00\x50",
+		// empty SOCKS4a domain
+		"\x04\x01\x00\x50\x00\x00\x00\x01\x00\x00",
+		// SOCKS4 user ID and SOCKS4a domain longer than 255 bytes
+		"\x04\x01\x00\x50\x0a\x00\x00\x01" + strings.Repeat("u", 256) + "\x00",
+		"\x04\x01\x00\x50\x00\x00\x00\x01\x00" + strings.Repeat("a", 256) + "\x00",
+		// unterminated SOCKS4 user ID
+		"\x04\x01\x00\x50\x0a\x00\x00\x01user",
+	}
+	for _, request := range invalid {
+		_, _, err := socksHandshake(&scriptedConn{request: bytes.NewReader([]byte(request))}, nil)
+		require.Error(t, err, "%q", request)
+	}
+}
+
+func TestSOCKSHandshakeTimeout(t *testing.T) {
+	defer func(timeout time.Duration) {
+		socksHandshakeTimeout = timeout
+	}(socksHandshakeTimeout)
+	socksHandshakeTimeout = 100 * time.Millisecond
+
+	ln, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	proxyLis := newProxyListener(logrus.New(), ln)
+	proxyLis.socks = true
+	defer proxyLis.Close()
+	go proxyLis.Accept()
+
+	// clients that send nothing, or stop part way through the handshake, are disconnected
+	for _, request := range []string{"", "\x05"} {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		require.NoError(t, err)
+		_, err = conn.Write([]byte(request))
+		require.NoError(t, err)
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		_, err = conn.Read(make([]byte, 1))
+		require.Error(t, err, "%q", request)
+		require.False(t, isTimeout(err), "the proxy should have closed the connection")
+		_ = conn.Close()
+	}
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
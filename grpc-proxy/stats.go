@@ -0,0 +1,121 @@
+package grpc_proxy
+
+import (
+	"context"
+	"sync"
+
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/stats"
+)
+
+// rpcStats collects the transport level details of an RPC that
+// aren't available through the grpc.ServerStream API.
+type rpcStats struct {
+	sync.Mutex
+	requestEncoding string
+	lastIn          *stats.InPayload
+	lastOut         *stats.OutPayload
+	timing          RPCTiming
+}
+
+type rpcStatsKey struct{}
+
+func rpcStatsFromContext(ctx context.Context) *rpcStats {
+	s, _ := ctx.Value(rpcStatsKey{}).(*rpcStats)
+	return s
+}
+
+// the encoding used for requests (grpc-encoding), empty if uncompressed
+func (s *rpcStats) RequestEncoding() string {
+	if s == nil {
+		return ""
+	}
+	s.Lock()
+	defer s.Unlock()
+	if s.requestEncoding == encoding.Identity {
+		return ""
+	}
+	return s.requestEncoding
+}
+
+// the encoding used for responses to the client: grpc-go servers respond
+// using the request encoding if they have a compressor registered for it
+func (s *rpcStats) ResponseEncoding() string {
+	requestEncoding := s.RequestEncoding()
+	if encoding.GetCompressor(requestEncoding) == nil {
+		return ""
+	}
+	return requestEncoding
+}
+
+// Timing returns a copy of the RPC's timing so far
+func (s *rpcStats) Timing() RPCTiming {
+	if s == nil {
+		return RPCTiming{}
+	}
+	s.Lock()
+	defer s.Unlock()
+	return s.timing
+}
+
+// updateTiming records the time of events in the RPC's timing
+func (s *rpcStats) updateTiming(update func(timing *RPCTiming)) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	update(&s.timing)
+}
+
+// the most recent payloads received and sent
+// (each is only modified by the goroutine receiving/sending messages)
+func (s *rpcStats) LastIn() *stats.InPayload {
+	if s == nil {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+	return s.lastIn
+}
+
+func (s *rpcStats) LastOut() *stats.OutPayload {
+	if s == nil {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+	return s.lastOut
+}
+
+// statsHandler implements stats.Handler to populate the rpcStats of each RPC
+type statsHandler struct{}
+
+func (statsHandler) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context {
+	return context.WithValue(ctx, rpcStatsKey{}, &rpcStats{})
+}
+
+func (statsHandler) HandleRPC(ctx context.Context, rs stats.RPCStats) {
+	s := rpcStatsFromContext(ctx)
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	switch rs := rs.(type) {
+	case *stats.Begin:
+		s.timing.Received = rs.BeginTime
+	case *stats.InHeader:
+		s.requestEncoding = rs.Compression
+	case *stats.InPayload:
+		s.lastIn = rs
+	case *stats.OutPayload:
+		s.lastOut = rs
+	}
+}
+
+func (statsHandler) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (statsHandler) HandleConn(context.Context, stats.ConnStats) {}
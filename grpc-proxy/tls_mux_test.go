@@ -3,14 +3,16 @@ package grpc_proxy
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/bradleyjkemp/grpc-tools/testutils"
 
@@ -34,11 +36,12 @@ func TestTLSMux_HTTP2Support(t *testing.T) {
 	// New keypair.
 	tlsCert, err := testutils.NewSelfSignedKeyPair()
 	require.NoError(t, err, "failed loading X509 keypair")
-	x509Cert, err := x509.ParseCertificate(tlsCert.Certificate[0])
-	require.NoError(t, err, "failed parsing certificate out of keypair")
+	getCert := func(string) (*tls.Certificate, error) {
+		return &tlsCert, nil
+	}
 
 	// Get TLS listener.
-	_, httpsLis := tlsmux.New(logger, proxyLis, x509Cert, tlsCert, ioutil.Discard)
+	_, httpsLis := tlsmux.New(logger, proxyLis, getCert, &tls.Config{})
 
 	// Start mock server with TLS listener.
 	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
@@ -56,3 +59,131 @@ func TestTLSMux_HTTP2Support(t *testing.T) {
 	_, err = client.Do(req)
 	require.NoError(t, err, "failed requesting")
 }
+
+// TestTLSMux_InterceptionPolicy verifies that connections excluded by the interception
+// policy, or to hosts whose clients rejected our certificate, are forwarded untouched.
+func TestTLSMux_InterceptionPolicy(t *testing.T) {
+	logger := logrus.New()
+	destination := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer destination.Close()
+	destinationCert := destination.Certificate()
+
+	tlsCert, err := testutils.NewSelfSignedKeyPair()
+	require.NoError(t, err, "failed loading X509 keypair")
+	getCert := func(string) (*tls.Certificate, error) {
+		return &tlsCert, nil
+	}
+
+	// handshake tunnels a connection to the destination through the proxy
+	// and returns the certificate the client was presented with
+	handshake := func(interception *interception, clientConfig *tls.Config) ([]byte, error) {
+		ln, err := net.Listen("tcp", "localhost:0")
+		require.NoError(t, err)
+		proxyLis := newProxyListener(logger, ln)
+		defer proxyLis.Close()
+		tlsmux.NewWithPolicy(logger, proxyLis, getCert, &tls.Config{}, tlsmux.AllowBoth, interception, nil)
+
+		tunnels, err := net.Listen("tcp", "localhost:0")
+		require.NoError(t, err)
+		defer tunnels.Close()
+		go func() {
+			conn, err := tunnels.Accept()
+			if err == nil {
+				proxyLis.internalRedirect(conn, destination.Listener.Addr().String(), "")
+			}
+		}()
+		conn, err := net.Dial("tcp", tunnels.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+
+		client := tls.Client(conn, clientConfig)
+		if err := client.Handshake(); err != nil {
+			return nil, err
+		}
+		return client.ConnectionState().PeerCertificates[0].Raw, nil
+	}
+	newPolicy := func(policy InterceptionPolicy) *interception {
+		interception, err := newInterception(logger, policy)
+		require.NoError(t, err)
+		return interception
+	}
+	insecure := &tls.Config{InsecureSkipVerify: true}
+
+	cert, err := handshake(newPolicy(InterceptionPolicy{}), insecure)
+	require.NoError(t, err)
+	require.Equal(t, tlsCert.Certificate[0], cert, "connection should have been intercepted")
+
+	cert, err = handshake(newPolicy(InterceptionPolicy{SkipHosts: []string{"127.0.0.*"}}), insecure)
+	require.NoError(t, err)
+	require.Equal(t, destinationCert.Raw, cert, "skipped host should have been forwarded")
+
+	cert, err = handshake(newPolicy(InterceptionPolicy{Hosts: []string{"127.0.0.1"}, Ports: []int{1}}), insecure)
+	require.NoError(t, err)
+	require.Equal(t, destinationCert.Raw, cert, "connection to another port should have been forwarded")
+
+	// a client pinning the destination's certificate rejects ours
+	roots := x509.NewCertPool()
+	roots.AddCert(destinationCert)
+	pinned := &tls.Config{RootCAs: roots, ServerName: "example.com"}
+	bypass := newPolicy(InterceptionPolicy{BypassRejected: true})
+	_, err = handshake(bypass, pinned)
+	require.Error(t, err, "client should have rejected our certificate")
+	client := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	require.Eventually(t, func() bool {
+		return !bypass.Intercept(client, destination.Listener.Addr().String())
+	}, time.Second, 10*time.Millisecond, "destination should no longer be intercepted")
+	require.True(t, bypass.Intercept(&net.TCPAddr{IP: net.IPv4(10, 0, 0, 1)}, destination.Listener.Addr().String()), "other clients should still be intercepted")
+
+	cert, err = handshake(bypass, pinned)
+	require.NoError(t, err)
+	require.Equal(t, destinationCert.Raw, cert, "rejected destination should have been forwarded")
+
+	// the bypass expires
+	bypass.now = func() time.Time {
+		return time.Now().Add(bypassDuration)
+	}
+	require.True(t, bypass.Intercept(client, destination.Listener.Addr().String()))
+}
+
+func TestInterceptionRejected(t *testing.T) {
+	interception, err := newInterception(logrus.New(), InterceptionPolicy{BypassRejected: true})
+	require.NoError(t, err)
+	client := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+
+	// only alerts rejecting the certificate count
+	interception.Rejected(client, "api.example.com:443", io.EOF)
+	interception.Rejected(client, "api.example.com:443", &net.OpError{Op: "remote error", Err: errors.New("tls: protocol version not supported")})
+	require.True(t, interception.Intercept(client, "api.example.com:443"))
+
+	interception.Rejected(client, "api.example.com:443", &net.OpError{Op: "remote error", Err: errors.New("tls: unknown certificate authority")})
+	require.False(t, interception.Intercept(client, "api.example.com:443"))
+	// from the same client (on any port) to the same destination
+	require.False(t, interception.Intercept(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5678}, "api.example.com:443"))
+	require.True(t, interception.Intercept(client, "other.example.com:443"))
+
+	// nothing is bypassed unless BypassRejected is set (which it isn't by default)
+	s, err := New()
+	require.NoError(t, err)
+	require.False(t, s.interceptionPolicy.BypassRejected)
+	interception, err = newInterception(logrus.New(), s.interceptionPolicy)
+	require.NoError(t, err)
+	interception.Rejected(client, "api.example.com:443", &net.OpError{Op: "remote error", Err: errors.New("tls: bad certificate")})
+	require.True(t, interception.Intercept(client, "api.example.com:443"))
+}
+
+func TestDefaultFlagsInterceptionPolicy(t *testing.T) {
+	defer func(skipIntercept string) {
+		fSkipIntercept = skipIntercept
+	}(fSkipIntercept)
+	fSkipIntercept = "pinned.example.com"
+
+	// flags that weren't given leave the rest of the policy unchanged
+	s := &server{}
+	WithInterceptionPolicy(InterceptionPolicy{Hosts: []string{"*.example.com"}, BypassRejected: true})(s)
+	DefaultFlags()(s)
+	require.Equal(t, InterceptionPolicy{
+		Hosts:          []string{"*.example.com"},
+		SkipHosts:      []string{"pinned.example.com"},
+		BypassRejected: true,
+	}, s.interceptionPolicy)
+}
@@ -12,14 +12,23 @@ import (
 
 func main() {
 	var (
-		destinationOverride = flag.String("destination", "", "Destination server to forward requests to. By default the destination for each RPC is autodetected from the dump metadata.")
+		destinationOverride = flag.String("destination", "", "Destination server to forward requests to (unix domain sockets can be used with unix:///path or unix-abstract:name). By default the destination for each RPC is autodetected from the dump metadata.")
 		dumpPath            = flag.String("dump", "", "The gRPC dump to replay requests from")
 		protoRoots          = flag.String("proto_roots", "", "A comma separated list of directories to search for gRPC service definitions.")
-		protoDescriptors    = flag.String("proto_descriptors", "", "A comma separated list of proto descriptors to load gRPC service definitions from.")
+		protoImportPaths    = flag.String("proto_import_paths", "", "A comma separated list of directories to search for imports of the files in --proto_roots.")
+		protoDescriptors    = flag.String("proto_descriptors", "", "A comma separated list of descriptor set files (protoc --descriptor_set_out or buf image) to load gRPC service definitions from.")
+		timeoutScale        = flag.Float64("timeout_scale", 1, "Multiplier applied to the recorded timeout of each RPC (e.g. 2 doubles them). 0 disables timeouts.")
 	)
 
 	flag.Parse()
-	err := replay.Run(*protoRoots, *protoDescriptors, *dumpPath, *destinationOverride, proxydialer.NewProxyDialer(httpproxy.FromEnvironment().ProxyFunc()))
+	err := replay.Run(replay.Config{
+		ProtoRoots:          *protoRoots,
+		ProtoImportPaths:    *protoImportPaths,
+		ProtoDescriptors:    *protoDescriptors,
+		DumpPath:            *dumpPath,
+		DestinationOverride: *destinationOverride,
+		TimeoutScale:        *timeoutScale,
+	}, proxydialer.NewProxyDialer(httpproxy.FromEnvironment().ProxyFunc()))
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
 		flag.Usage()
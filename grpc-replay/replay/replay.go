@@ -2,52 +2,54 @@ package replay
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"github.com/bradleyjkemp/grpc-tools/grpc-proxy"
 	"github.com/bradleyjkemp/grpc-tools/internal"
 	"github.com/bradleyjkemp/grpc-tools/internal/codec"
+	_ "github.com/bradleyjkemp/grpc-tools/internal/compression"
 	"github.com/bradleyjkemp/grpc-tools/internal/marker"
 	"github.com/bradleyjkemp/grpc-tools/internal/proto_decoder"
+	"github.com/bradleyjkemp/grpc-tools/internal/proxydialer"
+	"github.com/golang/protobuf/proto"
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 	"io"
 	"os"
-	"strings"
 	"time"
 )
 
-func Run(protoRoots, protoDescriptors, dumpPath, destinationOverride string, dialer grpc_proxy.ContextDialer) error {
-	pool := internal.NewConnPool(logrus.New(), dialer)
+// Config holds the grpc-replay settings (see the grpc-replay flags for details).
+type Config struct {
+	ProtoRoots          string // comma separated
+	ProtoImportPaths    string // comma separated
+	ProtoDescriptors    string // comma separated
+	DumpPath            string
+	DestinationOverride string
+	// multiplier applied to the recorded timeout of each RPC (0 disables timeouts)
+	TimeoutScale float64
+}
+
+func Run(config Config, dialer grpc_proxy.ContextDialer) error {
+	logger := logrus.New()
+	pool := internal.NewConnPool(logger, dialer)
 
-	dumpFile, err := os.Open(dumpPath)
+	dumpFile, err := os.Open(config.DumpPath)
 	if err != nil {
 		return err
 	}
-	var resolvers []proto_decoder.MessageResolver
-	if protoRoots != "" {
-		r, err := proto_decoder.NewFileResolver(strings.Split(protoRoots, ",")...)
-		if err != nil {
-			return err
-		}
-		resolvers = append(resolvers, r)
-	}
-	if protoDescriptors != "" {
-		r, err := proto_decoder.NewDescriptorResolver(strings.Split(protoRoots, ",")...)
-		if err != nil {
-			return err
-		}
-		resolvers = append(resolvers, r)
+	defer dumpFile.Close()
+	resolvers, err := proto_decoder.LoadResolvers(logger, config.ProtoRoots, config.ProtoImportPaths, config.ProtoDescriptors)
+	if err != nil {
+		return err
 	}
 	encoder := proto_decoder.NewEncoder(resolvers...)
 
-	dumpDecoder := json.NewDecoder(dumpFile)
-RPC:
+	dumpReader := internal.NewDumpReader(dumpFile)
 	for {
-		rpc := internal.RPC{}
-		err := dumpDecoder.Decode(&rpc)
+		rpc, err := dumpReader.Read()
 		if err == io.EOF {
 			break
 		}
@@ -55,64 +57,130 @@ RPC:
 			return fmt.Errorf("failed to decode dump: %s", err)
 		}
 
-		conn, err := getConnection(pool, rpc.Metadata, destinationOverride)
+		conn, err := getConnection(pool, rpc.Metadata, config.DestinationOverride)
 		if err != nil {
-			return fmt.Errorf("failed to connect to destination (%s): %s", destinationOverride, err)
+			return fmt.Errorf("failed to connect to destination (%s): %s", config.DestinationOverride, err)
 		}
 
-		// RPC has metadata added by grpc-dump that should be removed before sending
-		// (so that we're sending as close as possible to the original request)
-		marker.RemoveHTTPSMarker(rpc.Metadata)
-
-		ctx := metadata.NewOutgoingContext(context.Background(), rpc.Metadata)
-		streamName := rpc.StreamName()
-		str, err := conn.NewStream(ctx, &grpc.StreamDesc{
-			StreamName:    streamName,
-			ServerStreams: true,
-			ClientStreams: true,
-		}, streamName)
+		if err := replayRPC(conn, encoder, rpc, config.TimeoutScale); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replayRPC sends the client messages of an RPC and prints whether the server's
+// responses match. Errors are only returned if the RPC couldn't be replayed.
+func replayRPC(conn *grpc.ClientConn, encoder proto_decoder.MessageEncoder, rpc *internal.RPC, timeoutScale float64) error {
+	// RPC has metadata added by grpc-dump that should be removed before sending
+	// (so that we're sending as close as possible to the original request)
+	marker.RemoveHTTPSMarker(rpc.Metadata)
+
+	ctx, cancel, err := rpcContext(rpc, timeoutScale)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	md := proto_decoder.EncodeBinaryMetadata(internal.RequestMetadata, rpc.Metadata, rpc.BinaryMetadata)
+	ctx = metadata.NewOutgoingContext(ctx, md)
+	streamName := rpc.StreamName()
+	var callOptions []grpc.CallOption
+	if rpc.RequestEncoding != "" {
+		// compress requests in the same way as the original client
+		callOptions = append(callOptions, grpc.UseCompressor(rpc.RequestEncoding))
+	}
+	str, err := conn.NewStream(ctx, &grpc.StreamDesc{
+		StreamName:    streamName,
+		ServerStreams: true,
+		ClientStreams: true,
+	}, streamName, callOptions...)
+	if err != nil {
+		return fmt.Errorf("failed to make new stream: %v", err)
+	}
+
+	fmt.Print(streamName, "...")
+	for _, message := range rpc.Messages {
+		msgBytes, err := encoder.Encode(streamName, message)
 		if err != nil {
-			return fmt.Errorf("failed to make new stream: %v", err)
+			return fmt.Errorf("failed to encode message: %v", err)
 		}
 
-		fmt.Print(streamName, "...")
-		for _, message := range rpc.Messages {
-			msgBytes, err := encoder.Encode(streamName, message)
+		switch message.MessageOrigin {
+		case internal.ClientMessage:
+			err := str.SendMsg(msgBytes)
 			if err != nil {
-				return fmt.Errorf("failed to encode message: %v", err)
+				return fmt.Errorf("failed to send message: %v", err)
 			}
-
-			switch message.MessageOrigin {
-			case internal.ClientMessage:
-				err := str.SendMsg(msgBytes)
-				if err != nil {
-					return fmt.Errorf("failed to send message: %v", err)
-				}
-			case internal.ServerMessage:
-				var resp []byte
-				err := str.RecvMsg(&resp)
-				if err != nil {
-					// TODO when do we assert on RPC errors?
-					return fmt.Errorf("failed to recv message: %v", err)
-				}
-				if string(resp) != string(msgBytes) {
-					fmt.Println("Err mismatch")
-					continue RPC
-				}
-			default:
-				return fmt.Errorf("invalid message type: %v", message.MessageOrigin)
+		case internal.ServerMessage:
+			var resp []byte
+			err := str.RecvMsg(&resp)
+			if err != nil && rpc.Status != nil {
+				// the RPC failed early so check it failed in the same way as recorded
+				printStatusResult(rpc.Status, err)
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("failed to recv message: %v", err)
 			}
+			if string(resp) != string(msgBytes) {
+				fmt.Println("Err mismatch")
+				return nil
+			}
+		default:
+			return fmt.Errorf("invalid message type: %v", message.MessageOrigin)
+		}
+	}
+	if rpc.Status != nil {
+		if err := str.CloseSend(); err != nil {
+			return fmt.Errorf("failed to close stream: %v", err)
+		}
+		var resp []byte
+		err := str.RecvMsg(&resp)
+		if err == io.EOF {
+			err = nil
 		}
-		fmt.Println("OK")
+		printStatusResult(rpc.Status, err)
+		return nil
 	}
+	fmt.Println("OK")
 	return nil
 }
 
+// rpcContext applies the RPC's recorded timeout (scaled by timeoutScale)
+func rpcContext(rpc *internal.RPC, timeoutScale float64) (context.Context, context.CancelFunc, error) {
+	timeout, ok, err := rpc.TimeoutDuration()
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ok || timeoutScale == 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		return ctx, cancel, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(float64(timeout)*timeoutScale))
+	return ctx, cancel, nil
+}
+
+// printStatusResult compares the status an RPC finished with against the recorded one
+// (including any error details)
+func printStatusResult(expected *internal.Status, err error) {
+	expectedStatus, encodeErr := proto_decoder.EncodeStatus(expected)
+	if encodeErr != nil {
+		fmt.Println("Err failed to encode recorded status:", encodeErr)
+		return
+	}
+	actualStatus, _ := status.FromError(err)
+	if !proto.Equal(expectedStatus.Proto(), actualStatus.Proto()) {
+		fmt.Printf("Err status mismatch: expected %s %q, got %s %q\n", expectedStatus.Code(), expectedStatus.Message(), actualStatus.Code(), actualStatus.Message())
+		return
+	}
+	fmt.Println("OK")
+}
+
 func getConnection(pool *internal.ConnPool, md metadata.MD, destinationOverride string) (*grpc.ClientConn, error) {
 	// if no destination override set then auto-detect from the metadata
 	var destination = destinationOverride
+	authority := md.Get(":authority")
 	if destination == "" {
-		authority := md.Get(":authority")
 		if len(authority) == 0 {
 			return nil, fmt.Errorf("no destination override specified and could not auto-detect from dump")
 		}
@@ -123,6 +191,14 @@ func getConnection(pool *internal.ConnPool, md metadata.MD, destinationOverride
 		grpc.WithDefaultCallOptions(grpc.ForceCodec(codec.NoopCodec{})),
 		grpc.WithBlock(),
 	}
+	if proxydialer.IsUnixTarget(destination) {
+		// send the recorded authority rather than the socket path
+		if len(authority) > 0 && !proxydialer.IsUnixTarget(authority[0]) {
+			options = append(options, grpc.WithAuthority(authority[0]))
+		} else {
+			options = append(options, grpc.WithAuthority("localhost"))
+		}
+	}
 
 	if marker.IsTLSRPC(md) {
 		options = append(options, grpc.WithTransportCredentials(credentials.NewTLS(nil)))
@@ -0,0 +1,62 @@
+package replay
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bradleyjkemp/grpc-tools/grpc-fixture/fixture"
+	"github.com/bradleyjkemp/grpc-tools/grpc-proxy"
+	"github.com/bradleyjkemp/grpc-tools/internal/proto_decoder"
+	"github.com/bradleyjkemp/grpc-tools/internal/proxydialer"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/metadata"
+)
+
+const testDump = `{"service":"test.Service","method":"Method","messages":[{"message_origin":"client","raw_message":"CgNmb28="},{"message_origin":"server","raw_message":"CgNiYXI="}],"metadata":{":authority":["api.example.com"]}}`
+
+// errorsObserver sends the error of each finished RPC to a channel
+type errorsObserver chan error
+
+func (o errorsObserver) RPCStarted(*grpc_proxy.RPCInfo)                           {}
+func (o errorsObserver) MessageObserved(*grpc_proxy.RPCInfo, *grpc_proxy.Message) {}
+func (o errorsObserver) HeadersObserved(*grpc_proxy.RPCInfo, metadata.MD)         {}
+func (o errorsObserver) TrailersObserved(*grpc_proxy.RPCInfo, metadata.MD)        {}
+func (o errorsObserver) RPCFinished(_ *grpc_proxy.RPCInfo, err error) {
+	o <- err
+}
+
+func TestReplayToUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grpc-replay")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	dumpPath := filepath.Join(dir, "dump.json")
+	require.NoError(t, ioutil.WriteFile(dumpPath, []byte(testDump), 0644))
+	socket := filepath.Join(dir, "server.sock")
+
+	interceptor, err := fixture.Interceptor(strings.NewReader(testDump), proto_decoder.NewEncoder(), fixture.Options{})
+	require.NoError(t, err)
+	finished := make(errorsObserver, 1)
+	server, err := grpc_proxy.New(
+		grpc_proxy.UnixSocket(socket),
+		grpc_proxy.DirectServer(),
+		grpc_proxy.WithInterceptor(interceptor),
+		grpc_proxy.WithObserver(finished),
+	)
+	require.NoError(t, err)
+	require.NoError(t, server.Listen())
+	go server.Serve()
+	defer server.Stop()
+
+	err = Run(Config{
+		DumpPath:            dumpPath,
+		DestinationOverride: "unix://" + socket,
+	}, proxydialer.NewProxyDialer(func(*url.URL) (*url.URL, error) {
+		return nil, nil
+	}))
+	require.NoError(t, err)
+	require.NoError(t, <-finished, "the replayed request should have matched the saved one")
+}
@@ -0,0 +1,43 @@
+package grpctools
+
+import (
+	"github.com/bradleyjkemp/grpc-tools/internal/proto_decoder"
+	"github.com/sirupsen/logrus"
+)
+
+// MessageResolver finds the descriptor used to decode or encode a message.
+type MessageResolver = proto_decoder.MessageResolver
+
+// MessageDecoder turns raw message bytes into a human readable message.
+type MessageDecoder = proto_decoder.MessageDecoder
+
+// MessageEncoder turns a (possibly human readable) message back into bytes.
+type MessageEncoder = proto_decoder.MessageEncoder
+
+// NewFileResolver resolves messages using the .proto files
+// found by recursively searching the given directories.
+func NewFileResolver(protoRoots ...string) (MessageResolver, error) {
+	return proto_decoder.NewFileResolver(logrus.New(), nil, protoRoots...)
+}
+
+// NewFileResolverWithImportPaths is like NewFileResolver but also
+// resolves imports using the .proto files in importPaths.
+func NewFileResolverWithImportPaths(importPaths []string, protoRoots ...string) (MessageResolver, error) {
+	return proto_decoder.NewFileResolver(logrus.New(), importPaths, protoRoots...)
+}
+
+// NewDescriptorResolver resolves messages using the given proto descriptors.
+func NewDescriptorResolver(protoDescriptors ...string) (MessageResolver, error) {
+	return proto_decoder.NewDescriptorResolver(protoDescriptors...)
+}
+
+// NewDecoder chains together resolvers (in priority order) to decode messages.
+// Messages that can't be resolved are decoded heuristically.
+func NewDecoder(resolvers ...MessageResolver) MessageDecoder {
+	return proto_decoder.NewDecoder(logrus.New(), resolvers...)
+}
+
+// NewEncoder chains together resolvers (in priority order) to encode messages.
+func NewEncoder(resolvers ...MessageResolver) MessageEncoder {
+	return proto_decoder.NewEncoder(resolvers...)
+}
@@ -0,0 +1,32 @@
+package grpctools
+
+import (
+	"io"
+	"os"
+
+	"github.com/bradleyjkemp/grpc-tools/internal"
+)
+
+// DumpWriter writes RPCs in the grpc-dump JSON stream format.
+type DumpWriter = internal.DumpWriter
+
+// DumpReader reads RPCs from a grpc-dump JSON stream.
+type DumpReader = internal.DumpReader
+
+func NewDumpWriter(output io.Writer) *DumpWriter {
+	return internal.NewDumpWriter(output)
+}
+
+func NewDumpReader(input io.Reader) *DumpReader {
+	return internal.NewDumpReader(input)
+}
+
+// ReadDumpFile reads all of the RPCs saved in a grpc-dump output file.
+func ReadDumpFile(path string) ([]*RPC, error) {
+	dumpFile, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer dumpFile.Close()
+	return NewDumpReader(dumpFile).ReadAll()
+}
@@ -0,0 +1,34 @@
+// Package grpctools exposes the building blocks of grpc-dump, grpc-fixture
+// and grpc-replay so that they can be embedded in other Go programs
+// (e.g. integration tests that want an in-process recorder or fixture server).
+//
+// The types in this package are aliases of the ones used internally by the
+// tools so values can be passed freely between the two.
+package grpctools
+
+import (
+	"github.com/bradleyjkemp/grpc-tools/internal"
+)
+
+// RPC is a single recorded RPC as it appears in the grpc-dump JSON stream.
+type RPC = internal.RPC
+
+// ConnectionEvent is an event on a client connection to a proxy (see grpc_proxy.WithConnectionObserver)
+type ConnectionEvent = internal.ConnectionEvent
+
+// Frame is an HTTP/2 frame captured by a proxy (see grpc_proxy.WithFrameCapture)
+type Frame = internal.Frame
+
+// Message is a single message sent by either the client or the server.
+type Message = internal.Message
+
+// Status is the gRPC status of an RPC that returned an error.
+type Status = internal.Status
+
+// MessageOrigin identifies whether a message was sent by the client or the server.
+type MessageOrigin = internal.MessageOrigin
+
+const (
+	ClientMessage = internal.ClientMessage
+	ServerMessage = internal.ServerMessage
+)
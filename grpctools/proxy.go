@@ -0,0 +1,114 @@
+package grpctools
+
+import (
+	"io"
+	"net"
+
+	"github.com/bradleyjkemp/grpc-tools/grpc-dump/dump"
+	"github.com/bradleyjkemp/grpc-tools/grpc-fixture/fixture"
+	"github.com/bradleyjkemp/grpc-tools/grpc-proxy"
+	"github.com/bradleyjkemp/grpc-tools/internal/proto_decoder"
+	"github.com/sirupsen/logrus"
+)
+
+type proxyServer interface {
+	Listen() error
+	Serve() error
+	Addr() net.Addr
+	Addrs() []net.Addr
+	Stop() error
+}
+
+// Proxy is an in-process grpc-dump or grpc-fixture proxy.
+type Proxy struct {
+	server proxyServer
+	done   chan error
+}
+
+func newProxy(proxyConfig ...grpc_proxy.Configurator) (*Proxy, error) {
+	server, err := grpc_proxy.New(proxyConfig...)
+	if err != nil {
+		return nil, err
+	}
+	return &Proxy{
+		server: server,
+		done:   make(chan error, 1),
+	}, nil
+}
+
+// NewRecorder creates a proxy that forwards all RPCs to their destination
+// and calls onRPC with the details of each RPC once it completes.
+// If decoder is nil then messages are decoded heuristically.
+func NewRecorder(decoder MessageDecoder, onRPC func(rpc *RPC), proxyConfig ...grpc_proxy.Configurator) (*Proxy, error) {
+	if decoder == nil {
+		decoder = NewDecoder()
+	}
+	return newProxy(append(proxyConfig,
+		grpc_proxy.WithDecoder(decoder),
+		grpc_proxy.WithObserver(dump.NewObserver(proto_decoder.NewBinaryMetadataDecoder(logrus.New(), nil), onRPC)),
+	)...)
+}
+
+// NewFixture creates a proxy that answers requests using the responses
+// saved in a grpc-dump JSON stream instead of forwarding them.
+// If encoder is nil then only the raw saved messages are used.
+func NewFixture(dump io.Reader, encoder MessageEncoder, proxyConfig ...grpc_proxy.Configurator) (*Proxy, error) {
+	return NewFixtureWithOptions(dump, encoder, FixtureOptions{}, proxyConfig...)
+}
+
+// FixtureOptions control how a fixture responds to requests.
+type FixtureOptions = fixture.Options
+
+// NewFixtureWithOptions is like NewFixture but allows configuring how the fixture responds.
+func NewFixtureWithOptions(dump io.Reader, encoder MessageEncoder, options FixtureOptions, proxyConfig ...grpc_proxy.Configurator) (*Proxy, error) {
+	if encoder == nil {
+		encoder = NewEncoder()
+	}
+	interceptor, err := fixture.Interceptor(dump, encoder, options)
+	if err != nil {
+		return nil, err
+	}
+	return newProxy(append(proxyConfig, grpc_proxy.WithInterceptor(interceptor))...)
+}
+
+// Start begins listening and serving in the background.
+// Once Start returns, Addr returns the address the proxy is listening on.
+func (p *Proxy) Start() error {
+	if err := p.server.Listen(); err != nil {
+		return err
+	}
+	go func() {
+		p.done <- p.server.Serve()
+	}()
+	return nil
+}
+
+// Addr returns the address the proxy is listening on.
+func (p *Proxy) Addr() string {
+	addr := p.server.Addr()
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+// Addrs returns the addresses of all of the proxy's listeners
+// (see grpc_proxy.WithListener).
+func (p *Proxy) Addrs() []string {
+	var addrs []string
+	for _, addr := range p.server.Addrs() {
+		addrs = append(addrs, addr.String())
+	}
+	return addrs
+}
+
+// Stop shuts down the proxy and closes all active connections.
+func (p *Proxy) Stop() error {
+	return p.server.Stop()
+}
+
+// Wait blocks until the proxy stops serving, returning any error
+// that caused it to stop.
+func (p *Proxy) Wait() error {
+	return <-p.done
+}
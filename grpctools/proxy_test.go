@@ -0,0 +1,463 @@
+package grpctools
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bradleyjkemp/grpc-tools/grpc-proxy"
+	"github.com/bradleyjkemp/grpc-tools/internal/codec"
+	"github.com/bradleyjkemp/grpc-tools/internal/proxydialer"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/proxy"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const testDump = `{"service":"test.Service","method":"Method","messages":[{"message_origin":"client","raw_message":"CgNmb28="},{"message_origin":"server","raw_message":"CgNiYXI="}],"metadata":{}}`
+
+// startFixture starts a fixture serving testDump (which the caller must stop)
+func startFixture(t *testing.T, options ...grpc_proxy.Configurator) *Proxy {
+	return startFixtureWithOptions(t, FixtureOptions{}, options...)
+}
+
+func startFixtureWithOptions(t *testing.T, fixtureOptions FixtureOptions, options ...grpc_proxy.Configurator) *Proxy {
+	fixture, err := NewFixtureWithOptions(strings.NewReader(testDump), nil, fixtureOptions, options...)
+	require.NoError(t, err)
+	require.NoError(t, fixture.Start())
+	return fixture
+}
+
+// startRecorder starts a recorder (which the caller must stop)
+// sending each RPC it records to the returned channel
+func startRecorder(t *testing.T, options ...grpc_proxy.Configurator) (*Proxy, chan *RPC) {
+	recorded := make(chan *RPC, 10)
+	recorder, err := NewRecorder(nil, func(rpc *RPC) {
+		recorded <- rpc
+	}, options...)
+	require.NoError(t, err)
+	require.NoError(t, recorder.Start())
+	return recorder, recorded
+}
+
+// dialFixture is a recorder option forwarding every connection to the fixture
+func dialFixture(fixture *Proxy) grpc_proxy.Configurator {
+	return grpc_proxy.WithDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "tcp", fixture.Addr())
+	})
+}
+
+// invokeTestMethod dials the target and calls the method saved in testDump
+// returning an error unless the saved response is received
+func invokeTestMethod(target string, options ...grpc.DialOption) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, target, append(options, grpc.WithBlock(),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(codec.NoopCodec{})))...)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var resp []byte
+	if err := conn.Invoke(ctx, "/test.Service/Method", []byte("\n\x03foo"), &resp); err != nil {
+		return err
+	}
+	if string(resp) != "\n\x03bar" {
+		return fmt.Errorf("unexpected response %q", resp)
+	}
+	return nil
+}
+
+// starts a recorder forwarding to a fixture serving testDump
+// and returns a connection to the recorder
+func startRecorderAndFixture(t *testing.T, options FixtureOptions) (*grpc.ClientConn, *Proxy, chan *RPC, func()) {
+	fixture := startFixtureWithOptions(t, options, grpc_proxy.Port(0))
+	recorder, recorded := startRecorder(t, grpc_proxy.Port(0), dialFixture(fixture))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, recorder.Addr(), grpc.WithInsecure(), grpc.WithBlock(),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(codec.NoopCodec{})))
+	require.NoError(t, err)
+	return conn, recorder, recorded, func() {
+		conn.Close()
+		recorder.Stop()
+		fixture.Stop()
+	}
+}
+
+func waitForRPC(t *testing.T, recorded chan *RPC) *RPC {
+	select {
+	case rpc := <-recorded:
+		return rpc
+	case <-time.After(5 * time.Second):
+		t.Fatal("RPC was not recorded")
+		return nil
+	}
+}
+
+func TestRecorderAndFixture(t *testing.T) {
+	t.Run("uncompressed", func(t *testing.T) {
+		testRecorderAndFixture(t, "")
+	})
+	t.Run("zstd", func(t *testing.T) {
+		testRecorderAndFixture(t, "zstd")
+	})
+}
+
+func testRecorderAndFixture(t *testing.T, compressor string) {
+	conn, recorder, recorded, stop := startRecorderAndFixture(t, FixtureOptions{})
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var callOptions []grpc.CallOption
+	if compressor != "" {
+		callOptions = append(callOptions, grpc.UseCompressor(compressor))
+	}
+	var resp []byte
+	err := conn.Invoke(ctx, "/test.Service/Method", []byte("\n\x03foo"), &resp, callOptions...)
+	require.NoError(t, err)
+	require.Equal(t, "\n\x03bar", string(resp))
+
+	rpc := waitForRPC(t, recorded)
+	require.Equal(t, "/test.Service/Method", rpc.StreamName())
+	require.Len(t, rpc.Messages, 2)
+	require.Equal(t, ClientMessage, rpc.Messages[0].MessageOrigin)
+	require.Equal(t, "\n\x03bar", string(rpc.Messages[1].RawMessage))
+	require.Equal(t, compressor, rpc.RequestEncoding)
+	require.Equal(t, compressor, rpc.ResponseEncoding)
+	for _, message := range rpc.Messages {
+		require.Equal(t, compressor != "", message.Compressed)
+		require.NotZero(t, message.WireSize)
+	}
+	require.NotNil(t, rpc.Timing)
+	require.NotNil(t, rpc.Timing.UpstreamConnected)
+	require.NotNil(t, rpc.Timing.FirstResponse)
+	require.NotEmpty(t, rpc.Timing.UpstreamLatency)
+	require.NotEmpty(t, rpc.Timing.Total)
+
+	require.NoError(t, recorder.Stop())
+	require.NoError(t, recorder.Wait())
+}
+
+func TestFixtureDeadline(t *testing.T) {
+	conn, _, recorded, stop := startRecorderAndFixture(t, FixtureOptions{
+		ResponseDelay: time.Minute,
+	})
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	var resp []byte
+	err := conn.Invoke(ctx, "/test.Service/Method", []byte("\n\x03foo"), &resp)
+	require.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+	rpc := waitForRPC(t, recorded)
+	require.NotNil(t, rpc.Deadline)
+	timeout, ok, err := rpc.TimeoutDuration()
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.True(t, timeout > 0 && timeout <= 200*time.Millisecond, "unexpected timeout %s", timeout)
+	require.Equal(t, "DeadlineExceeded", rpc.Status.Code)
+}
+
+const errorDump = `{"service":"test.Service","method":"Method","messages":[{"message_origin":"client","raw_message":"CgNmb28="}],` +
+	`"error":{"code":"ResourceExhausted","message":"slow down","details":[{"type_url":"type.googleapis.com/google.rpc.RetryInfo","raw_value":"CgIIAQ=="}]},` +
+	`"metadata":{},"metadata_response_headers":{"x-ratelimit-remaining":["0"],"trailer":["Grpc-Status"]},"metadata_response_trailers":{"x-request-id":["abc"]}}`
+
+func TestFixtureHeadersTrailersAndErrors(t *testing.T) {
+	fixture, err := NewFixture(strings.NewReader(errorDump), nil, grpc_proxy.Port(0))
+	require.NoError(t, err)
+	require.NoError(t, fixture.Start())
+	defer fixture.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, fixture.Addr(), grpc.WithInsecure(), grpc.WithBlock(),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(codec.NoopCodec{})))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	var resp []byte
+	var headers, trailers metadata.MD
+	err = conn.Invoke(ctx, "/test.Service/Method", []byte("\n\x03foo"), &resp, grpc.Header(&headers), grpc.Trailer(&trailers))
+	s := status.Convert(err)
+	require.Equal(t, codes.ResourceExhausted, s.Code())
+	require.Equal(t, "slow down", s.Message())
+	require.Len(t, s.Details(), 1)
+	require.Equal(t, []string{"0"}, headers.Get("x-ratelimit-remaining"))
+	require.Equal(t, []string{"abc"}, trailers.Get("x-request-id"))
+}
+
+func TestUnixSockets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grpctools")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// the fixture listens on an abstract socket where supported
+	fixtureSocket, fixtureTarget := filepath.Join(dir, "fixture.sock"), "unix://"+filepath.Join(dir, "fixture.sock")
+	if runtime.GOOS == "linux" {
+		fixtureSocket = fmt.Sprintf("@grpctools-test-%d", os.Getpid())
+		fixtureTarget = "unix-abstract:" + strings.TrimPrefix(fixtureSocket, "@")
+	}
+	fixture := startFixture(t, grpc_proxy.UnixSocket(fixtureSocket), grpc_proxy.DirectServer())
+	defer fixture.Stop()
+
+	recorderSocket := filepath.Join(dir, "recorder.sock")
+	recorder, recorded := startRecorder(t, grpc_proxy.UnixSocket(recorderSocket), grpc_proxy.Destination(fixtureTarget))
+	defer recorder.Stop()
+
+	require.NoError(t, invokeTestMethod("unix://"+recorderSocket, grpc.WithInsecure(),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", recorderSocket)
+		})))
+	require.Equal(t, "/test.Service/Method", waitForRPC(t, recorded).StreamName())
+}
+
+func TestMultipleListeners(t *testing.T) {
+	fixture := startFixture(t, grpc_proxy.Port(0), grpc_proxy.DirectServer())
+	defer fixture.Stop()
+
+	recorder, recorded := startRecorder(t,
+		grpc_proxy.WithListener(grpc_proxy.ListenerConfig{Address: "localhost:0"}),
+		grpc_proxy.WithListener(grpc_proxy.ListenerConfig{Address: "localhost:0", Mode: grpc_proxy.DestinationMode, Destination: fixture.Addr()}),
+	)
+	defer recorder.Stop()
+	addrs := recorder.Addrs()
+	require.Len(t, addrs, 2)
+	require.Equal(t, addrs[0], recorder.Addr())
+
+	// the proxy mode listener forwards to the requested authority
+	require.NoError(t, invokeTestMethod(addrs[0], grpc.WithInsecure(), grpc.WithAuthority(fixture.Addr())))
+	require.Equal(t, "/test.Service/Method", waitForRPC(t, recorded).StreamName())
+
+	// the destination mode listener forwards everything to the fixture
+	require.NoError(t, invokeTestMethod(addrs[1], grpc.WithInsecure()))
+	require.Equal(t, "/test.Service/Method", waitForRPC(t, recorded).StreamName())
+}
+
+func TestSOCKSClients(t *testing.T) {
+	fixture := startFixture(t, grpc_proxy.Port(0), grpc_proxy.DirectServer())
+	defer fixture.Stop()
+	recorder, recorded := startRecorder(t, grpc_proxy.Port(0))
+	defer recorder.Stop()
+
+	socks5, err := proxy.SOCKS5("tcp", recorder.Addr(), nil, proxy.Direct)
+	require.NoError(t, err)
+	dialers := map[string]func(ctx context.Context, address string) (net.Conn, error){
+		"socks5": func(ctx context.Context, address string) (net.Conn, error) {
+			return socks5.Dial("tcp", address)
+		},
+		"socks4a": func(ctx context.Context, address string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", recorder.Addr())
+			if err != nil {
+				return nil, err
+			}
+			host, port, _ := net.SplitHostPort(address)
+			portNumber, _ := strconv.Atoi(port)
+			request := append([]byte{0x04, 0x01, byte(portNumber >> 8), byte(portNumber), 0, 0, 0, 1, 0}, append([]byte(host), 0)...)
+			if _, err := conn.Write(request); err != nil {
+				return nil, err
+			}
+			reply := make([]byte, 8)
+			if _, err := io.ReadFull(conn, reply); err != nil {
+				return nil, err
+			}
+			if reply[1] != 0x5a {
+				return nil, fmt.Errorf("SOCKS4a request rejected: %v", reply)
+			}
+			return conn, nil
+		},
+	}
+	for name, dialer := range dialers {
+		require.NoError(t, invokeTestMethod(fixture.Addr(), grpc.WithInsecure(), grpc.WithContextDialer(dialer)), name)
+		require.Equal(t, "/test.Service/Method", waitForRPC(t, recorded).StreamName(), name)
+	}
+}
+
+func TestUpstreamProxyChaining(t *testing.T) {
+	fixture := startFixture(t, grpc_proxy.Port(0), grpc_proxy.DirectServer())
+	defer fixture.Stop()
+
+	// the upstream recorder is used as a SOCKS5 proxy by the first
+	upstream, upstreamRecorded := startRecorder(t, grpc_proxy.Port(0))
+	defer upstream.Stop()
+	recorder, recorded := startRecorder(t, grpc_proxy.Port(0),
+		grpc_proxy.UpstreamProxy("http://unused-proxy.invalid:3128", ""),
+		grpc_proxy.UpstreamProxyRule("127.0.0.0/8", "socks5://"+upstream.Addr()),
+	)
+	defer recorder.Stop()
+
+	require.NoError(t, invokeTestMethod(recorder.Addr(), grpc.WithInsecure(), grpc.WithAuthority(fixture.Addr())))
+	require.Equal(t, "/test.Service/Method", waitForRPC(t, recorded).StreamName())
+	require.Equal(t, "/test.Service/Method", waitForRPC(t, upstreamRecorded).StreamName())
+}
+
+func TestProxyAuthentication(t *testing.T) {
+	fixture := startFixture(t, grpc_proxy.Port(0), grpc_proxy.DirectServer())
+	defer fixture.Stop()
+	recorder, recorded := startRecorder(t, grpc_proxy.Port(0), grpc_proxy.ProxyAuth("alice", "secret"))
+	defer recorder.Stop()
+
+	// HTTP CONNECT
+	require.NoError(t, invokeTestMethod(fixture.Addr(), grpc.WithInsecure(),
+		grpc.WithContextDialer(proxydialer.NewProxyDialer(func(*url.URL) (*url.URL, error) {
+			return &url.URL{Scheme: "http", User: url.UserPassword("alice", "secret"), Host: recorder.Addr()}, nil
+		}))))
+	require.Equal(t, "alice", waitForRPC(t, recorded).ProxyUser)
+
+	// SOCKS5
+	socks5, err := proxy.SOCKS5("tcp", recorder.Addr(), &proxy.Auth{User: "alice", Password: "secret"}, proxy.Direct)
+	require.NoError(t, err)
+	require.NoError(t, invokeTestMethod(fixture.Addr(), grpc.WithInsecure(),
+		grpc.WithContextDialer(func(ctx context.Context, address string) (net.Conn, error) {
+			return socks5.Dial("tcp", address)
+		})))
+	require.Equal(t, "alice", waitForRPC(t, recorded).ProxyUser)
+}
+
+func TestTLSHandshakeCapture(t *testing.T) {
+	recorder, recorded := startRecorder(t, grpc_proxy.Port(0), grpc_proxy.Destination("localhost:1"),
+		grpc_proxy.WithInterceptor(func(interface{}, grpc.ServerStream, *grpc.StreamServerInfo, grpc.StreamHandler) error {
+			// answer without forwarding as there is no TLS server to forward to
+			return status.Error(codes.Unimplemented, "not forwarded")
+		}))
+	defer recorder.Stop()
+
+	creds := credentials.NewTLS(&tls.Config{ServerName: "api.example.com", InsecureSkipVerify: true})
+	err := invokeTestMethod(recorder.Addr(), grpc.WithTransportCredentials(creds))
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+
+	handshake := waitForRPC(t, recorded).TLS
+	require.NotNil(t, handshake)
+	require.Equal(t, "api.example.com", handshake.ServerName)
+	require.Equal(t, "h2", handshake.NegotiatedProtocol)
+	require.Len(t, handshake.JA3, 32)
+}
+
+func TestConnectionEvents(t *testing.T) {
+	fixture := startFixture(t, grpc_proxy.Port(0))
+	defer fixture.Stop()
+	events := make(chan *ConnectionEvent, 100)
+	recorder, recorded := startRecorder(t, grpc_proxy.Port(0), dialFixture(fixture),
+		grpc_proxy.WithConnectionObserver(grpc_proxy.ConnectionObserverFunc(func(event *ConnectionEvent) {
+			events <- event
+		})))
+	defer recorder.Stop()
+
+	require.NoError(t, invokeTestMethod(recorder.Addr(), grpc.WithInsecure()))
+	rpc := waitForRPC(t, recorded)
+
+	nextEvent := func() *ConnectionEvent {
+		select {
+		case event := <-events:
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatal("connection event was not logged")
+			return nil
+		}
+	}
+	accepted := nextEvent()
+	require.Equal(t, "accept", string(accepted.Event))
+	require.NotZero(t, accepted.ConnectionID)
+	require.Equal(t, accepted.ConnectionID, rpc.ConnectionID)
+
+	seen := map[string]bool{}
+	for {
+		event := nextEvent()
+		require.Equal(t, accepted.ConnectionID, event.ConnectionID)
+		if event.Event == "settings" {
+			seen[event.Sender] = true
+		}
+		if event.Event == "close" {
+			require.NotZero(t, event.BytesReceived)
+			require.NotZero(t, event.BytesSent)
+			break
+		}
+	}
+	require.True(t, seen["client"], "client SETTINGS should be logged")
+	require.True(t, seen["server"], "server SETTINGS should be logged")
+}
+
+// lockedBuffer is a bytes.Buffer that can be written to while being read
+type lockedBuffer struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) Bytes() []byte {
+	b.Lock()
+	defer b.Unlock()
+	return append([]byte{}, b.buf.Bytes()...)
+}
+
+func TestFrameCapture(t *testing.T) {
+	fixture := startFixture(t, grpc_proxy.Port(0))
+	defer fixture.Stop()
+	frameLog, pcap := &lockedBuffer{}, &lockedBuffer{}
+	recorder, recorded := startRecorder(t, grpc_proxy.Port(0), dialFixture(fixture), grpc_proxy.WithFrameCapture(frameLog, pcap))
+	defer recorder.Stop()
+
+	require.NoError(t, invokeTestMethod(recorder.Addr(), grpc.WithInsecure()))
+	rpc := waitForRPC(t, recorded)
+
+	// the request headers and response data on each leg
+	seen := map[string]bool{}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(seen) < 4 && time.Now().Before(deadline) {
+		decoder := json.NewDecoder(bytes.NewReader(frameLog.Bytes()))
+		for decoder.More() {
+			frame := &Frame{}
+			require.NoError(t, decoder.Decode(frame))
+			require.Empty(t, frame.Error)
+			if frame.Leg == "downstream" {
+				require.Equal(t, rpc.ConnectionID, frame.ConnectionID)
+			}
+			switch {
+			case frame.Type == "HEADERS" && frame.Sender == "client":
+				for _, header := range frame.Headers {
+					if header.Name == ":path" && header.Value == "/test.Service/Method" {
+						seen[frame.Leg+" request"] = true
+					}
+				}
+			case frame.Type == "DATA" && frame.Sender == "server" && strings.HasSuffix(string(frame.Data), "\n\x03bar"):
+				seen[frame.Leg+" response"] = true
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, map[string]bool{
+		"downstream request":  true,
+		"downstream response": true,
+		"upstream request":    true,
+		"upstream response":   true,
+	}, seen)
+
+	// the section header block then the interface
+	require.True(t, bytes.HasPrefix(pcap.Bytes(), []byte{0x0a, 0x0d, 0x0d, 0x0a}))
+	require.True(t, bytes.Contains(pcap.Bytes(), []byte("\n\x03foo")), "the request message should be captured")
+}
@@ -19,6 +19,7 @@ import (
 
 const (
 	protoRoots       = "."
+	protoImportPaths = ""
 	protoDescriptors = ""
 	certFile         = "_wildcard.github.io.pem"
 	keyFile          = "_wildcard.github.io-key.pem"
@@ -29,6 +30,7 @@ const (
 
 var (
 	timestampRegex = regexp.MustCompile(`"timestamp":"[0-9TZ:.+\-]+"`)
+	timingRegex    = regexp.MustCompile(`"timing":{[^}]*}`)
 	snapshotter    = cupaloy.NewDefaultConfig().WithOptions(cupaloy.SnapshotFileExtension(".json"))
 )
 
@@ -46,9 +48,12 @@ func TestIntegration(t *testing.T) {
 
 	go func() {
 		fixtureErr := fixture.Run(
-			protoRoots,
-			protoDescriptors,
-			"test-fixture.json",
+			fixture.Config{
+				ProtoRoots:       protoRoots,
+				ProtoImportPaths: protoImportPaths,
+				ProtoDescriptors: protoDescriptors,
+				DumpPath:         "test-fixture.json",
+			},
 			grpc_proxy.Port(fixturePort),
 			grpc_proxy.UsingTLS(certFile, keyFile),
 		)
@@ -61,8 +66,11 @@ func TestIntegration(t *testing.T) {
 	go func() {
 		dumpErr := dump.Run(
 			dumpLog,
-			protoRoots,
-			protoDescriptors,
+			dump.Config{
+				ProtoRoots:       protoRoots,
+				ProtoImportPaths: protoImportPaths,
+				ProtoDescriptors: protoDescriptors,
+			},
 			grpc_proxy.Port(dumpPort),
 			grpc_proxy.UsingTLS(certFile, keyFile),
 			grpc_proxy.WithDialer(proxydialer.NewProxyDialer(func(req *url.URL) (*url.URL, error) {
@@ -77,10 +85,13 @@ func TestIntegration(t *testing.T) {
 	}()
 
 	replayErr := replay.Run(
-		protoRoots,
-		protoDescriptors,
-		"test-dump.json",
-		"",
+		replay.Config{
+			ProtoRoots:       protoRoots,
+			ProtoImportPaths: protoImportPaths,
+			ProtoDescriptors: protoDescriptors,
+			DumpPath:         "test-dump.json",
+			TimeoutScale:     1,
+		},
 		proxydialer.NewProxyDialer(func(req *url.URL) (*url.URL, error) {
 			return &url.URL{
 				Host: fmt.Sprintf("localhost:%d", dumpPort),
@@ -104,6 +115,7 @@ func TestIntegration(t *testing.T) {
 		t.Fail()
 	}
 	dumpLogSanitised := timestampRegex.ReplaceAll(dumpLog.Bytes(), []byte("\"timestamp\":\"2019-06-24T19:19:46.644943+01:00\""))
+	dumpLogSanitised = timingRegex.ReplaceAll(dumpLogSanitised, []byte("\"timing\":{}"))
 
 	snapshotter.SnapshotT(t, dumpLogSanitised)
 }
@@ -0,0 +1,62 @@
+package internal
+
+import (
+	"encoding/base64"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// IsBinaryMetadataKey reports whether the values for key are binary
+// (and so are base64 encoded on the wire).
+func IsBinaryMetadataKey(key string) bool {
+	return strings.HasSuffix(key, "-bin")
+}
+
+// EncodeBinaryMetadata returns a copy of md with all binary values base64 encoded.
+// gRPC decodes these values on receipt but they aren't valid UTF-8 so would be
+// mangled when written to a dump.
+func EncodeBinaryMetadata(md metadata.MD) metadata.MD {
+	if md == nil {
+		return nil
+	}
+	encoded := md.Copy()
+	for key, values := range encoded {
+		if !IsBinaryMetadataKey(key) {
+			continue
+		}
+		for i, value := range values {
+			values[i] = base64.StdEncoding.EncodeToString([]byte(value))
+		}
+	}
+	return encoded
+}
+
+// DecodeBinaryMetadata reverses EncodeBinaryMetadata so the metadata
+// can be sent again. Values that aren't valid base64 are left as is.
+func DecodeBinaryMetadata(md metadata.MD) metadata.MD {
+	if md == nil {
+		return nil
+	}
+	decoded := md.Copy()
+	for key, values := range decoded {
+		if !IsBinaryMetadataKey(key) {
+			continue
+		}
+		for i, value := range values {
+			if raw, err := DecodeBinaryMetadataValue(value); err == nil {
+				values[i] = string(raw)
+			}
+		}
+	}
+	return decoded
+}
+
+// DecodeBinaryMetadataValue decodes a base64 value with or without padding
+// (gRPC itself sends values without padding).
+func DecodeBinaryMetadataValue(value string) ([]byte, error) {
+	if len(value)%4 == 0 {
+		return base64.StdEncoding.DecodeString(value)
+	}
+	return base64.RawStdEncoding.DecodeString(value)
+}
@@ -0,0 +1,101 @@
+// Package compression registers the gRPC compressors supported by grpc-tools
+// in addition to gzip (which is registered by grpc-go itself).
+// Importing this package for its side effects lets both sides of the proxy
+// (and grpc-replay) handle messages using these encodings.
+package compression
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/grpc/encoding"
+	_ "google.golang.org/grpc/encoding/gzip"
+)
+
+func init() {
+	encoding.RegisterCompressor(deflateCompressor{})
+	encoding.RegisterCompressor(snappyCompressor{})
+	encoding.RegisterCompressor(newZstdCompressor())
+}
+
+// deflate is the zlib format (as for the HTTP deflate content-coding)
+type deflateCompressor struct{}
+
+func (deflateCompressor) Name() string {
+	return "deflate"
+}
+
+func (deflateCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	return zlib.NewWriter(w), nil
+}
+
+func (deflateCompressor) Decompress(r io.Reader) (io.Reader, error) {
+	return zlib.NewReader(r)
+}
+
+// snappy uses the framing format as the block format can't be streamed
+type snappyCompressor struct{}
+
+func (snappyCompressor) Name() string {
+	return "snappy"
+}
+
+func (snappyCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	return snappy.NewBufferedWriter(w), nil
+}
+
+func (snappyCompressor) Decompress(r io.Reader) (io.Reader, error) {
+	return snappy.NewReader(r), nil
+}
+
+// zstd encodes whole messages at once using a shared encoder/decoder
+// (streaming ones each start goroutines that would need to be cleaned up)
+type zstdCompressor struct {
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+}
+
+func newZstdCompressor() *zstdCompressor {
+	// neither of these can fail without any options
+	encoder, _ := zstd.NewWriter(nil)
+	decoder, _ := zstd.NewReader(nil)
+	return &zstdCompressor{
+		encoder: encoder,
+		decoder: decoder,
+	}
+}
+
+func (*zstdCompressor) Name() string {
+	return "zstd"
+}
+
+func (z *zstdCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	return &zstdWriter{encoder: z.encoder, w: w}, nil
+}
+
+func (z *zstdCompressor) Decompress(r io.Reader) (io.Reader, error) {
+	compressed, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	decompressed, err := z.decoder.DecodeAll(compressed, nil)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(decompressed), nil
+}
+
+type zstdWriter struct {
+	bytes.Buffer
+	encoder *zstd.Encoder
+	w       io.Writer
+}
+
+func (z *zstdWriter) Close() error {
+	_, err := z.w.Write(z.encoder.EncodeAll(z.Bytes(), nil))
+	return err
+}
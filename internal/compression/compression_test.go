@@ -0,0 +1,34 @@
+package compression
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/encoding"
+)
+
+func TestCompressorsRoundTrip(t *testing.T) {
+	message := bytes.Repeat([]byte("grpc-tools"), 100)
+	for _, name := range []string{"gzip", "deflate", "snappy", "zstd"} {
+		t.Run(name, func(t *testing.T) {
+			compressor := encoding.GetCompressor(name)
+			require.NotNil(t, compressor)
+
+			compressed := &bytes.Buffer{}
+			w, err := compressor.Compress(compressed)
+			require.NoError(t, err)
+			_, err = w.Write(message)
+			require.NoError(t, err)
+			require.NoError(t, w.Close())
+			require.True(t, compressed.Len() < len(message))
+
+			r, err := compressor.Decompress(compressed)
+			require.NoError(t, err)
+			decompressed, err := ioutil.ReadAll(r)
+			require.NoError(t, err)
+			require.Equal(t, message, decompressed)
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+type ConnectionEventType string
+
+const (
+	ConnectionAccepted    ConnectionEventType = "accept"               // a client connected to a listener
+	ConnectionConnect     ConnectionEventType = "connect"              // the client opened a tunnel (HTTP CONNECT or SOCKS)
+	ConnectionIntercepted ConnectionEventType = "tls_intercepted"      // the TLS connection was intercepted
+	ConnectionTunnelled   ConnectionEventType = "tls_tunnelled"        // the TLS connection was forwarded untouched
+	ConnectionBounced     ConnectionEventType = "bounced"              // the connection wasn't HTTP so was forwarded untouched
+	ConnectionTLSFailed   ConnectionEventType = "tls_handshake_failed" // the client failed the TLS handshake
+	ConnectionSettings    ConnectionEventType = "settings"             // an HTTP/2 SETTINGS frame
+	ConnectionGoAway      ConnectionEventType = "goaway"               // an HTTP/2 GOAWAY frame
+	ConnectionRSTStream   ConnectionEventType = "rst_stream"           // an HTTP/2 RST_STREAM frame
+	ConnectionClosed      ConnectionEventType = "close"                // the connection was closed
+)
+
+// the Sender of HTTP/2 frames
+const (
+	SentByClient = "client"
+	SentByServer = "server" // i.e. the proxy
+)
+
+// ConnectionEvent is something that happened on a client connection to the proxy.
+// RPCs record the ConnectionID of the connection they were received on.
+type ConnectionEvent struct {
+	ConnectionID uint64              `json:"connection_id"`
+	Timestamp    time.Time           `json:"timestamp"`
+	Event        ConnectionEventType `json:"event"`
+
+	Listener    string `json:"listener,omitempty"`    // accept: the listener's address
+	RemoteAddr  string `json:"remote_addr,omitempty"` // accept: the client's address
+	Destination string `json:"destination,omitempty"` // the destination of a tunnel or a forwarded connection
+	Protocol    string `json:"protocol,omitempty"`    // connect: the tunnel protocol (http or socks)
+	Reason      string `json:"reason,omitempty"`      // tls_tunnelled: why the connection wasn't intercepted
+	Error       string `json:"error,omitempty"`       // tls_handshake_failed: the handshake error
+
+	// HTTP/2 frames
+	Sender       string            `json:"sender,omitempty"`    // client or server
+	StreamID     uint32            `json:"stream_id,omitempty"` // rst_stream: the reset stream
+	Settings     map[string]uint32 `json:"settings,omitempty"`
+	LastStreamID *uint32           `json:"last_stream_id,omitempty"` // goaway: the last stream that may have been processed
+	ErrorCode    string            `json:"error_code,omitempty"`     // goaway and rst_stream
+	DebugData    string            `json:"debug_data,omitempty"`     // goaway
+
+	// close: the bytes transferred over the connection (including TLS and tunnelled traffic)
+	BytesReceived int64 `json:"bytes_received,omitempty"`
+	BytesSent     int64 `json:"bytes_sent,omitempty"`
+}
+
+// ConnectionEventWriter writes connection events as a newline separated stream
+// of JSON objects. It is safe for concurrent use.
+type ConnectionEventWriter struct {
+	sync.Mutex
+	output io.Writer
+}
+
+func NewConnectionEventWriter(output io.Writer) *ConnectionEventWriter {
+	return &ConnectionEventWriter{
+		output: output,
+	}
+}
+
+func (w *ConnectionEventWriter) Write(event *ConnectionEvent) error {
+	encoded, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal connection event: %v", err)
+	}
+	w.Lock()
+	defer w.Unlock()
+	_, err = fmt.Fprintln(w.output, string(encoded))
+	return err
+}
@@ -0,0 +1,401 @@
+package connlog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bradleyjkemp/grpc-tools/internal"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// the largest frame size allowed by HTTP/2 (so no frame is too large to be captured)
+const maxFrameSize = 1<<24 - 1
+
+// Capture records the HTTP/2 frames sent over the proxy's connections (both from
+// clients and to upstream servers) as JSON and the raw bytes as a pcapng.
+type Capture struct {
+	logger        logrus.FieldLogger
+	frames        *internal.FrameWriter // nil unless logging frames
+	framesStopped int32                 // set once a write fails or the capture is closed
+
+	pcapLock    sync.Mutex                 // guards the pcapng and the TCP streams written to it
+	pcap        *pcapngWriter              // nil unless writing a pcapng
+	pcapStopped bool                       // set once a write fails or the capture is closed
+	open        map[*capturedConn]struct{} // the connections not yet closed in the pcapng
+}
+
+// NewCapture writes frames as newline separated JSON to frameLog and the captured
+// connections as a pcapng to pcap. Either may be nil.
+func NewCapture(logger logrus.FieldLogger, frameLog, pcap io.Writer) (*Capture, error) {
+	c := &Capture{logger: logger, open: map[*capturedConn]struct{}{}}
+	if frameLog != nil {
+		c.frames = internal.NewFrameWriter(frameLog)
+	}
+	if pcap != nil {
+		var err error
+		c.pcap, err = newPcapngWriter(pcap)
+		if err != nil {
+			return nil, fmt.Errorf("failed to write pcapng: %v", err)
+		}
+	}
+	return c, nil
+}
+
+// KeyLogWriter is used as a tls.Config.KeyLogWriter so that the TLS connections
+// in the pcapng can be decrypted (nil if not writing a pcapng).
+func (c *Capture) KeyLogWriter() io.Writer {
+	if c == nil || c.pcap == nil {
+		return nil
+	}
+	return keyLogWriter{c}
+}
+
+type keyLogWriter struct {
+	capture *Capture
+}
+
+func (w keyLogWriter) Write(keyLog []byte) (int, error) {
+	w.capture.writePcap(func(pcap *pcapngWriter) error {
+		return pcap.secrets(keyLog)
+	})
+	return len(keyLog), nil
+}
+
+// writePcap writes to the pcapng (if there is one) until a write fails
+func (c *Capture) writePcap(write func(pcap *pcapngWriter) error) {
+	c.pcapLock.Lock()
+	defer c.pcapLock.Unlock()
+	if c.pcap == nil || c.pcapStopped {
+		return
+	}
+	if err := write(c.pcap); err != nil {
+		c.pcapStopped = true
+		c.logger.WithError(err).Warn("Failed to write pcapng, no more packets will be captured")
+	}
+}
+
+func (c *Capture) writeFrame(frame *internal.Frame) {
+	if atomic.LoadInt32(&c.framesStopped) == 1 {
+		return
+	}
+	if err := c.frames.Write(frame); err != nil && atomic.CompareAndSwapInt32(&c.framesStopped, 0, 1) {
+		c.logger.WithError(err).Warn("Failed to write frame log, no more frames will be captured")
+	}
+}
+
+// connection starts capturing a connection (a nil Capture captures nothing)
+func (c *Capture) connection(id uint64, leg string, client, server net.Addr) *capturedConn {
+	if c == nil {
+		return nil
+	}
+	captured := &capturedConn{
+		capture: c,
+		id:      id,
+		leg:     leg,
+		tcp:     newTCPStream(id, client, server),
+		client:  newFrameDecoder(),
+		server:  newFrameDecoder(),
+	}
+	c.writePcap(func(pcap *pcapngWriter) error {
+		c.open[captured] = struct{}{}
+		return writePackets(pcap, captured.tcp.handshake())
+	})
+	return captured
+}
+
+// Close stops capturing, first closing the connections still open in the pcapng
+// (so that it doesn't end part way through them). It doesn't close the writers.
+func (c *Capture) Close() {
+	if c == nil {
+		return
+	}
+	atomic.StoreInt32(&c.framesStopped, 1)
+	c.writePcap(func(pcap *pcapngWriter) error {
+		for conn := range c.open {
+			delete(c.open, conn)
+			if err := writePackets(pcap, conn.tcp.close()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	c.pcapLock.Lock()
+	defer c.pcapLock.Unlock()
+	c.pcapStopped = true
+}
+
+func writePackets(pcap *pcapngWriter, packets [][]byte) error {
+	now := time.Now()
+	for _, packet := range packets {
+		if err := pcap.packet(now, packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// capturedConn is a connection being captured. Its methods can be called on a nil
+// capturedConn (which captures nothing).
+type capturedConn struct {
+	capture *Capture
+	id      uint64
+	leg     string
+	tcp     *tcpStream // guarded by capture.pcapLock
+
+	// guards the decoders (each is changed by the SETTINGS sent by the other)
+	framesLock     sync.Mutex
+	client, server *frameDecoder
+}
+
+// raw captures the bytes sent by one side of the connection
+func (c *capturedConn) raw(sender string, b []byte) {
+	if c == nil || len(b) == 0 {
+		return
+	}
+	c.capture.writePcap(func(pcap *pcapngWriter) error {
+		return writePackets(pcap, c.tcp.data(sender == internal.SentByClient, b))
+	})
+}
+
+func (c *capturedConn) close() {
+	if c == nil {
+		return
+	}
+	c.capture.writePcap(func(pcap *pcapngWriter) error {
+		delete(c.capture.open, c)
+		return writePackets(pcap, c.tcp.close())
+	})
+}
+
+// capturingFrames checks whether the HTTP/2 frames of the connection are needed
+func (c *capturedConn) capturingFrames() bool {
+	return c != nil && c.capture.frames != nil
+}
+
+// frame captures a complete HTTP/2 frame sent by one side of the connection
+func (c *capturedConn) frame(sender string, header, payload []byte) {
+	if !c.capturingFrames() {
+		return
+	}
+	c.framesLock.Lock()
+	defer c.framesLock.Unlock()
+	decoder, peer := c.client, c.server
+	if sender == internal.SentByServer {
+		decoder, peer = c.server, c.client
+	}
+	frame := decoder.decode(header, payload, peer)
+	frame.ConnectionID = c.id
+	frame.Leg = c.leg
+	frame.Sender = sender
+	frame.Timestamp = time.Now()
+	c.capture.writeFrame(frame)
+}
+
+// frameDecoder decodes the frames sent by one side of a connection
+type frameDecoder struct {
+	source *bytes.Buffer // the frame being decoded
+	framer *http2.Framer
+	hpack  *hpack.Decoder
+	// the fields decoded from the current frame
+	fields []*internal.HeaderField
+	// set once a header block couldn't be decoded as the header table is then unknown
+	hpackErr error
+	// the stream of a header block that hasn't ended yet
+	continuationStream uint32
+}
+
+func newFrameDecoder() *frameDecoder {
+	d := &frameDecoder{
+		source: &bytes.Buffer{},
+	}
+	d.framer = http2.NewFramer(ioutil.Discard, d.source)
+	d.framer.SetMaxReadFrameSize(maxFrameSize)
+	// the framer only sees a single frame at a time so frame order is checked here instead
+	d.framer.AllowIllegalReads = true
+	d.hpack = hpack.NewDecoder(initialHeaderTableSize, func(field hpack.HeaderField) {
+		d.fields = append(d.fields, &internal.HeaderField{
+			Name:      field.Name,
+			Value:     field.Value,
+			Sensitive: field.Sensitive,
+		})
+	})
+	return d
+}
+
+// the header table size used until a SETTINGS frame changes it
+const initialHeaderTableSize = 4096
+
+func (d *frameDecoder) decode(header, payload []byte, peer *frameDecoder) *internal.Frame {
+	frameType := http2.FrameType(header[3])
+	frame := &internal.Frame{
+		Type:     frameType.String(),
+		StreamID: binary.BigEndian.Uint32(header[5:9]) & (1<<31 - 1),
+		Flags:    flagNames(frameType, http2.Flags(header[4])),
+		Length:   uint32(len(payload)),
+	}
+	switch {
+	case d.continuationStream != 0 && (frameType != http2.FrameContinuation || frame.StreamID != d.continuationStream):
+		frame.Error = fmt.Sprintf("expected a CONTINUATION frame for stream %d", d.continuationStream)
+		// the rest of that header block is lost
+		if d.hpackErr == nil {
+			d.hpackErr = fmt.Errorf("the header block for stream %d wasn't finished", d.continuationStream)
+		}
+		d.continuationStream = 0
+	case d.continuationStream == 0 && frameType == http2.FrameContinuation:
+		frame.Error = "unexpected CONTINUATION frame"
+	}
+
+	d.source.Reset()
+	d.source.Write(header)
+	d.source.Write(payload)
+	parsed, err := d.framer.ReadFrame()
+	if err != nil {
+		frame.Error = err.Error()
+		if detail := d.framer.ErrorDetail(); detail != nil {
+			frame.Error = fmt.Sprintf("%v: %v", err, detail)
+		}
+		switch frameType {
+		case http2.FrameHeaders, http2.FramePushPromise, http2.FrameContinuation:
+			if d.hpackErr == nil {
+				d.hpackErr = fmt.Errorf("invalid %s frame", frameType)
+			}
+		}
+		return frame
+	}
+
+	switch parsed := parsed.(type) {
+	case *http2.DataFrame:
+		frame.Data = append([]byte{}, parsed.Data()...)
+	case *http2.HeadersFrame:
+		if parsed.HasPriority() {
+			frame.Priority = priority(parsed.Priority)
+		}
+		d.decodeHeaders(frame, parsed.HeaderBlockFragment(), parsed.HeadersEnded())
+	case *http2.PriorityFrame:
+		frame.Priority = priority(parsed.PriorityParam)
+	case *http2.RSTStreamFrame:
+		frame.ErrorCode = parsed.ErrCode.String()
+	case *http2.SettingsFrame:
+		if parsed.IsAck() {
+			break
+		}
+		frame.Settings = map[string]uint32{}
+		_ = parsed.ForeachSetting(func(setting http2.Setting) error {
+			frame.Settings[setting.ID.String()] = setting.Val
+			if setting.ID == http2.SettingHeaderTableSize {
+				// the peer's header blocks can now use a header table of this size
+				peer.hpack.SetAllowedMaxDynamicTableSize(setting.Val)
+			}
+			return nil
+		})
+	case *http2.PushPromiseFrame:
+		frame.PromisedStreamID = parsed.PromiseID
+		d.decodeHeaders(frame, parsed.HeaderBlockFragment(), parsed.HeadersEnded())
+	case *http2.PingFrame:
+		frame.PingData = hex.EncodeToString(parsed.Data[:])
+	case *http2.GoAwayFrame:
+		lastStreamID := parsed.LastStreamID
+		frame.LastStreamID = &lastStreamID
+		frame.ErrorCode = parsed.ErrCode.String()
+		frame.DebugData = string(parsed.DebugData())
+	case *http2.WindowUpdateFrame:
+		frame.WindowIncrement = parsed.Increment
+	case *http2.ContinuationFrame:
+		d.decodeHeaders(frame, parsed.HeaderBlockFragment(), parsed.HeadersEnded())
+	case *http2.UnknownFrame:
+		frame.Data = append([]byte{}, parsed.Payload()...)
+	}
+	return frame
+}
+
+// decodeHeaders decodes the fields of a header block fragment
+// (fields split between fragments are part of the frame they end in)
+func (d *frameDecoder) decodeHeaders(frame *internal.Frame, fragment []byte, ended bool) {
+	if ended {
+		d.continuationStream = 0
+	} else {
+		d.continuationStream = frame.StreamID
+	}
+	if d.hpackErr != nil {
+		if frame.Error == "" {
+			frame.Error = fmt.Sprintf("can't decode headers after an earlier error: %v", d.hpackErr)
+		}
+		return
+	}
+
+	d.fields = nil
+	_, err := d.hpack.Write(fragment)
+	if err == nil && ended {
+		err = d.hpack.Close()
+	}
+	frame.Headers = d.fields
+	if err != nil {
+		d.hpackErr = err
+		frame.Error = fmt.Sprintf("failed to decode headers: %v", err)
+	}
+}
+
+func priority(param http2.PriorityParam) *internal.FramePriority {
+	return &internal.FramePriority{
+		StreamDependency: param.StreamDep,
+		Exclusive:        param.Exclusive,
+		Weight:           uint16(param.Weight) + 1, // sent as one less than the weight
+	}
+}
+
+// the names of the flags of each frame type
+var frameFlags = map[http2.FrameType][]struct {
+	flag http2.Flags
+	name string
+}{
+	http2.FrameData: {
+		{http2.FlagDataEndStream, "END_STREAM"},
+		{http2.FlagDataPadded, "PADDED"},
+	},
+	http2.FrameHeaders: {
+		{http2.FlagHeadersEndStream, "END_STREAM"},
+		{http2.FlagHeadersEndHeaders, "END_HEADERS"},
+		{http2.FlagHeadersPadded, "PADDED"},
+		{http2.FlagHeadersPriority, "PRIORITY"},
+	},
+	http2.FrameSettings: {
+		{http2.FlagSettingsAck, "ACK"},
+	},
+	http2.FramePing: {
+		{http2.FlagPingAck, "ACK"},
+	},
+	http2.FramePushPromise: {
+		{http2.FlagPushPromiseEndHeaders, "END_HEADERS"},
+		{http2.FlagPushPromisePadded, "PADDED"},
+	},
+	http2.FrameContinuation: {
+		{http2.FlagContinuationEndHeaders, "END_HEADERS"},
+	},
+}
+
+// flagNames names the flags set on a frame (flags undefined for the frame type are in hex)
+func flagNames(frameType http2.FrameType, flags http2.Flags) []string {
+	var names []string
+	for _, known := range frameFlags[frameType] {
+		if flags.Has(known.flag) {
+			names = append(names, known.name)
+			flags &^= known.flag
+		}
+	}
+	for bit := http2.Flags(1); bit != 0; bit <<= 1 {
+		if flags.Has(bit) {
+			names = append(names, fmt.Sprintf("0x%02x", uint8(bit)))
+		}
+	}
+	return names
+}
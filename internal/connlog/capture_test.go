@@ -0,0 +1,163 @@
+package connlog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"testing"
+
+	"github.com/bradleyjkemp/grpc-tools/internal"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+func TestCaptureFrames(t *testing.T) {
+	frameLog := &bytes.Buffer{}
+	capture, err := NewCapture(logrus.New(), frameLog, nil)
+	require.NoError(t, err)
+	conn := capture.connection(7, internal.Upstream, nil, nil)
+
+	// sends the frames written by write
+	send := func(sender string, write func(framer *http2.Framer)) {
+		buf := &bytes.Buffer{}
+		write(http2.NewFramer(buf, nil))
+		for b := buf.Bytes(); len(b) > 0; {
+			length := int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+			conn.frame(sender, b[:frameHeaderLen], b[frameHeaderLen:frameHeaderLen+length])
+			b = b[frameHeaderLen+length:]
+		}
+	}
+	headers := &bytes.Buffer{}
+	encoder := hpack.NewEncoder(headers)
+	require.NoError(t, encoder.WriteField(hpack.HeaderField{Name: ":path", Value: "/test.Service/Method"}))
+	require.NoError(t, encoder.WriteField(hpack.HeaderField{Name: "authorization", Value: "secret", Sensitive: true}))
+	block := headers.Bytes()
+
+	send(internal.SentByClient, func(framer *http2.Framer) {
+		require.NoError(t, framer.WriteHeaders(http2.HeadersFrameParam{
+			StreamID:      1,
+			BlockFragment: block[:3], // the rest is in a CONTINUATION
+			Priority:      http2.PriorityParam{StreamDep: 0, Weight: 15},
+		}))
+		require.NoError(t, framer.WriteContinuation(1, true, block[3:]))
+		require.NoError(t, framer.WriteData(1, true, []byte("\x00\x00\x00\x00\x03foo")))
+		require.NoError(t, framer.WritePing(false, [8]byte{1, 2, 3, 4, 5, 6, 7, 8}))
+		require.NoError(t, framer.WriteRawFrame(http2.FrameData, 0, 0, []byte("on stream 0")))
+		require.NoError(t, framer.WriteContinuation(3, true, nil))
+		require.NoError(t, framer.WriteRawFrame(0x42, 0x80, 1, []byte("extension")))
+	})
+	send(internal.SentByServer, func(framer *http2.Framer) {
+		require.NoError(t, framer.WriteWindowUpdate(0, 1000))
+	})
+
+	var frames []*internal.Frame
+	decoder := json.NewDecoder(frameLog)
+	for decoder.More() {
+		frame := &internal.Frame{}
+		require.NoError(t, decoder.Decode(frame))
+		require.Equal(t, uint64(7), frame.ConnectionID)
+		require.Equal(t, internal.Upstream, frame.Leg)
+		frames = append(frames, frame)
+	}
+	require.Len(t, frames, 8)
+
+	require.Equal(t, "HEADERS", frames[0].Type)
+	require.Equal(t, []string{"PRIORITY"}, frames[0].Flags)
+	require.Equal(t, uint16(16), frames[0].Priority.Weight)
+	require.Equal(t, "CONTINUATION", frames[1].Type)
+	// the fields are in the frame their encoding ends in
+	require.Equal(t, []*internal.HeaderField{
+		{Name: ":path", Value: "/test.Service/Method"},
+		{Name: "authorization", Value: "secret", Sensitive: true},
+	}, append(frames[0].Headers, frames[1].Headers...))
+
+	require.Equal(t, "DATA", frames[2].Type)
+	require.Equal(t, []string{"END_STREAM"}, frames[2].Flags)
+	require.Equal(t, "\x00\x00\x00\x00\x03foo", string(frames[2].Data))
+	require.Equal(t, "0102030405060708", frames[3].PingData)
+	require.Contains(t, frames[4].Error, "DATA frame with stream ID 0")
+	require.Equal(t, "unexpected CONTINUATION frame", frames[5].Error)
+	require.Equal(t, "UNKNOWN_FRAME_TYPE_66", frames[6].Type)
+	require.Equal(t, []string{"0x80"}, frames[6].Flags)
+	require.Equal(t, "extension", string(frames[6].Data))
+
+	require.Equal(t, internal.SentByServer, frames[7].Sender)
+	require.Equal(t, uint32(1000), frames[7].WindowIncrement)
+	require.Empty(t, frames[7].Error)
+}
+
+func TestCapturePcapng(t *testing.T) {
+	pcap := &bytes.Buffer{}
+	capture, err := NewCapture(logrus.New(), nil, pcap)
+	require.NoError(t, err)
+	conn := capture.connection(1, internal.Downstream,
+		&net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000},
+		&net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 443},
+	)
+	_, err = capture.KeyLogWriter().Write([]byte("CLIENT_RANDOM abc def\n"))
+	require.NoError(t, err)
+	conn.raw(internal.SentByClient, []byte("hello"))
+	conn.raw(internal.SentByServer, []byte("world!"))
+	conn.close()
+
+	var blockTypes []uint32
+	var packets [][]byte
+	for b := pcap.Bytes(); len(b) > 0; {
+		blockType, length := binary.LittleEndian.Uint32(b), binary.LittleEndian.Uint32(b[4:])
+		require.Zero(t, length%4)
+		require.Equal(t, length, binary.LittleEndian.Uint32(b[length-4:]))
+		blockTypes = append(blockTypes, blockType)
+		switch blockType {
+		case blockEnhancedPacket:
+			packets = append(packets, b[28:28+binary.LittleEndian.Uint32(b[20:])])
+		case blockDecryptionSecrets:
+			require.Equal(t, "CLIENT_RANDOM abc def\n", string(b[16:16+binary.LittleEndian.Uint32(b[12:])]))
+		}
+		b = b[length:]
+	}
+	require.Equal(t, []uint32{blockSectionHeader, blockInterface}, blockTypes[:2])
+	require.Contains(t, blockTypes, uint32(blockDecryptionSecrets))
+	require.Len(t, packets, 8) // handshake, two data packets and close
+
+	hello := packets[3]
+	require.Equal(t, uint16(0), checksum(0, hello[:20]), "valid IPv4 header checksum")
+	require.Equal(t, net.IPv4(10, 0, 0, 1).To4(), net.IP(hello[12:16]))
+	require.Equal(t, uint16(5000), binary.BigEndian.Uint16(hello[20:]))
+	require.Equal(t, uint32(1), binary.BigEndian.Uint32(hello[24:]), "first byte after the SYN")
+	require.Equal(t, "hello", string(hello[40:]))
+
+	world := packets[4]
+	require.Equal(t, uint16(443), binary.BigEndian.Uint16(world[20:]))
+	require.Equal(t, uint32(6), binary.BigEndian.Uint32(world[28:]), "acknowledges hello")
+	require.Equal(t, "world!", string(world[40:]))
+}
+
+func TestCaptureClose(t *testing.T) {
+	pcap := &bytes.Buffer{}
+	capture, err := NewCapture(logrus.New(), nil, pcap)
+	require.NoError(t, err)
+	closed := capture.connection(1, internal.Downstream, nil, nil)
+	capture.connection(2, internal.Downstream, nil, nil)
+	closed.close()
+	capture.Close()
+	// nothing is captured once closed
+	closed.raw(internal.SentByClient, []byte("hello"))
+	capture.connection(3, internal.Downstream, nil, nil)
+
+	var flags []byte
+	for b := pcap.Bytes(); len(b) > 0; {
+		blockType, length := binary.LittleEndian.Uint32(b), binary.LittleEndian.Uint32(b[4:])
+		if blockType == blockEnhancedPacket {
+			flags = append(flags, b[28+33]) // the TCP flags of the IPv4 packet
+		}
+		b = b[length:]
+	}
+	// both connections are opened and closed (the one still open by Close)
+	handshake := []byte{tcpSYN, tcpSYN | tcpACK, tcpACK}
+	close := []byte{tcpFIN | tcpACK, tcpFIN | tcpACK, tcpACK}
+	expected := append(append(append(append([]byte{}, handshake...), handshake...), close...), close...)
+	require.Equal(t, expected, flags)
+}
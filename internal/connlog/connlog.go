@@ -0,0 +1,220 @@
+// Package connlog logs events on the client connections accepted by the proxy
+// and captures the frames sent over them (and over connections to upstream servers).
+//
+// Connections are tracked from when they are accepted until they are closed.
+// The layers handling a connection (e.g. tlsmux and the HTTP servers) see it
+// wrapped in several ways so they find it again through its connstate.State.
+package connlog
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bradleyjkemp/grpc-tools/internal"
+	"github.com/bradleyjkemp/grpc-tools/internal/connstate"
+)
+
+// Logger assigns IDs to accepted connections and passes their events on
+type Logger struct {
+	emit    func(*internal.ConnectionEvent)
+	capture *Capture
+	nextID  uint64
+}
+
+// New returns a logger passing events to emit (which must be safe for concurrent use)
+// and capturing connections using capture. Either may be nil.
+func New(emit func(*internal.ConnectionEvent), capture *Capture) *Logger {
+	return &Logger{emit: emit, capture: capture}
+}
+
+// Listener tracks the connections accepted from a listener.
+// A nil Logger returns the listener unchanged.
+func (l *Logger) Listener(listener net.Listener) net.Listener {
+	if l == nil {
+		return listener
+	}
+	return trackingListener{listener, l}
+}
+
+type trackingListener struct {
+	net.Listener
+	logger *Logger
+}
+
+func (l trackingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	conn, state := connstate.New(conn)
+	tracked := &trackedConn{
+		Conn:   conn,
+		id:     atomic.AddUint64(&l.logger.nextID, 1),
+		logger: l.logger,
+	}
+	state.Tracker = tracked
+	tracked.capture = l.logger.capture.connection(tracked.id, internal.Downstream, conn.RemoteAddr(), conn.LocalAddr())
+	tracked.log(&internal.ConnectionEvent{
+		Event:      internal.ConnectionAccepted,
+		Listener:   l.Addr().String(),
+		RemoteAddr: conn.RemoteAddr().String(),
+	})
+	return tracked, nil
+}
+
+// Dialer captures the connections made to upstream servers using dialer.
+// A nil Logger (or one without a Capture) returns the dialer unchanged.
+func (l *Logger) Dialer(dialer func(context.Context, string) (net.Conn, error)) func(context.Context, string) (net.Conn, error) {
+	if l == nil || l.capture == nil {
+		return dialer
+	}
+	return func(ctx context.Context, address string) (net.Conn, error) {
+		conn, err := dialer(ctx, address)
+		if err != nil {
+			return nil, err
+		}
+		tracked := &trackedConn{
+			Conn:     conn,
+			id:       atomic.AddUint64(&l.nextID, 1),
+			logger:   l,
+			upstream: true,
+		}
+		tracked.capture = l.capture.connection(tracked.id, internal.Upstream, conn.LocalAddr(), conn.RemoteAddr())
+		// the frames of TLS connections are captured once the handshake is done (see UpstreamTLS)
+		return newHTTP2Conn(tracked, tracked, false), nil
+	}
+}
+
+type tcpLike interface {
+	CloseRead() error
+	CloseWrite() error
+}
+
+// trackedConn counts the bytes transferred over a connection and logs when it is closed
+type trackedConn struct {
+	net.Conn
+	id       uint64
+	logger   *Logger
+	upstream bool          // a connection to an upstream server rather than from a client
+	capture  *capturedConn // nil unless capturing connections
+
+	received, sent          int64
+	readClosed, writeClosed int32
+	closeOnce               sync.Once
+}
+
+// readSender is the side of the connection sending the bytes read from it
+func (c *trackedConn) readSender() string {
+	if c.upstream {
+		return internal.SentByServer
+	}
+	return internal.SentByClient
+}
+
+// writeSender is the side of the connection sending the bytes written to it
+func (c *trackedConn) writeSender() string {
+	if c.upstream {
+		return internal.SentByClient
+	}
+	return internal.SentByServer
+}
+
+func (c *trackedConn) ID() uint64 {
+	return c.id
+}
+
+func (c *trackedConn) Log(event *internal.ConnectionEvent) {
+	c.log(event)
+}
+
+func (c *trackedConn) log(event *internal.ConnectionEvent) {
+	if c.logger.emit == nil || c.upstream {
+		// only client connections are logged
+		return
+	}
+	event.ConnectionID = c.id
+	event.Timestamp = time.Now()
+	c.logger.emit(event)
+}
+
+func (c *trackedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.received, int64(n))
+	c.capture.raw(c.readSender(), b[:n])
+	return n, err
+}
+
+func (c *trackedConn) Write(b []byte) (int, error) {
+	// captured before writing so that any response is captured after it
+	c.capture.raw(c.writeSender(), b)
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.sent, int64(n))
+	return n, err
+}
+
+func (c *trackedConn) Close() error {
+	c.closed()
+	return c.Conn.Close()
+}
+
+// tunnels close each half of TCP connections separately (see tlsmux.forwardConnection)
+func (c *trackedConn) CloseRead() error {
+	atomic.StoreInt32(&c.readClosed, 1)
+	if atomic.LoadInt32(&c.writeClosed) == 1 {
+		c.closed()
+	}
+	if tcp, ok := c.Conn.(tcpLike); ok {
+		return tcp.CloseRead()
+	}
+	return nil
+}
+
+func (c *trackedConn) CloseWrite() error {
+	atomic.StoreInt32(&c.writeClosed, 1)
+	if atomic.LoadInt32(&c.readClosed) == 1 {
+		c.closed()
+	}
+	if tcp, ok := c.Conn.(tcpLike); ok {
+		return tcp.CloseWrite()
+	}
+	return nil
+}
+
+func (c *trackedConn) closed() {
+	c.closeOnce.Do(func() {
+		c.capture.close()
+		c.log(&internal.ConnectionEvent{
+			Event:         internal.ConnectionClosed,
+			BytesReceived: atomic.LoadInt64(&c.received),
+			BytesSent:     atomic.LoadInt64(&c.sent),
+		})
+	})
+}
+
+// tracked finds the tracked connection with the state (nil if it isn't tracked)
+func tracked(state *connstate.State) *trackedConn {
+	if state == nil {
+		return nil
+	}
+	conn, _ := state.Tracker.(*trackedConn)
+	return conn
+}
+
+// Log logs an event on a client connection (if it is tracked)
+func Log(conn net.Conn, event *internal.ConnectionEvent) {
+	if tracked := tracked(connstate.FromConn(conn)); tracked != nil {
+		tracked.log(event)
+	}
+}
+
+// ID returns the ID of the tracked connection a request or RPC was received on
+// (zero if it isn't tracked)
+func ID(ctx context.Context) uint64 {
+	if tracked := tracked(connstate.FromContext(ctx)); tracked != nil {
+		return tracked.id
+	}
+	return 0
+}
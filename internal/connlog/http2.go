@@ -0,0 +1,236 @@
+package connlog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+
+	"github.com/bradleyjkemp/grpc-tools/internal"
+	"github.com/bradleyjkemp/grpc-tools/internal/connstate"
+	"golang.org/x/net/http2"
+)
+
+const (
+	frameHeaderLen = 9
+	// the most of a logged frame's payload kept when not capturing frames
+	// (only GOAWAY debug data can be longer)
+	maxPayloadLen = 1024
+)
+
+// HTTP2Listener logs the HTTP/2 frames of the tracked connections accepted from a listener
+// (see HTTP2). Untracked connections are returned unchanged.
+func HTTP2Listener(listener net.Listener, knownHTTP2 bool) net.Listener {
+	return http2Listener{listener, knownHTTP2}
+}
+
+type http2Listener struct {
+	net.Listener
+	knownHTTP2 bool
+}
+
+func (l http2Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return HTTP2(conn, l.knownHTTP2), nil
+}
+
+// HTTP2 logs the SETTINGS, GOAWAY and RST_STREAM frames sent in either direction over
+// a tracked connection (and captures every frame if capturing). If knownHTTP2 is false
+// then frames are only parsed if the client starts the connection with the HTTP/2 preface
+// (i.e. HTTP/2 with prior knowledge) otherwise the proxy's frames are parsed from the start
+// of the connection. Untracked connections are returned unchanged.
+func HTTP2(conn net.Conn, knownHTTP2 bool) net.Conn {
+	tracked := tracked(connstate.FromConn(conn))
+	if tracked == nil {
+		return conn
+	}
+	return newHTTP2Conn(conn, tracked, knownHTTP2)
+}
+
+// UpstreamTLS captures the frames of an upstream TLS connection made over rawConn
+// (a connection returned by a Logger's Dialer) once the handshake is done.
+func UpstreamTLS(rawConn, conn net.Conn) net.Conn {
+	raw, ok := rawConn.(*http2Conn)
+	if !ok {
+		return conn
+	}
+	// gRPC is always HTTP/2
+	return newHTTP2Conn(conn, raw.tracked, true)
+}
+
+func newHTTP2Conn(conn net.Conn, tracked *trackedConn, knownHTTP2 bool) *http2Conn {
+	client := &frameParser{
+		conn:    tracked,
+		sender:  internal.SentByClient,
+		preface: []byte(http2.ClientPreface),
+		parsing: true,
+	}
+	server := &frameParser{
+		conn:    tracked,
+		sender:  internal.SentByServer,
+		parsing: knownHTTP2,
+	}
+	if !knownHTTP2 {
+		// servers only respond once they have read the preface
+		client.onPreface = func() {
+			atomic.StoreInt32(&server.ready, 1)
+		}
+	}
+	c := &http2Conn{Conn: conn, tracked: tracked, read: client, written: server}
+	if tracked.upstream {
+		c.read, c.written = server, client
+	}
+	return c
+}
+
+type http2Conn struct {
+	net.Conn
+	tracked *trackedConn
+	// the parsers of the frames read from and written to the connection
+	read, written *frameParser
+}
+
+func (c *http2Conn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.read.parse(b[:n])
+	return n, err
+}
+
+func (c *http2Conn) Write(b []byte) (int, error) {
+	// parsed before writing so that frames are logged before any response to them
+	c.written.parse(b)
+	return c.Conn.Write(b)
+}
+
+// frameParser follows the frames sent in one direction of a connection.
+// It is only used by one goroutine at a time (the reader or the writer).
+type frameParser struct {
+	conn      *trackedConn
+	sender    string
+	parsing   bool
+	preface   []byte
+	onPreface func()
+	ready     int32 // set to start parsing once the client has sent the preface
+
+	header    [frameHeaderLen]byte
+	headerLen int
+	remaining uint32 // the remaining payload of the current frame
+	payload   []byte
+}
+
+func (p *frameParser) parse(b []byte) {
+	if !p.parsing && atomic.LoadInt32(&p.ready) == 1 {
+		p.parsing = true
+	}
+	for p.parsing && len(b) > 0 {
+		switch {
+		case len(p.preface) > 0:
+			n := len(p.preface)
+			if len(b) < n {
+				n = len(b)
+			}
+			if !bytes.Equal(b[:n], p.preface[:n]) {
+				// not HTTP/2 with prior knowledge
+				p.parsing = false
+				return
+			}
+			p.preface, b = p.preface[n:], b[n:]
+			if len(p.preface) == 0 && p.onPreface != nil {
+				p.onPreface()
+			}
+
+		case p.headerLen < frameHeaderLen:
+			n := copy(p.header[p.headerLen:], b)
+			p.headerLen, b = p.headerLen+n, b[n:]
+			if p.headerLen == frameHeaderLen {
+				p.remaining = uint32(p.header[0])<<16 | uint32(p.header[1])<<8 | uint32(p.header[2])
+				p.payload = p.payload[:0]
+				p.frameDone()
+			}
+
+		default:
+			n := uint32(len(b))
+			if n > p.remaining {
+				n = p.remaining
+			}
+			p.keep(b[:n])
+			p.remaining, b = p.remaining-n, b[n:]
+			p.frameDone()
+		}
+	}
+}
+
+func (p *frameParser) frameType() http2.FrameType {
+	return http2.FrameType(p.header[3])
+}
+
+// logged checks whether the current frame is one that is logged
+func (p *frameParser) logged() bool {
+	switch p.frameType() {
+	case http2.FrameSettings, http2.FrameGoAway, http2.FrameRSTStream:
+		return true
+	default:
+		return false
+	}
+}
+
+// keep adds to the payload kept of the current frame: all of it when capturing
+// frames otherwise just enough to log the frames that are logged
+func (p *frameParser) keep(b []byte) {
+	switch {
+	case p.conn.capture.capturingFrames():
+		p.payload = append(p.payload, b...)
+	case p.logged() && len(p.payload) < maxPayloadLen:
+		if len(p.payload)+len(b) > maxPayloadLen {
+			b = b[:maxPayloadLen-len(p.payload)]
+		}
+		p.payload = append(p.payload, b...)
+	}
+}
+
+// frameDone logs the current frame if all of its payload has been read
+func (p *frameParser) frameDone() {
+	if p.remaining > 0 {
+		return
+	}
+	p.headerLen = 0
+	p.conn.capture.frame(p.sender, p.header[:], p.payload)
+	if !p.logged() {
+		return
+	}
+	flags := http2.Flags(p.header[4])
+	streamID := binary.BigEndian.Uint32(p.header[5:9]) & (1<<31 - 1)
+	event := &internal.ConnectionEvent{Sender: p.sender}
+	switch p.frameType() {
+	case http2.FrameSettings:
+		if flags.Has(http2.FlagSettingsAck) {
+			return
+		}
+		event.Event = internal.ConnectionSettings
+		event.Settings = map[string]uint32{}
+		for i := 0; i+6 <= len(p.payload); i += 6 {
+			setting := http2.SettingID(binary.BigEndian.Uint16(p.payload[i:]))
+			event.Settings[setting.String()] = binary.BigEndian.Uint32(p.payload[i+2:])
+		}
+	case http2.FrameGoAway:
+		if len(p.payload) < 8 {
+			return
+		}
+		lastStreamID := binary.BigEndian.Uint32(p.payload) & (1<<31 - 1)
+		event.Event = internal.ConnectionGoAway
+		event.LastStreamID = &lastStreamID
+		event.ErrorCode = http2.ErrCode(binary.BigEndian.Uint32(p.payload[4:])).String()
+		event.DebugData = string(p.payload[8:])
+	case http2.FrameRSTStream:
+		if len(p.payload) < 4 {
+			return
+		}
+		event.Event = internal.ConnectionRSTStream
+		event.StreamID = streamID
+		event.ErrorCode = http2.ErrCode(binary.BigEndian.Uint32(p.payload)).String()
+	}
+	p.conn.log(event)
+}
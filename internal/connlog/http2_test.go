@@ -0,0 +1,61 @@
+package connlog
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/bradleyjkemp/grpc-tools/internal"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+)
+
+func TestFrameParser(t *testing.T) {
+	var events []*internal.ConnectionEvent
+	conn := &trackedConn{id: 1, logger: New(func(event *internal.ConnectionEvent) {
+		events = append(events, event)
+	}, nil)}
+
+	frames := &bytes.Buffer{}
+	frames.WriteString(http2.ClientPreface)
+	framer := http2.NewFramer(frames, nil)
+	require.NoError(t, framer.WriteSettings(http2.Setting{ID: http2.SettingMaxConcurrentStreams, Val: 100}))
+	require.NoError(t, framer.WriteSettingsAck())
+	require.NoError(t, framer.WriteData(1, false, make([]byte, 2000)))
+	require.NoError(t, framer.WriteRSTStream(1, http2.ErrCodeCancel))
+	require.NoError(t, framer.WriteGoAway(3, http2.ErrCodeEnhanceYourCalm, []byte("too_many_pings")))
+
+	parser := &frameParser{
+		conn:    conn,
+		sender:  internal.SentByClient,
+		preface: []byte(http2.ClientPreface),
+		parsing: true,
+	}
+	// frames are split across reads
+	for b := frames.Bytes(); len(b) > 0; {
+		n := 7
+		if n > len(b) {
+			n = len(b)
+		}
+		parser.parse(b[:n])
+		b = b[n:]
+	}
+
+	require.Len(t, events, 3)
+	require.Equal(t, internal.ConnectionSettings, events[0].Event)
+	require.Equal(t, map[string]uint32{"MAX_CONCURRENT_STREAMS": 100}, events[0].Settings)
+	require.Equal(t, internal.ConnectionRSTStream, events[1].Event)
+	require.Equal(t, uint32(1), events[1].StreamID)
+	require.Equal(t, "CANCEL", events[1].ErrorCode)
+	require.Equal(t, internal.ConnectionGoAway, events[2].Event)
+	require.Equal(t, uint32(3), *events[2].LastStreamID)
+	require.Equal(t, "ENHANCE_YOUR_CALM", events[2].ErrorCode)
+	require.Equal(t, "too_many_pings", events[2].DebugData)
+	for _, event := range events {
+		require.Equal(t, uint64(1), event.ConnectionID)
+		require.Equal(t, internal.SentByClient, event.Sender)
+	}
+
+	notHTTP2 := &frameParser{conn: conn, preface: []byte(http2.ClientPreface), parsing: true}
+	notHTTP2.parse([]byte("GET / HTTP/1.1\r\n"))
+	require.False(t, notHTTP2.parsing)
+}
@@ -0,0 +1,227 @@
+package connlog
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+
+	"github.com/bradleyjkemp/grpc-tools/internal/connstate"
+)
+
+// pcapng block types (see https://datatracker.ietf.org/doc/draft-ietf-opsawg-pcapng/)
+const (
+	blockSectionHeader     = 0x0a0d0d0a
+	blockInterface         = 0x00000001
+	blockEnhancedPacket    = 0x00000006
+	blockDecryptionSecrets = 0x0000000a
+
+	byteOrderMagic   = 0x1a2b3c4d
+	linkTypeRaw      = 101        // packets start with an IPv4 or IPv6 header
+	secretsTLSKeyLog = 0x544c534b // the NSS key log format (as written to tls.Config.KeyLogWriter)
+
+	// the most payload put in a single TCP segment (keeping well within the maximum IPv4 packet size)
+	maxSegmentSize = 32 * 1024
+)
+
+// TCP flags
+const (
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpPSH = 0x08
+	tcpACK = 0x10
+)
+
+// pcapngWriter writes a pcapng with a single interface of raw IP packets
+type pcapngWriter struct {
+	output io.Writer
+}
+
+func newPcapngWriter(output io.Writer) (*pcapngWriter, error) {
+	w := &pcapngWriter{output}
+	sectionHeader := make([]byte, 16)
+	binary.LittleEndian.PutUint32(sectionHeader[0:], byteOrderMagic)
+	binary.LittleEndian.PutUint16(sectionHeader[4:], 1) // version 1.0
+	binary.LittleEndian.PutUint64(sectionHeader[8:], ^uint64(0))
+	if err := w.block(blockSectionHeader, sectionHeader); err != nil {
+		return nil, err
+	}
+	iface := make([]byte, 8)
+	binary.LittleEndian.PutUint16(iface[0:], linkTypeRaw)
+	if err := w.block(blockInterface, iface); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *pcapngWriter) block(blockType uint32, body []byte) error {
+	length := 12 + (len(body)+3)&^3
+	block := make([]byte, length)
+	binary.LittleEndian.PutUint32(block[0:], blockType)
+	binary.LittleEndian.PutUint32(block[4:], uint32(length))
+	copy(block[8:], body)
+	binary.LittleEndian.PutUint32(block[length-4:], uint32(length))
+	_, err := w.output.Write(block)
+	return err
+}
+
+// secrets writes the TLS secrets needed to decrypt the packets that follow
+func (w *pcapngWriter) secrets(keyLog []byte) error {
+	body := make([]byte, 8+len(keyLog))
+	binary.LittleEndian.PutUint32(body[0:], secretsTLSKeyLog)
+	binary.LittleEndian.PutUint32(body[4:], uint32(len(keyLog)))
+	copy(body[8:], keyLog)
+	return w.block(blockDecryptionSecrets, body)
+}
+
+func (w *pcapngWriter) packet(timestamp time.Time, packet []byte) error {
+	body := make([]byte, 20+len(packet))
+	micros := uint64(timestamp.UnixNano() / int64(time.Microsecond))
+	binary.LittleEndian.PutUint32(body[4:], uint32(micros>>32))
+	binary.LittleEndian.PutUint32(body[8:], uint32(micros))
+	binary.LittleEndian.PutUint32(body[12:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(body[16:], uint32(len(packet)))
+	copy(body[20:], packet)
+	return w.block(blockEnhancedPacket, body)
+}
+
+// tcpStream makes up the TCP packets carrying the bytes sent over a connection
+// (which may not be TCP at all, e.g. a unix socket).
+type tcpStream struct {
+	client, server       *net.TCPAddr
+	clientSeq, serverSeq uint32 // the next sequence number sent by each side
+}
+
+func newTCPStream(id uint64, client, server net.Addr) *tcpStream {
+	s := &tcpStream{
+		client: tcpAddr(client, net.IPv4(127, 0, 0, 1), 1024+int(id%64000)),
+		server: tcpAddr(server, net.IPv4(127, 0, 0, 2), 80),
+	}
+	if (s.client.IP.To4() == nil) != (s.server.IP.To4() == nil) {
+		// both addresses must be the same IP version
+		s.client.IP, s.server.IP = s.client.IP.To16(), s.server.IP.To16()
+	}
+	return s
+}
+
+// tcpAddr returns the address of a TCP connection or else a made up one
+func tcpAddr(addr net.Addr, fallbackIP net.IP, fallbackPort int) *net.TCPAddr {
+	if tcp, ok := connstate.Unwrap(addr).(*net.TCPAddr); ok && tcp.IP != nil {
+		return &net.TCPAddr{IP: tcp.IP, Port: tcp.Port}
+	}
+	return &net.TCPAddr{IP: fallbackIP, Port: fallbackPort}
+}
+
+// handshake returns the packets opening the connection
+func (s *tcpStream) handshake() [][]byte {
+	return [][]byte{
+		s.segment(true, tcpSYN, nil),
+		s.segment(false, tcpSYN|tcpACK, nil),
+		s.segment(true, tcpACK, nil),
+	}
+}
+
+// data returns the packets carrying bytes sent by one side
+func (s *tcpStream) data(fromClient bool, payload []byte) [][]byte {
+	var packets [][]byte
+	for len(payload) > 0 {
+		n := len(payload)
+		if n > maxSegmentSize {
+			n = maxSegmentSize
+		}
+		packets = append(packets, s.segment(fromClient, tcpPSH|tcpACK, payload[:n]))
+		payload = payload[n:]
+	}
+	return packets
+}
+
+// close returns the packets closing the connection
+func (s *tcpStream) close() [][]byte {
+	return [][]byte{
+		s.segment(false, tcpFIN|tcpACK, nil),
+		s.segment(true, tcpFIN|tcpACK, nil),
+		s.segment(false, tcpACK, nil),
+	}
+}
+
+func (s *tcpStream) segment(fromClient bool, flags byte, payload []byte) []byte {
+	src, dst, seq, ack := s.client, s.server, &s.clientSeq, s.serverSeq
+	if !fromClient {
+		src, dst, seq, ack = s.server, s.client, &s.serverSeq, s.clientSeq
+	}
+	if flags&tcpACK == 0 {
+		ack = 0
+	}
+
+	tcp := make([]byte, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(tcp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint32(tcp[4:], *seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4 // no options
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535) // window
+	copy(tcp[20:], payload)
+
+	*seq += uint32(len(payload))
+	if flags&(tcpSYN|tcpFIN) != 0 {
+		// SYN and FIN each use up a sequence number
+		*seq++
+	}
+
+	var packet, pseudoHeader []byte
+	if src.IP.To4() != nil {
+		packet = make([]byte, 20+len(tcp))
+		packet[0] = 4<<4 | 5 // IPv4 without options
+		binary.BigEndian.PutUint16(packet[2:], uint16(len(packet)))
+		binary.BigEndian.PutUint16(packet[6:], 0x4000) // don't fragment
+		packet[8] = 64                                 // TTL
+		packet[9] = 6                                  // TCP
+		copy(packet[12:], src.IP.To4())
+		copy(packet[16:], dst.IP.To4())
+		binary.BigEndian.PutUint16(packet[10:], checksum(0, packet[:20]))
+
+		pseudoHeader = make([]byte, 12)
+		copy(pseudoHeader[0:], src.IP.To4())
+		copy(pseudoHeader[4:], dst.IP.To4())
+		pseudoHeader[9] = 6
+		binary.BigEndian.PutUint16(pseudoHeader[10:], uint16(len(tcp)))
+	} else {
+		packet = make([]byte, 40+len(tcp))
+		packet[0] = 6 << 4
+		binary.BigEndian.PutUint16(packet[4:], uint16(len(tcp)))
+		packet[6] = 6  // TCP
+		packet[7] = 64 // hop limit
+		copy(packet[8:], src.IP.To16())
+		copy(packet[24:], dst.IP.To16())
+
+		pseudoHeader = make([]byte, 40)
+		copy(pseudoHeader[0:], src.IP.To16())
+		copy(pseudoHeader[16:], dst.IP.To16())
+		binary.BigEndian.PutUint32(pseudoHeader[32:], uint32(len(tcp)))
+		pseudoHeader[39] = 6
+	}
+	binary.BigEndian.PutUint16(tcp[16:], checksum(sum(0, pseudoHeader), tcp))
+	copy(packet[len(packet)-len(tcp):], tcp)
+	return packet
+}
+
+// sum adds b to a ones' complement checksum
+func sum(total uint32, b []byte) uint32 {
+	for i := 0; i+1 < len(b); i += 2 {
+		total += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		total += uint32(b[len(b)-1]) << 8
+	}
+	return total
+}
+
+// checksum is the Internet checksum of b (continuing from a partial sum)
+func checksum(total uint32, b []byte) uint16 {
+	total = sum(total, b)
+	for total>>16 != 0 {
+		total = total&0xffff + total>>16
+	}
+	return ^uint16(total)
+}
@@ -0,0 +1,150 @@
+// Package connstate attaches state to the client connections accepted by the proxy.
+//
+// The layers handling a connection (e.g. tlsmux and the HTTP and gRPC servers)
+// see it wrapped in several ways, and some (like *tls.Conn) hide the connection
+// they wrap, so the state is carried by the connection's remote address which
+// every wrapper preserves. It is then added to the context of the requests and
+// RPCs received over the connection.
+package connstate
+
+import (
+	"context"
+	"net"
+
+	"github.com/bradleyjkemp/grpc-tools/internal"
+	"google.golang.org/grpc/peer"
+)
+
+// State is what is known about a client connection.
+// Fields are set by the layer handling the connection before it is
+// passed on to the next one so are not guarded by a lock.
+type State struct {
+	// Destination is the address the client was connecting to
+	// before being tunnelled or transparently redirected to the proxy
+	Destination string
+	// Tunnelled is set for connections tunnelled through the proxy
+	// (i.e. using HTTP CONNECT or SOCKS)
+	Tunnelled bool
+	// ProxyUser is the user the client authenticated as when opening the tunnel
+	// (empty if authentication isn't required)
+	ProxyUser string
+	// TLS is the handshake of the (innermost) intercepted TLS connection
+	TLS *internal.TLSHandshake
+	// Tracker logs the connection's events (nil unless connections are being logged)
+	Tracker Tracker
+}
+
+// Tracker is implemented by the connections tracked by package connlog
+type Tracker interface {
+	ID() uint64
+	Log(event *internal.ConnectionEvent)
+}
+
+// Addr is the remote address of a connection with state attached
+type Addr struct {
+	net.Addr
+	State *State
+}
+
+// Unwrap returns the address without any state attached
+func Unwrap(addr net.Addr) net.Addr {
+	if a, ok := addr.(Addr); ok {
+		return a.Addr
+	}
+	return addr
+}
+
+// New attaches new state to a connection, unless it already has some.
+func New(c net.Conn) (net.Conn, *State) {
+	if state := FromConn(c); state != nil {
+		return c, state
+	}
+	state := &State{}
+	addr := Addr{Addr: c.RemoteAddr(), State: state}
+	if _, ok := c.(halfCloser); ok {
+		return &halfCloseConn{conn{c, addr}}, state
+	}
+	return &conn{c, addr}, state
+}
+
+// FromConn returns the state attached to a connection (nil if there isn't any)
+func FromConn(c net.Conn) *State {
+	return FromAddr(c.RemoteAddr())
+}
+
+// FromAddr returns the state attached to a remote address (nil if there isn't any)
+func FromAddr(addr net.Addr) *State {
+	if a, ok := addr.(Addr); ok {
+		return a.State
+	}
+	return nil
+}
+
+type contextKey struct{}
+
+// ConnContext adds the state of a connection to a context.
+// It has the signature of http.Server's ConnContext.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	if state := FromConn(c); state != nil {
+		return context.WithValue(ctx, contextKey{}, state)
+	}
+	return ctx
+}
+
+// FromContext returns the state of the connection a request or RPC was received on
+// (nil if there isn't any)
+func FromContext(ctx context.Context) *State {
+	if state, ok := ctx.Value(contextKey{}).(*State); ok {
+		return state
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		// RPCs served directly by the gRPC server have the connection's address
+		return FromAddr(p.Addr)
+	}
+	return nil
+}
+
+// Listener attaches new state to every connection accepted from a listener
+func Listener(l net.Listener) net.Listener {
+	return listener{l}
+}
+
+type listener struct {
+	net.Listener
+}
+
+func (l listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	c, _ = New(c)
+	return c, nil
+}
+
+type conn struct {
+	net.Conn
+	addr Addr
+}
+
+func (c *conn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+type halfCloser interface {
+	CloseRead() error
+	CloseWrite() error
+}
+
+// halfCloseConn preserves the ability to close each half of (e.g. TCP) connections
+type halfCloseConn struct {
+	conn
+}
+
+func (c *halfCloseConn) CloseRead() error {
+	return c.Conn.(halfCloser).CloseRead()
+}
+
+func (c *halfCloseConn) CloseWrite() error {
+	return c.Conn.(halfCloser).CloseWrite()
+}
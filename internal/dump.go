@@ -15,17 +15,103 @@ type RPC struct {
 	Metadata             metadata.MD `json:"metadata"`
 	MetadataRespHeaders  metadata.MD `json:"metadata_response_headers"`
 	MetadataRespTrailers metadata.MD `json:"metadata_response_trailers"`
+	// decoded forms of the binary (-bin) values in the metadata above
+	BinaryMetadata []*BinaryMetadata `json:"binary_metadata,omitempty"`
+	// the grpc-encoding used in each direction (empty if uncompressed)
+	RequestEncoding  string `json:"request_encoding,omitempty"`
+	ResponseEncoding string `json:"response_encoding,omitempty"`
+	// the client's deadline and the time remaining until it when the RPC started
+	// (Timeout is in time.Duration string format e.g. "1.5s")
+	Deadline *time.Time `json:"deadline,omitempty"`
+	Timeout  string     `json:"timeout,omitempty"`
+	Timing   *Timing    `json:"timing,omitempty"`
+	// the user the client authenticated to the proxy as
+	ProxyUser string `json:"proxy_user,omitempty"`
+	// the TLS handshake of the client's connection (omitted for plaintext connections)
+	TLS *TLSHandshake `json:"tls,omitempty"`
+	// the connection the RPC was received on (see the connection event log)
+	ConnectionID uint64 `json:"connection_id,omitempty"`
+}
+
+// TLSHandshake describes the ClientHello sent by a client and the resulting TLS session
+type TLSHandshake struct {
+	ServerName         string   `json:"server_name,omitempty"`         // the SNI sent by the client
+	ALPN               []string `json:"alpn,omitempty"`                // the application protocols offered by the client
+	NegotiatedProtocol string   `json:"negotiated_protocol,omitempty"` // the application protocol chosen
+	Version            string   `json:"version"`                       // the negotiated TLS version e.g. TLS 1.3
+	CipherSuite        string   `json:"cipher_suite"`                  // the negotiated cipher suite
+	JA3                string   `json:"ja3"`                           // the JA3 fingerprint of the ClientHello (an MD5 hash)
+	JA3String          string   `json:"ja3_string"`                    // the fields hashed to make the JA3 fingerprint
+	JA4                string   `json:"ja4"`                           // the JA4 fingerprint of the ClientHello
+}
+
+// Timing records when each stage of an RPC happened and the resulting latencies.
+// Upstream fields are omitted if the RPC wasn't forwarded to a server.
+// Durations are in time.Duration string format (e.g. "1.5s").
+type Timing struct {
+	Received            time.Time  `json:"received"`
+	UpstreamConnected   *time.Time `json:"upstream_connected,omitempty"`
+	UpstreamRequestSent *time.Time `json:"upstream_request_sent,omitempty"`
+	FirstResponse       *time.Time `json:"first_response,omitempty"`
+	UpstreamFinished    *time.Time `json:"upstream_finished,omitempty"`
+	LastMessage         *time.Time `json:"last_message,omitempty"`
+	Finished            time.Time  `json:"finished"`
+
+	ConnectionAcquisition string `json:"connection_acquisition,omitempty"` // received until upstream connected
+	TimeToFirstResponse   string `json:"time_to_first_response,omitempty"` // received until first response
+	UpstreamLatency       string `json:"upstream_latency,omitempty"`       // upstream request sent until upstream finished
+	ProxyOverhead         string `json:"proxy_overhead"`                   // total minus upstream latency
+	Total                 string `json:"total"`                            // received until finished
+}
+
+type MetadataSource string
+
+const (
+	RequestMetadata  MetadataSource = "request"
+	ResponseHeaders  MetadataSource = "response_headers"
+	ResponseTrailers MetadataSource = "response_trailers"
+)
+
+// BinaryMetadata is the decoded form of a binary (-bin) metadata value.
+// The raw value is kept (base64 encoded) in the RPC's metadata at Key[Index].
+type BinaryMetadata struct {
+	Source      MetadataSource `json:"source"`
+	Key         string         `json:"key"`
+	Index       int            `json:"index"`
+	MessageType string         `json:"message_type,omitempty"` // empty if decoded heuristically
+	Value       interface{}    `json:"value,omitempty"`
 }
 
 type Status struct {
-	Code    string `json:"code"`
-	Message string `json:"message"`
+	Code    string          `json:"code"`
+	Message string          `json:"message"`
+	Details []*StatusDetail `json:"details,omitempty"`
+}
+
+// StatusDetail is one of the details in a google.rpc.Status
+// (as sent in the grpc-status-details-bin trailer).
+type StatusDetail struct {
+	TypeURL  string      `json:"type_url"`
+	RawValue []byte      `json:"raw_value"`
+	Value    interface{} `json:"value,omitempty"`
 }
 
 func (r RPC) StreamName() string {
 	return fmt.Sprintf("/%s/%s", r.Service, r.Method)
 }
 
+// TimeoutDuration parses the RPC's timeout returning false if it had none
+func (r RPC) TimeoutDuration() (time.Duration, bool, error) {
+	if r.Timeout == "" {
+		return 0, false, nil
+	}
+	timeout, err := time.ParseDuration(r.Timeout)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid timeout %q: %v", r.Timeout, err)
+	}
+	return timeout, true, nil
+}
+
 type MessageOrigin string
 
 const (
@@ -38,4 +124,8 @@ type Message struct {
 	RawMessage    []byte        `json:"raw_message"`
 	Message       interface{}   `json:"message,omitempty"`
 	Timestamp     time.Time     `json:"timestamp"`
+	// whether the message was compressed on the wire and its size there
+	// (excluding the 5 byte gRPC message prefix)
+	Compressed bool `json:"compressed,omitempty"`
+	WireSize   int  `json:"wire_size,omitempty"`
 }
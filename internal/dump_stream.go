@@ -0,0 +1,69 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// DumpWriter writes RPCs as a newline separated stream of JSON objects
+// (the format output by grpc-dump). It is safe for concurrent use.
+type DumpWriter struct {
+	sync.Mutex
+	output io.Writer
+}
+
+func NewDumpWriter(output io.Writer) *DumpWriter {
+	return &DumpWriter{
+		output: output,
+	}
+}
+
+func (w *DumpWriter) Write(rpc *RPC) error {
+	dump, err := json.Marshal(rpc)
+	if err != nil {
+		return fmt.Errorf("failed to marshal rpc: %v", err)
+	}
+	w.Lock()
+	defer w.Unlock()
+	_, err = fmt.Fprintln(w.output, string(dump))
+	return err
+}
+
+// DumpReader reads RPCs from a stream in the format output by grpc-dump.
+type DumpReader struct {
+	decoder *json.Decoder
+}
+
+func NewDumpReader(input io.Reader) *DumpReader {
+	return &DumpReader{
+		decoder: json.NewDecoder(input),
+	}
+}
+
+// Read returns the next RPC in the stream or io.EOF
+// once there are no RPCs remaining.
+func (r *DumpReader) Read() (*RPC, error) {
+	rpc := &RPC{}
+	err := r.decoder.Decode(rpc)
+	if err != nil {
+		return nil, err
+	}
+	return rpc, nil
+}
+
+// ReadAll reads all remaining RPCs in the stream.
+func (r *DumpReader) ReadAll() ([]*RPC, error) {
+	var rpcs []*RPC
+	for {
+		rpc, err := r.Read()
+		if err == io.EOF {
+			return rpcs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		rpcs = append(rpcs, rpc)
+	}
+}
@@ -0,0 +1,84 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// the Leg of a captured connection
+const (
+	Downstream = "downstream" // between the client and the proxy
+	Upstream   = "upstream"   // between the proxy and the server
+)
+
+// Frame is an HTTP/2 frame captured on one of the proxy's connections.
+// The Sender is the HTTP/2 client or server of the connection (on upstream
+// connections the proxy is the client).
+type Frame struct {
+	ConnectionID uint64    `json:"connection_id"`
+	Leg          string    `json:"leg"`
+	Sender       string    `json:"sender"`
+	Timestamp    time.Time `json:"timestamp"`
+	Type         string    `json:"type"` // e.g. HEADERS or UNKNOWN_FRAME_TYPE_10
+	StreamID     uint32    `json:"stream_id"`
+	Flags        []string  `json:"flags,omitempty"`
+	Length       uint32    `json:"length"` // the length of the payload (including padding)
+
+	// the header fields decoded from the header block fragment of HEADERS,
+	// PUSH_PROMISE and CONTINUATION frames
+	Headers []*HeaderField `json:"headers,omitempty"`
+	// the payload of DATA frames (without padding) and unknown frame types
+	Data             []byte            `json:"data,omitempty"`
+	Settings         map[string]uint32 `json:"settings,omitempty"`
+	WindowIncrement  uint32            `json:"window_increment,omitempty"`
+	PingData         string            `json:"ping_data,omitempty"` // hex encoded
+	PromisedStreamID uint32            `json:"promised_stream_id,omitempty"`
+	Priority         *FramePriority    `json:"priority,omitempty"`
+	LastStreamID     *uint32           `json:"last_stream_id,omitempty"`
+	ErrorCode        string            `json:"error_code,omitempty"` // GOAWAY and RST_STREAM
+	DebugData        string            `json:"debug_data,omitempty"` // GOAWAY
+
+	// why the frame is invalid (e.g. it breaks the HTTP/2 framing rules or its headers can't be decoded)
+	Error string `json:"error,omitempty"`
+}
+
+// HeaderField is a single HPACK decoded header
+type HeaderField struct {
+	Name      string `json:"name"`
+	Value     string `json:"value"`
+	Sensitive bool   `json:"sensitive,omitempty"` // must never be indexed
+}
+
+// FramePriority is the stream priority set by HEADERS and PRIORITY frames
+type FramePriority struct {
+	StreamDependency uint32 `json:"stream_dependency"`
+	Exclusive        bool   `json:"exclusive,omitempty"`
+	Weight           uint16 `json:"weight"` // 1 to 256
+}
+
+// FrameWriter writes frames as a newline separated stream
+// of JSON objects. It is safe for concurrent use.
+type FrameWriter struct {
+	sync.Mutex
+	output io.Writer
+}
+
+func NewFrameWriter(output io.Writer) *FrameWriter {
+	return &FrameWriter{
+		output: output,
+	}
+}
+
+func (w *FrameWriter) Write(frame *Frame) error {
+	encoded, err := json.Marshal(frame)
+	if err != nil {
+		return fmt.Errorf("failed to marshal frame: %v", err)
+	}
+	w.Lock()
+	defer w.Unlock()
+	_, err = fmt.Fprintln(w.output, string(encoded))
+	return err
+}
@@ -48,19 +48,6 @@ func (p *peeker) CloseWrite() error {
 	}
 }
 
-type proxiedConnection interface {
-	OriginalDestination() string
-}
-
-func (p *peeker) OriginalDestination() string {
-	switch underlying := p.Conn.(type) {
-	case proxiedConnection:
-		return underlying.OriginalDestination()
-	default:
-		return ""
-	}
-}
-
 // Once called, the original connection *must not* be used
 func (p *peeker) PeekMatch(regexp *regexp.Regexp, len int) (bool, error) {
 	if p.peeked != nil {
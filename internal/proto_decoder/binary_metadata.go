@@ -0,0 +1,146 @@
+package proto_decoder
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/bradleyjkemp/grpc-tools/internal"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/desc/builder"
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/metadata"
+)
+
+// BinaryMetadataDecoder decodes binary (-bin) metadata values as protobuf messages.
+// Keys with a configured message type are decoded using that type, otherwise
+// the value is decoded heuristically in the same way as unknown messages.
+type BinaryMetadataDecoder struct {
+	logger       logrus.FieldLogger
+	messageTypes map[string]string // metadata key to fully qualified message name
+	unknownField unknownFieldResolver
+}
+
+func NewBinaryMetadataDecoder(logger logrus.FieldLogger, messageTypes map[string]string) *BinaryMetadataDecoder {
+	return &BinaryMetadataDecoder{
+		logger:       logger.WithField("", "binary_metadata"),
+		messageTypes: messageTypes,
+	}
+}
+
+var metadataMessageName = strings.NewReplacer("-", "_", ".", "_")
+
+// Decode decodes all of the binary values in md.
+// md must contain the raw values as received by gRPC (i.e. not base64 encoded).
+func (d *BinaryMetadataDecoder) Decode(source internal.MetadataSource, md metadata.MD) []*internal.BinaryMetadata {
+	var keys []string
+	for key := range md {
+		if internal.IsBinaryMetadataKey(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var decoded []*internal.BinaryMetadata
+	for _, key := range keys {
+		for i, value := range md[key] {
+			if len(value) == 0 {
+				continue
+			}
+			entry := &internal.BinaryMetadata{
+				Source: source,
+				Key:    key,
+				Index:  i,
+			}
+			var err error
+			if messageType, ok := d.messageTypes[key]; ok {
+				entry.Value, err = d.decodeAs(messageType, []byte(value))
+				if err == nil {
+					entry.MessageType = messageType
+				} else {
+					d.logger.WithError(err).Warnf("Failed to decode metadata %s as %s", key, messageType)
+				}
+			}
+			if entry.Value == nil {
+				entry.Value, err = d.decodeHeuristically(key, []byte(value))
+				if err != nil {
+					// most likely not a protobuf message so just leave the raw value
+					continue
+				}
+			}
+			decoded = append(decoded, entry)
+		}
+	}
+	return decoded
+}
+
+func (d *BinaryMetadataDecoder) decodeAs(messageType string, value []byte) (*dynamic.Message, error) {
+	descriptor, err := findMessageDescriptor(messageType)
+	if err != nil {
+		return nil, err
+	}
+	dyn := dynamic.NewMessage(descriptor)
+	if err := proto.Unmarshal(value, dyn); err != nil {
+		return nil, err
+	}
+	return dyn, nil
+}
+
+func (d *BinaryMetadataDecoder) decodeHeuristically(key string, value []byte) (*dynamic.Message, error) {
+	fb := builder.NewFile("") // "" == generate unique filename
+	mb := builder.NewMessage(metadataMessageName.Replace(key))
+	fb.AddMessage(mb)
+	empty, err := mb.Build()
+	if err != nil {
+		return nil, err
+	}
+	descriptor, err := d.unknownField.enrichDecodeDescriptor(empty, &internal.Message{RawMessage: value})
+	if err != nil {
+		return nil, err
+	}
+	dyn := dynamic.NewMessage(descriptor)
+	if err := proto.Unmarshal(value, dyn); err != nil {
+		return nil, err
+	}
+	return dyn, nil
+}
+
+// EncodeBinaryMetadata converts dumped metadata back into the form to be sent.
+// Binary values are decoded from base64 unless the dump contains a decoded value
+// of a known message type, in which case the value is encoded from that instead
+// (so that it can be edited).
+func EncodeBinaryMetadata(source internal.MetadataSource, md metadata.MD, decoded []*internal.BinaryMetadata) metadata.MD {
+	encoded := internal.DecodeBinaryMetadata(md)
+	for _, entry := range decoded {
+		if entry.Source != source || entry.MessageType == "" || entry.Value == nil {
+			continue
+		}
+		values := encoded[entry.Key]
+		if entry.Index < 0 || entry.Index >= len(values) {
+			continue
+		}
+		descriptor, err := findMessageDescriptor(entry.MessageType)
+		if err != nil {
+			continue
+		}
+		if value, err := encodeFromJSON(descriptor, entry.Value); err == nil {
+			values[entry.Index] = string(value)
+		}
+	}
+	return encoded
+}
+
+func encodeFromJSON(descriptor *desc.MessageDescriptor, value interface{}) ([]byte, error) {
+	jsonMarshalled, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	dyn := dynamic.NewMessage(descriptor)
+	if err := jsonpb.UnmarshalString(string(jsonMarshalled), dyn); err != nil {
+		return nil, err
+	}
+	return proto.Marshal(dyn)
+}
@@ -0,0 +1,53 @@
+package proto_decoder
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/bradleyjkemp/grpc-tools/internal"
+	"github.com/golang/protobuf/proto"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestBinaryMetadataRoundTrip(t *testing.T) {
+	requestInfo, err := proto.Marshal(&errdetails.RequestInfo{RequestId: "abc", ServingData: "data"})
+	require.NoError(t, err)
+	md := metadata.Pairs(
+		"request-info-bin", string(requestInfo),
+		"unknown-bin", string(requestInfo),
+		"not-binary", "plain",
+	)
+
+	decoder := NewBinaryMetadataDecoder(logrus.New(), map[string]string{
+		"request-info-bin": "google.rpc.RequestInfo",
+	})
+	decoded := decoder.Decode(internal.RequestMetadata, md)
+	require.Len(t, decoded, 2)
+	require.Equal(t, "request-info-bin", decoded[0].Key)
+	require.Equal(t, "google.rpc.RequestInfo", decoded[0].MessageType)
+	require.Equal(t, "unknown-bin", decoded[1].Key)
+	require.Empty(t, decoded[1].MessageType, "unconfigured keys should be decoded heuristically")
+	require.NotNil(t, decoded[1].Value)
+
+	// simulate writing to and reading from a dump
+	dumped := internal.EncodeBinaryMetadata(md)
+	require.NotEqual(t, md["request-info-bin"], dumped["request-info-bin"])
+	require.Equal(t, md["not-binary"], dumped["not-binary"])
+	value, err := json.Marshal(decoded[0].Value)
+	require.NoError(t, err)
+	var edited map[string]interface{}
+	require.NoError(t, json.Unmarshal(value, &edited))
+	edited["requestId"] = "edited"
+	decoded[0].Value = edited
+
+	encoded := EncodeBinaryMetadata(internal.RequestMetadata, dumped, decoded)
+	require.Equal(t, md["unknown-bin"], encoded["unknown-bin"])
+	require.Equal(t, md["not-binary"], encoded["not-binary"])
+	editedInfo := &errdetails.RequestInfo{}
+	require.NoError(t, proto.Unmarshal([]byte(encoded["request-info-bin"][0]), editedInfo))
+	require.Equal(t, "edited", editedInfo.RequestId)
+	require.Equal(t, "data", editedInfo.ServingData)
+}
@@ -24,7 +24,7 @@ type MessageEncoder interface {
 // a default resolver is used that always returns empty.Empty
 func NewEncoder(resolvers ...MessageResolver) *messageEncoder {
 	return &messageEncoder{
-		resolvers: append(resolvers),
+		resolvers: resolvers,
 		// TODO: include an unknown message encoder here
 	}
 }
@@ -7,11 +7,25 @@ import (
 	"github.com/golang/protobuf/ptypes/empty"
 	"github.com/jhump/protoreflect/desc"
 	"github.com/jhump/protoreflect/desc/builder"
+	"github.com/sirupsen/logrus"
+	"sort"
 	"strings"
 )
 
 type descriptorResolver struct {
 	methodDescriptors map[string]*desc.MethodDescriptor
+	messageTypes      proto_descriptor.MessageTypes
+	loaded            []string // the proto files that were loaded
+	skipped           []string // the proto files that couldn't be loaded
+}
+
+func newDescriptorResolver(protos *proto_descriptor.Protos) *descriptorResolver {
+	return &descriptorResolver{
+		methodDescriptors: protos.Methods,
+		messageTypes:      protos.Messages,
+		loaded:            protos.Loaded,
+		skipped:           protos.Skipped,
+	}
 }
 
 func (d *descriptorResolver) resolveEncoded(fullMethod string, message *internal.Message) (*desc.MessageDescriptor, error) {
@@ -34,26 +48,145 @@ func (d *descriptorResolver) resolve(fullMethod string, direction internal.Messa
 	return nil, fmt.Errorf("method not known")
 }
 
-func NewFileResolver(protoFileRoots ...string) (*descriptorResolver, error) {
-	descs, err := proto_descriptor.LoadProtoDirectories(protoFileRoots...)
+func (d *descriptorResolver) fileDescriptors() []*desc.FileDescriptor {
+	var files []*desc.FileDescriptor
+	seen := map[string]bool{}
+	for _, method := range d.methodDescriptors {
+		file := method.GetFile()
+		if !seen[file.GetName()] {
+			seen[file.GetName()] = true
+			files = append(files, file)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].GetName() < files[j].GetName()
+	})
+	return files
+}
+
+// NewFileResolver loads all .proto files found in the given roots.
+// Imports are also searched for in importPaths.
+func NewFileResolver(logger logrus.FieldLogger, importPaths []string, protoFileRoots ...string) (*descriptorResolver, error) {
+	r, err := loadFileResolver(logger, importPaths, protoFileRoots...)
 	if err != nil {
 		return nil, err
 	}
+	proto_descriptor.ReplaceMessageTypes(nil, r.messageTypes)
+	return r, nil
+}
 
-	return &descriptorResolver{
-		descs,
-	}, nil
+func loadFileResolver(logger logrus.FieldLogger, importPaths []string, protoFileRoots ...string) (*descriptorResolver, error) {
+	protos, err := proto_descriptor.LoadProtoDirectories(logger, importPaths, protoFileRoots...)
+	if err != nil {
+		return nil, err
+	}
+	return newDescriptorResolver(protos), nil
 }
 
 func NewDescriptorResolver(protoFileDescriptors ...string) (*descriptorResolver, error) {
-	descs, err := proto_descriptor.LoadProtoDescriptors(protoFileDescriptors...)
+	r, err := loadDescriptorResolver(protoFileDescriptors...)
 	if err != nil {
 		return nil, err
 	}
+	proto_descriptor.ReplaceMessageTypes(nil, r.messageTypes)
+	return r, nil
+}
 
-	return &descriptorResolver{
-		descs,
-	}, nil
+func loadDescriptorResolver(protoFileDescriptors ...string) (*descriptorResolver, error) {
+	protos, err := proto_descriptor.LoadProtoDescriptors(protoFileDescriptors...)
+	if err != nil {
+		return nil, err
+	}
+	return newDescriptorResolver(protos), nil
+}
+
+// LoadResolvers creates the resolvers for comma separated lists of
+// proto root directories, import paths and proto descriptor files (as taken by
+// the --proto_roots, --proto_import_paths and --proto_descriptors flags).
+// Their message types are used to resolve google.protobuf.Any fields.
+func LoadResolvers(logger logrus.FieldLogger, protoRoots, protoImportPaths, protoDescriptors string) ([]MessageResolver, error) {
+	resolvers, err := loadResolvers(logger, protoRoots, protoImportPaths, protoDescriptors)
+	if err != nil {
+		return nil, err
+	}
+	proto_descriptor.ReplaceMessageTypes(nil, messageTypes(resolvers))
+	return resolvers, nil
+}
+
+// loadResolvers is like LoadResolvers but leaves the message types in use unchanged
+func loadResolvers(logger logrus.FieldLogger, protoRoots, protoImportPaths, protoDescriptors string) ([]MessageResolver, error) {
+	var resolvers []MessageResolver
+	if protoRoots != "" {
+		var importPaths []string
+		if protoImportPaths != "" {
+			importPaths = strings.Split(protoImportPaths, ",")
+		}
+		r, err := loadFileResolver(logger, importPaths, strings.Split(protoRoots, ",")...)
+		if err != nil {
+			return nil, err
+		}
+		resolvers = append(resolvers, r)
+	}
+	if protoDescriptors != "" {
+		r, err := loadDescriptorResolver(strings.Split(protoDescriptors, ",")...)
+		if err != nil {
+			return nil, err
+		}
+		resolvers = append(resolvers, r)
+	}
+	return resolvers, nil
+}
+
+// messageTypes merges the message types of the loaded protos
+func messageTypes(resolvers []MessageResolver) proto_descriptor.MessageTypes {
+	types := proto_descriptor.MessageTypes{}
+	for _, resolver := range resolvers {
+		if r, ok := resolver.(*descriptorResolver); ok {
+			for name, mt := range r.messageTypes {
+				types[name] = mt
+			}
+		}
+	}
+	return types
+}
+
+// loadedFiles lists the proto files that the resolvers loaded
+func loadedFiles(resolvers []MessageResolver) []string {
+	var loaded []string
+	for _, resolver := range resolvers {
+		if r, ok := resolver.(*descriptorResolver); ok {
+			loaded = append(loaded, r.loaded...)
+		}
+	}
+	return loaded
+}
+
+// skippedFiles lists the proto files that the resolvers couldn't load
+func skippedFiles(resolvers []MessageResolver) []string {
+	var skipped []string
+	for _, resolver := range resolvers {
+		if r, ok := resolver.(*descriptorResolver); ok {
+			skipped = append(skipped, r.skipped...)
+		}
+	}
+	return skipped
+}
+
+// fileResolver is implemented by the resolvers that load proto files
+type fileResolver interface {
+	fileDescriptors() []*desc.FileDescriptor
+}
+
+// FileDescriptors returns the loaded proto files that define services
+// (their imports are available from each file's dependencies).
+func FileDescriptors(resolvers ...MessageResolver) []*desc.FileDescriptor {
+	var files []*desc.FileDescriptor
+	for _, resolver := range resolvers {
+		if fileResolver, ok := resolver.(fileResolver); ok {
+			files = append(files, fileResolver.fileDescriptors()...)
+		}
+	}
+	return files
 }
 
 var messageName = strings.NewReplacer(
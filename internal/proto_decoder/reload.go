@@ -0,0 +1,185 @@
+package proto_decoder
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bradleyjkemp/grpc-tools/internal"
+	"github.com/bradleyjkemp/grpc-tools/internal/proto_descriptor"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/sirupsen/logrus"
+)
+
+// ReloadableResolver resolves messages using the protos loaded from a set of
+// proto roots and descriptors. These can be reloaded while in use: the loaded
+// resolvers are swapped atomically so in-flight RPCs are unaffected.
+type ReloadableResolver struct {
+	logger           logrus.FieldLogger
+	protoRoots       string
+	protoImportPaths string
+	protoDescriptors string
+	reloadLock       sync.Mutex   // serialises reloads (e.g. by the watcher and the admin endpoint)
+	loaded           atomic.Value // *loadedProtos
+}
+
+// loadedProtos are the resolvers of a complete load of the protos
+type loadedProtos struct {
+	resolvers    []MessageResolver
+	messageTypes proto_descriptor.MessageTypes
+	files        map[string]bool // the proto files that were loaded
+}
+
+func NewReloadableResolver(logger logrus.FieldLogger, protoRoots, protoImportPaths, protoDescriptors string) (*ReloadableResolver, error) {
+	r := &ReloadableResolver{
+		logger:           logger,
+		protoRoots:       protoRoots,
+		protoImportPaths: protoImportPaths,
+		protoDescriptors: protoDescriptors,
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload parses all of the protos again. If this fails (including if any file
+// that loaded previously now fails to load) then the previously loaded protos
+// continue to be used. Otherwise both the resolvers and the message types used
+// for google.protobuf.Any fields are replaced, so types that have been removed
+// from the protos are no longer used.
+func (r *ReloadableResolver) Reload() error {
+	r.reloadLock.Lock()
+	defer r.reloadLock.Unlock()
+	resolvers, err := loadResolvers(r.logger, r.protoRoots, r.protoImportPaths, r.protoDescriptors)
+	if err != nil {
+		return err
+	}
+	previous, _ := r.loaded.Load().(*loadedProtos)
+	if previous != nil {
+		// a broken file would otherwise silently remove its services
+		// (files that never loaded, e.g. new or already broken ones, are skipped as usual)
+		var broken []string
+		for _, file := range skippedFiles(resolvers) {
+			if previous.files[file] {
+				broken = append(broken, file)
+			}
+		}
+		if len(broken) > 0 {
+			return fmt.Errorf("failed to load %s", strings.Join(broken, ", "))
+		}
+	}
+	loaded := &loadedProtos{
+		resolvers:    resolvers,
+		messageTypes: messageTypes(resolvers),
+		files:        map[string]bool{},
+	}
+	for _, file := range loadedFiles(resolvers) {
+		loaded.files[file] = true
+	}
+	var previousTypes proto_descriptor.MessageTypes
+	if previous != nil {
+		previousTypes = previous.messageTypes
+	}
+	proto_descriptor.ReplaceMessageTypes(previousTypes, loaded.messageTypes)
+	r.loaded.Store(loaded)
+	return nil
+}
+
+func (r *ReloadableResolver) resolvers() []MessageResolver {
+	return r.loaded.Load().(*loadedProtos).resolvers
+}
+
+func (r *ReloadableResolver) resolveEncoded(fullMethod string, message *internal.Message) (*desc.MessageDescriptor, error) {
+	err := fmt.Errorf("method not known")
+	for _, resolver := range r.resolvers() {
+		var descriptor *desc.MessageDescriptor
+		descriptor, err = resolver.resolveEncoded(fullMethod, message)
+		if err == nil {
+			return descriptor, nil
+		}
+	}
+	return nil, err
+}
+
+func (r *ReloadableResolver) resolveDecoded(fullMethod string, message *internal.Message) (*desc.MessageDescriptor, error) {
+	err := fmt.Errorf("method not known")
+	for _, resolver := range r.resolvers() {
+		var descriptor *desc.MessageDescriptor
+		descriptor, err = resolver.resolveDecoded(fullMethod, message)
+		if err == nil {
+			return descriptor, nil
+		}
+	}
+	return nil, err
+}
+
+func (r *ReloadableResolver) fileDescriptors() []*desc.FileDescriptor {
+	return FileDescriptors(r.resolvers()...)
+}
+
+// Watch polls the proto files for changes and reloads them whenever
+// a file is added, removed or modified. Call the returned function
+// to stop watching.
+func (r *ReloadableResolver) Watch(logger logrus.FieldLogger, interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		lastState := r.filesState()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			state := r.filesState()
+			if state == lastState {
+				continue
+			}
+			lastState = state
+			logger.Info("Proto files changed, reloading")
+			if err := r.Reload(); err != nil {
+				logger.WithError(err).Warn("Failed to reload protos, continuing to use previously loaded protos")
+			}
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
+
+// filesState summarises the name, size and modification time of all the proto files
+// so that changes can be detected by comparing it with a previous state.
+func (r *ReloadableResolver) filesState() string {
+	state := &strings.Builder{}
+	addFile := func(path string, info os.FileInfo) {
+		fmt.Fprintf(state, "%s:%d:%d\n", path, info.Size(), info.ModTime().UnixNano())
+	}
+	for _, dirs := range []string{r.protoRoots, r.protoImportPaths} {
+		if dirs == "" {
+			continue
+		}
+		for _, dir := range strings.Split(dirs, ",") {
+			_ = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+				if err == nil && filepath.Ext(path) == ".proto" {
+					addFile(path, info)
+				}
+				return nil
+			})
+		}
+	}
+	if r.protoDescriptors != "" {
+		for _, path := range strings.Split(r.protoDescriptors, ",") {
+			if info, err := os.Stat(path); err == nil {
+				addFile(path, info)
+			}
+		}
+	}
+	return state.String()
+}
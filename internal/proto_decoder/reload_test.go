@@ -0,0 +1,94 @@
+package proto_decoder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bradleyjkemp/grpc-tools/internal"
+	"github.com/bradleyjkemp/grpc-tools/internal/proto_descriptor"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testProtoV1 = `syntax = "proto3";
+package test;
+message Message {}
+service Service {
+    rpc Method(Message) returns (Message) {};
+}
+`
+	testProtoV2 = `syntax = "proto3";
+package test;
+message Message {}
+message NewMessage {}
+service Service {
+    rpc Method(Message) returns (Message) {};
+    rpc NewMethod(Message) returns (Message) {};
+}
+`
+)
+
+func TestReloadableResolver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proto_decoder")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	protoFile := filepath.Join(dir, "test.proto")
+	require.NoError(t, ioutil.WriteFile(protoFile, []byte(testProtoV1), 0644))
+
+	resolver, err := NewReloadableResolver(logrus.New(), dir, "", "")
+	require.NoError(t, err)
+	message := &internal.Message{MessageOrigin: internal.ClientMessage}
+	_, err = resolver.resolveEncoded("/test.Service/Method", message)
+	require.NoError(t, err)
+	_, err = resolver.resolveEncoded("/test.Service/NewMethod", message)
+	require.Error(t, err)
+
+	state := resolver.filesState()
+	require.NoError(t, ioutil.WriteFile(protoFile, []byte(testProtoV2), 0644))
+	require.NotEqual(t, state, resolver.filesState())
+
+	require.NoError(t, resolver.Reload())
+	_, err = resolver.resolveEncoded("/test.Service/NewMethod", message)
+	require.NoError(t, err)
+	require.Contains(t, proto_descriptor.LoadedMessageTypes(), "test.NewMessage")
+
+	// a broken proto fails the reload (even though other protos load) and the previous protos are still used
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "other.proto"), []byte("syntax = \"proto3\";\nmessage Other {}"), 0644))
+	require.NoError(t, ioutil.WriteFile(protoFile, []byte("syntax = \"proto3\";\nmessage Broken {"), 0644))
+	require.Error(t, resolver.Reload())
+	_, err = resolver.resolveEncoded("/test.Service/NewMethod", message)
+	require.NoError(t, err)
+	require.Contains(t, proto_descriptor.LoadedMessageTypes(), "test.NewMessage")
+	require.NotContains(t, proto_descriptor.LoadedMessageTypes(), "Other")
+
+	// removed message types are no longer used
+	require.NoError(t, ioutil.WriteFile(protoFile, []byte(testProtoV1), 0644))
+	require.NoError(t, resolver.Reload())
+	require.NotContains(t, proto_descriptor.LoadedMessageTypes(), "test.NewMessage")
+	require.Contains(t, proto_descriptor.LoadedMessageTypes(), "test.Message")
+}
+
+func TestReloadableResolverBrokenFromStart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proto_decoder")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	protoFile := filepath.Join(dir, "test.proto")
+	require.NoError(t, ioutil.WriteFile(protoFile, []byte(testProtoV1), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "broken.proto"), []byte("syntax = \"proto3\";\nmessage Broken {"), 0644))
+
+	// a file that never loaded doesn't stop the other files being reloaded
+	resolver, err := NewReloadableResolver(logrus.New(), dir, "", "")
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(protoFile, []byte(testProtoV2), 0644))
+	require.NoError(t, resolver.Reload())
+	message := &internal.Message{MessageOrigin: internal.ClientMessage}
+	_, err = resolver.resolveEncoded("/test.Service/NewMethod", message)
+	require.NoError(t, err)
+
+	// nor does a new broken file
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "new.proto"), []byte("syntax = \"proto3\";\nmessage New {"), 0644))
+	require.NoError(t, resolver.Reload())
+}
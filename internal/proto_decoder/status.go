@@ -0,0 +1,132 @@
+package proto_decoder
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bradleyjkemp/grpc-tools/internal"
+	"github.com/bradleyjkemp/grpc-tools/internal/proto_descriptor"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/any"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DecodeStatus converts an RPC error into its dumped form. The details of the
+// google.rpc.Status are decoded if their type is known: either one of the standard
+// error details (e.g. google.rpc.BadRequest) or a type from the loaded protos.
+func DecodeStatus(err error) *internal.Status {
+	if err == nil {
+		return nil
+	}
+	grpcStatus, _ := status.FromError(err)
+	decoded := &internal.Status{
+		Code:    grpcStatus.Code().String(),
+		Message: grpcStatus.Message(),
+	}
+	for _, detail := range grpcStatus.Proto().GetDetails() {
+		decodedDetail := &internal.StatusDetail{
+			TypeURL:  detail.GetTypeUrl(),
+			RawValue: detail.GetValue(),
+		}
+		if value, err := decodeDetail(detail); err == nil {
+			decodedDetail.Value = value
+		}
+		decoded.Details = append(decoded.Details, decodedDetail)
+	}
+	return decoded
+}
+
+func decodeDetail(detail *any.Any) (*dynamic.Message, error) {
+	descriptor, err := findMessageDescriptor(detail.GetTypeUrl())
+	if err != nil {
+		return nil, err
+	}
+	dyn := dynamic.NewMessage(descriptor)
+	if err := proto.Unmarshal(detail.GetValue(), dyn); err != nil {
+		return nil, err
+	}
+	return dyn, nil
+}
+
+// EncodeStatus converts a dumped status back into a gRPC status including its details.
+// Like messages, details are encoded from their human readable form if possible
+// falling back to the raw value.
+func EncodeStatus(dumped *internal.Status) (*status.Status, error) {
+	code, ok := codesByName[dumped.Code]
+	if !ok {
+		return nil, fmt.Errorf("unknown status code %s", dumped.Code)
+	}
+	encoded := &spb.Status{
+		Code:    int32(code),
+		Message: dumped.Message,
+	}
+	for _, detail := range dumped.Details {
+		value, err := encodeDetail(detail)
+		if err != nil {
+			return nil, err
+		}
+		encoded.Details = append(encoded.Details, &any.Any{
+			TypeUrl: detail.TypeURL,
+			Value:   value,
+		})
+	}
+	return status.FromProto(encoded), nil
+}
+
+func encodeDetail(detail *internal.StatusDetail) ([]byte, error) {
+	if detail.Value == nil {
+		if detail.RawValue == nil {
+			return nil, fmt.Errorf("no value available for detail %s: both Value and RawValue are nil", detail.TypeURL)
+		}
+		return detail.RawValue, nil
+	}
+
+	encoded, err := encodeDetailFromHumanReadable(detail)
+	if err != nil {
+		if detail.RawValue != nil {
+			return detail.RawValue, nil
+		}
+		return nil, err
+	}
+	return encoded, nil
+}
+
+func encodeDetailFromHumanReadable(detail *internal.StatusDetail) ([]byte, error) {
+	descriptor, err := findMessageDescriptor(detail.TypeURL)
+	if err != nil {
+		return nil, err
+	}
+	return encodeFromJSON(descriptor, detail.Value)
+}
+
+// finds the descriptor for a google.protobuf.Any type URL from either
+// the loaded protos or the types compiled into this binary
+func findMessageDescriptor(typeURL string) (*desc.MessageDescriptor, error) {
+	name := typeURL[strings.LastIndex(typeURL, "/")+1:]
+
+	if descriptor, ok := proto_descriptor.LoadedMessageTypes()[name]; ok {
+		return descriptor, nil
+	}
+
+	descriptor, err := desc.LoadMessageDescriptor(name)
+	if err != nil {
+		return nil, err
+	}
+	if descriptor == nil {
+		return nil, fmt.Errorf("unknown message type %s", name)
+	}
+	return descriptor, nil
+}
+
+// maps the string form of status codes (as used in dumps) back to the code
+var codesByName = map[string]codes.Code{}
+
+func init() {
+	for code := codes.OK; code <= codes.Unauthenticated; code++ {
+		codesByName[code.String()] = code
+	}
+}
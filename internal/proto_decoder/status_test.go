@@ -0,0 +1,55 @@
+package proto_decoder
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/bradleyjkemp/grpc-tools/internal"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestStatusRoundTrip(t *testing.T) {
+	original, err := status.New(codes.InvalidArgument, "bad request").WithDetails(&errdetails.BadRequest{
+		FieldViolations: []*errdetails.BadRequest_FieldViolation{
+			{Field: "name", Description: "must not be empty"},
+		},
+	})
+	require.NoError(t, err)
+
+	decoded := DecodeStatus(original.Err())
+	require.Equal(t, "InvalidArgument", decoded.Code)
+	require.Len(t, decoded.Details, 1)
+	require.Equal(t, "type.googleapis.com/google.rpc.BadRequest", decoded.Details[0].TypeURL)
+	require.NotNil(t, decoded.Details[0].Value)
+
+	// round trip through JSON as the fixture would when reading a dump
+	dumped, err := json.Marshal(decoded.Details[0].Value)
+	require.NoError(t, err)
+	var value interface{}
+	require.NoError(t, json.Unmarshal(dumped, &value))
+	decoded.Details[0].Value = value
+	decoded.Details[0].RawValue = nil
+
+	encoded, err := EncodeStatus(decoded)
+	require.NoError(t, err)
+	require.True(t, proto.Equal(original.Proto(), encoded.Proto()))
+}
+
+func TestStatusUnknownDetail(t *testing.T) {
+	decoded := &internal.Status{
+		Code:    "NotFound",
+		Message: "missing",
+		Details: []*internal.StatusDetail{{
+			TypeURL:  "type.googleapis.com/unknown.Detail",
+			RawValue: []byte{0x08, 0x01},
+		}},
+	}
+	encoded, err := EncodeStatus(decoded)
+	require.NoError(t, err)
+	require.Equal(t, codes.NotFound, encoded.Code())
+	require.Equal(t, []byte{0x08, 0x01}, encoded.Proto().GetDetails()[0].GetValue())
+}
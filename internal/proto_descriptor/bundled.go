@@ -0,0 +1,25 @@
+package proto_descriptor
+
+import (
+	"github.com/jhump/protoreflect/desc"
+
+	// Commonly imported googleapis protos are compiled into the binary
+	// so that imports of them always resolve (even when users don't have
+	// the googleapis sources available).
+	_ "google.golang.org/genproto/googleapis/api/annotations"
+	_ "google.golang.org/genproto/googleapis/api/httpbody"
+	_ "google.golang.org/genproto/googleapis/longrunning"
+	_ "google.golang.org/genproto/googleapis/rpc/code"
+	_ "google.golang.org/genproto/googleapis/rpc/errdetails"
+	_ "google.golang.org/genproto/googleapis/rpc/status"
+	_ "google.golang.org/genproto/googleapis/type/date"
+	_ "google.golang.org/genproto/googleapis/type/latlng"
+	_ "google.golang.org/genproto/googleapis/type/money"
+	_ "google.golang.org/genproto/googleapis/type/timeofday"
+)
+
+// lookupBundledImport returns the descriptor for a proto file compiled into
+// this binary (the well-known types and the googleapis protos imported above).
+func lookupBundledImport(filename string) (*desc.FileDescriptor, error) {
+	return desc.LoadFileDescriptor(filename)
+}
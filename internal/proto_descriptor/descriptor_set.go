@@ -0,0 +1,126 @@
+package proto_descriptor
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	dpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"github.com/jhump/protoreflect/desc"
+)
+
+// loadDescriptorFile reads a file containing a set of file descriptors in any of the supported formats:
+// * FileDescriptorSet as output by protoc --descriptor_set_out (with or without --include_imports)
+// * buf images (as output by buf build -o) in either binary or JSON form
+// Both formats may optionally be gzip compressed.
+func loadDescriptorFile(path string) ([]*desc.FileDescriptor, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.HasPrefix(contents, gzipMagic) {
+		reader, err := gzip.NewReader(bytes.NewReader(contents))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress %s: %v", path, err)
+		}
+		contents, err = ioutil.ReadAll(reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress %s: %v", path, err)
+		}
+	}
+
+	// A buf image is wire compatible with a FileDescriptorSet:
+	// each ImageFile is a FileDescriptorProto with an extra (unknown to us) field.
+	fileSet := &dpb.FileDescriptorSet{}
+	if trimmed := bytes.TrimSpace(contents); len(trimmed) > 0 && trimmed[0] == '{' {
+		unmarshaler := jsonpb.Unmarshaler{AllowUnknownFields: true}
+		err = unmarshaler.Unmarshal(bytes.NewReader(trimmed), fileSet)
+	} else {
+		err = proto.Unmarshal(contents, fileSet)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s as a descriptor set or buf image: %v", path, err)
+	}
+
+	return linkDescriptorSet(fileSet)
+}
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// linkDescriptorSet converts all of the files in the set into descriptors.
+// Imports that are missing from the set (i.e. protoc was run without --include_imports)
+// are resolved from the descriptors compiled into this binary (e.g. the well-known types).
+func linkDescriptorSet(fileSet *dpb.FileDescriptorSet) ([]*desc.FileDescriptor, error) {
+	files := map[string]*dpb.FileDescriptorProto{}
+	for _, file := range fileSet.GetFile() {
+		files[file.GetName()] = file
+	}
+
+	linked := map[string]*desc.FileDescriptor{}
+	var descriptors []*desc.FileDescriptor
+	for _, file := range fileSet.GetFile() {
+		descriptor, err := linkFile(file.GetName(), files, linked, nil)
+		if err != nil {
+			return nil, err
+		}
+		descriptors = append(descriptors, descriptor)
+	}
+	return descriptors, nil
+}
+
+func linkFile(name string, files map[string]*dpb.FileDescriptorProto, linked map[string]*desc.FileDescriptor, seen []string) (*desc.FileDescriptor, error) {
+	if descriptor, ok := linked[name]; ok {
+		return descriptor, nil
+	}
+	for _, s := range seen {
+		if s == name {
+			return nil, fmt.Errorf("cycle in imports: %s -> %s", strings.Join(seen, " -> "), name)
+		}
+	}
+
+	file, ok := files[name]
+	if !ok {
+		// not included in the set so try the descriptors registered in this binary
+		descriptor, err := desc.LoadFileDescriptor(name)
+		if err != nil {
+			return nil, fmt.Errorf("import %s is missing from the descriptor set (try using protoc --include_imports): %v", name, err)
+		}
+		linked[name] = descriptor
+		return descriptor, nil
+	}
+
+	var deps []*desc.FileDescriptor
+	for _, dep := range file.GetDependency() {
+		descriptor, err := linkFile(dep, files, linked, append(seen, name))
+		if err != nil {
+			return nil, err
+		}
+		deps = append(deps, descriptor)
+	}
+
+	descriptor, err := desc.CreateFileDescriptor(file, deps...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to link %s: %v", name, err)
+	}
+	linked[name] = descriptor
+	return descriptor, nil
+}
+
+// loadDescriptor loads the descriptors from a file on disk, or if the
+// path does not exist, looks up a file descriptor registered in this binary.
+func loadDescriptor(path string) ([]*desc.FileDescriptor, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		descriptor, err := desc.LoadFileDescriptor(path)
+		if err != nil {
+			return nil, err
+		}
+		return []*desc.FileDescriptor{descriptor}, nil
+	}
+	return loadDescriptorFile(path)
+}
@@ -0,0 +1,84 @@
+package proto_descriptor
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	dpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"github.com/jhump/protoreflect/desc/protoparse"
+	"github.com/stretchr/testify/require"
+)
+
+const testProto = `syntax = "proto3";
+package test;
+import "google/protobuf/timestamp.proto";
+
+message Request {
+    google.protobuf.Timestamp time = 1;
+}
+
+service TestService {
+    rpc Method(Request) returns (Request) {};
+}
+`
+
+func testDescriptorSet(t *testing.T) *dpb.FileDescriptorSet {
+	parser := protoparse.Parser{
+		Accessor: func(filename string) (io.ReadCloser, error) {
+			if filename != "test.proto" {
+				// fallback to the built-in well-known types
+				return nil, os.ErrNotExist
+			}
+			return ioutil.NopCloser(strings.NewReader(testProto)), nil
+		},
+	}
+	fds, err := parser.ParseFiles("test.proto")
+	require.NoError(t, err)
+
+	// the same as protoc without --include_imports
+	return &dpb.FileDescriptorSet{
+		File: []*dpb.FileDescriptorProto{fds[0].AsFileDescriptorProto()},
+	}
+}
+
+func TestLoadProtoDescriptors(t *testing.T) {
+	fileSet := testDescriptorSet(t)
+	binary, err := proto.Marshal(fileSet)
+	require.NoError(t, err)
+	json, err := (&jsonpb.Marshaler{}).MarshalToString(fileSet)
+	require.NoError(t, err)
+	gzipped := &bytes.Buffer{}
+	gzipWriter := gzip.NewWriter(gzipped)
+	_, err = gzipWriter.Write(binary)
+	require.NoError(t, err)
+	require.NoError(t, gzipWriter.Close())
+
+	dir, err := ioutil.TempDir("", "proto_descriptor")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for name, contents := range map[string][]byte{
+		"test.protoset": binary,
+		"image.json":    []byte(json),
+		"image.bin.gz":  gzipped.Bytes(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+			require.NoError(t, ioutil.WriteFile(path, contents, 0644))
+
+			protos, err := LoadProtoDescriptors(path)
+			require.NoError(t, err)
+			method := protos.Methods["/test.TestService/Method"]
+			require.NotNil(t, method)
+			require.Equal(t, "google.protobuf.Timestamp", method.GetInputType().GetFields()[0].GetMessageType().GetFullyQualifiedName())
+		})
+	}
+}
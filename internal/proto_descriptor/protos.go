@@ -4,79 +4,159 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/jhump/protoreflect/desc"
 	"github.com/jhump/protoreflect/desc/protoparse"
+	"github.com/sirupsen/logrus"
 )
 
-func LoadProtoDescriptors(descriptorPaths ...string) (map[string]*desc.MethodDescriptor, error) {
+// Protos are the services and message types loaded from a set of proto files or descriptor sets
+type Protos struct {
+	// the methods of the services by gRPC method name (/package.Service/Method)
+	Methods  map[string]*desc.MethodDescriptor
+	Messages MessageTypes
+	// the proto files that were loaded from the proto roots
+	Loaded []string
+	// the proto files that were skipped because they failed to parse or had unresolved imports
+	Skipped []string
+}
+
+func newProtos(files []*desc.FileDescriptor) *Protos {
+	protos := &Protos{
+		Methods:  convertDescriptorsToMap(files),
+		Messages: MessageTypes{},
+	}
+	for _, file := range files {
+		protos.Messages.add(file)
+	}
+	return protos
+}
+
+// loads descriptor set files (protoset or buf image) containing gRPC service or message definitions
+func LoadProtoDescriptors(descriptorPaths ...string) (*Protos, error) {
 	descriptors := []*desc.FileDescriptor{}
 	for _, path := range descriptorPaths {
-		descriptor, err := desc.LoadFileDescriptor(path)
+		fileDescs, err := loadDescriptor(path)
 		if err != nil {
 			return nil, err
 		}
-		descriptors = append(descriptors, descriptor)
+		descriptors = append(descriptors, fileDescs...)
 	}
 
-	return convertDescriptorsToMap(descriptors), nil
+	return newProtos(descriptors), nil
 }
 
-type MessageDesc struct {
-	Desc map[string]*desc.MessageDescriptor
-	sync.Mutex
+// MessageTypes maps the fully qualified names of message types (including nested ones) to their descriptors
+type MessageTypes map[string]*desc.MessageDescriptor
+
+func (m MessageTypes) add(fileDesc *desc.FileDescriptor) {
+	var add func(mts []*desc.MessageDescriptor)
+	add = func(mts []*desc.MessageDescriptor) {
+		for _, mt := range mts {
+			m[mt.GetFullyQualifiedName()] = mt
+			add(mt.GetNestedMessageTypes())
+		}
+	}
+	add(fileDesc.GetMessageTypes())
 }
 
-var MsgDesc = MessageDesc{Desc: make(map[string]*desc.MessageDescriptor, 0)}
+var (
+	messageTypesLock sync.Mutex   // serialises updates of messageTypes
+	messageTypes     atomic.Value // MessageTypes, never modified once stored
+)
+
+// LoadedMessageTypes returns the message types of all the protos in use. These are
+// used to resolve google.protobuf.Any fields. The returned map must not be modified.
+func LoadedMessageTypes() MessageTypes {
+	loaded, _ := messageTypes.Load().(MessageTypes)
+	return loaded
+}
+
+// ReplaceMessageTypes removes the previous message types (e.g. those of protos that
+// have since been reloaded) from the ones in use and adds the new ones.
+// The change is made with a single store so readers never see a mix of the two.
+func ReplaceMessageTypes(previous, types MessageTypes) {
+	messageTypesLock.Lock()
+	defer messageTypesLock.Unlock()
+	replaced := MessageTypes{}
+	for name, mt := range LoadedMessageTypes() {
+		if previous[name] != mt {
+			replaced[name] = mt
+		}
+	}
+	for name, mt := range types {
+		replaced[name] = mt
+	}
+	messageTypes.Store(replaced)
+}
 
 // recursively walks through all files in the given directories and
-// finds .proto files that contains service definitions
-func LoadProtoDirectories(roots ...string) (map[string]*desc.MethodDescriptor, error) {
-	var servicesFiles []*desc.FileDescriptor
+// loads all .proto files. Imports are resolved relative to the roots,
+// then the extra import paths, then any parent directory of the importing
+// file and finally the bundled common protos.
+// Files without service definitions are loaded so that their messages
+// can be used to decode google.protobuf.Any fields. Files (or directories)
+// that can't be read or parsed are skipped with a warning.
+func LoadProtoDirectories(logger logrus.FieldLogger, importPaths []string, roots ...string) (*Protos, error) {
+	var files []*desc.FileDescriptor
+	var loaded, skipped []string
+	unresolved := unresolvedImports{}
 
+	allImportPaths := append(append([]string{}, roots...), importPaths...)
 	parser := protoparse.Parser{
-		ImportPaths:      roots,
+		ImportPaths:      allImportPaths,
 		InferImportPaths: true, // attempt to be clever
+		LookupImport:     lookupBundledImport,
 	}
 
-	// scan all roots for .proto files containing gRPC service definitions
 	for _, root := range roots {
 		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
-			if filepath.Ext(path) == ".proto" {
-				relpath, err := filepath.Rel(root, path)
-				if err != nil {
-					return err
-				}
-				descs, err := parser.ParseFilesButDoNotLink(path)
-				if err != nil {
-					// oh well we won't worry though
-					fmt.Fprintf(os.Stderr, "Skipping %s due to parse error %s", path, err)
-					return nil
-				}
-				fileDescs, err := parser.ParseFiles(relpath)
-				for _, fileDesc := range fileDescs {
-					for _, mt := range fileDesc.GetMessageTypes() {
-						MsgDesc.Lock()
-						MsgDesc.Desc[mt.GetFullyQualifiedName()] = mt
-						MsgDesc.Unlock()
-					}
-				}
-				if len(descs[0].Service) > 0 {
-					// this file is interesting so
-					fileDesc, err := parser.ParseFiles(relpath)
-					if err != nil {
-						fmt.Fprintf(os.Stderr, "Skipping %s due to parse error %s", path, err)
-						return nil
-					}
-					servicesFiles = append(servicesFiles, fileDesc[0])
-					for _, smt := range fileDesc[0].GetMessageTypes() {
-						MsgDesc.Lock()
-						MsgDesc.Desc[smt.GetFullyQualifiedName()] = smt
-						MsgDesc.Unlock()
-					}
+			if err != nil {
+				// e.g. an unreadable directory, the rest of the protos can still be loaded
+				logger.WithError(err).Warnf("Skipping %s as it couldn't be read", path)
+				return nil
+			}
+			if filepath.Ext(path) != ".proto" {
+				return nil
+			}
+			relpath, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+
+			unlinked, err := parser.ParseFilesButDoNotLink(path)
+			if err != nil {
+				// oh well we won't worry though
+				logger.WithError(err).Warnf("Skipping %s due to parse error", path)
+				skipped = append(skipped, path)
+				return nil
+			}
+			var missing []string
+			for _, imp := range findUnresolvedImports(unlinked[0].GetDependency(), parser.ImportPaths) {
+				if importPath, ok := inferImportPath(root, path, imp); ok {
+					parser.ImportPaths = append(parser.ImportPaths, importPath)
+					continue
 				}
+				missing = append(missing, imp)
 			}
+			if len(missing) > 0 {
+				unresolved.add(relpath, missing)
+				skipped = append(skipped, path)
+				return nil
+			}
+
+			fileDescs, err := parser.ParseFiles(relpath)
+			if err != nil {
+				logger.WithError(err).Warnf("Skipping %s due to parse error", path)
+				skipped = append(skipped, path)
+				return nil
+			}
+			files = append(files, fileDescs[0])
+			loaded = append(loaded, path)
 			return nil
 		})
 		if err != nil {
@@ -84,11 +164,77 @@ func LoadProtoDirectories(roots ...string) (map[string]*desc.MethodDescriptor, e
 		}
 	}
 
-	if len(servicesFiles) == 0 {
-		return nil, fmt.Errorf("no service definitions found")
+	if len(unresolved) > 0 {
+		logger.Warn(strings.TrimSuffix(unresolved.report(), "\n"))
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no proto files could be loaded from %s", strings.Join(roots, ", "))
 	}
 
-	return convertDescriptorsToMap(servicesFiles), nil
+	protos := newProtos(files)
+	protos.Loaded = loaded
+	protos.Skipped = skipped
+	return protos, nil
+}
+
+// maps each import that couldn't be found to the files that import it
+type unresolvedImports map[string][]string
+
+func (u unresolvedImports) add(file string, imports []string) {
+	for _, imp := range imports {
+		u[imp] = append(u[imp], file)
+	}
+}
+
+func (u unresolvedImports) report() string {
+	var imports []string
+	for imp := range u {
+		imports = append(imports, imp)
+	}
+	sort.Strings(imports)
+
+	report := &strings.Builder{}
+	fmt.Fprintln(report, "The following imports could not be resolved (use --proto_import_paths to add the directories containing them):")
+	for _, imp := range imports {
+		fmt.Fprintf(report, "  %s (imported by %s)\n", imp, strings.Join(u[imp], ", "))
+	}
+	return report.String()
+}
+
+func findUnresolvedImports(imports []string, importPaths []string) []string {
+	var missing []string
+Imports:
+	for _, imp := range imports {
+		for _, importPath := range importPaths {
+			if _, err := os.Stat(filepath.Join(importPath, imp)); err == nil {
+				continue Imports
+			}
+		}
+		if _, err := lookupBundledImport(imp); err == nil {
+			continue
+		}
+		if strings.HasPrefix(imp, "google/protobuf/") {
+			// the well-known types are built in to the parser
+			continue
+		}
+		missing = append(missing, imp)
+	}
+	return missing
+}
+
+// inferImportPath finds the directory (between the file's own directory and the root)
+// that an import of the file is relative to. This allows roots to contain protos
+// that are compiled with a different include path (e.g. protoc -I proto).
+func inferImportPath(root, file, imp string) (string, bool) {
+	root = filepath.Clean(root)
+	for dir := filepath.Dir(file); ; dir = filepath.Dir(dir) {
+		if _, err := os.Stat(filepath.Join(dir, imp)); err == nil {
+			return dir, true
+		}
+		if dir == root || dir == filepath.Dir(dir) {
+			return "", false
+		}
+	}
 }
 
 func convertDescriptorsToMap(descs []*desc.FileDescriptor) map[string]*desc.MethodDescriptor {
@@ -0,0 +1,122 @@
+package proto_descriptor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+)
+
+var testProtoFiles = map[string]string{
+	"service/service.proto": `syntax = "proto3";
+package test.service;
+import "google/api/annotations.proto";
+import "google/rpc/status.proto";
+import "shared/shared.proto";
+
+service Service {
+    rpc Method(test.shared.Shared) returns (google.rpc.Status) {
+        option (google.api.http) = { get: "/method" };
+    };
+}
+`,
+	"messages/messages.proto": `syntax = "proto3";
+package test.messages;
+
+message Outer {
+    message Nested {
+        string value = 1;
+    }
+}
+`,
+	"broken/broken.proto": `syntax = "proto3";
+package test.broken;
+import "does/not/exist.proto";
+`,
+	"imports/shared/shared.proto": `syntax = "proto3";
+package test.shared;
+
+message Shared {}
+`,
+}
+
+func TestLoadProtoDirectories(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proto_descriptor")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	for name, contents := range testProtoFiles {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, ioutil.WriteFile(path, []byte(contents), 0644))
+	}
+
+	logger, hook := test.NewNullLogger()
+	protos, err := LoadProtoDirectories(
+		logger,
+		[]string{filepath.Join(dir, "imports")},
+		filepath.Join(dir, "service"),
+		filepath.Join(dir, "messages"),
+		filepath.Join(dir, "broken"),
+		// a root that can't be read doesn't stop the others loading
+		filepath.Join(dir, "missing"),
+	)
+	require.NoError(t, err)
+	require.Contains(t, protos.Methods, "/test.service.Service/Method")
+	require.Contains(t, protos.Messages, "test.messages.Outer.Nested")
+	require.Equal(t, []string{filepath.Join(dir, "broken", "broken.proto")}, protos.Skipped)
+
+	// the skipped files are logged
+	var warnings []string
+	for _, entry := range hook.AllEntries() {
+		require.Equal(t, logrus.WarnLevel, entry.Level)
+		warnings = append(warnings, entry.Message)
+	}
+	require.Len(t, warnings, 2)
+	require.Equal(t, "Skipping "+filepath.Join(dir, "missing")+" as it couldn't be read", warnings[0])
+	require.Contains(t, warnings[1], "does/not/exist.proto (imported by broken.proto)")
+}
+
+func TestUnresolvedImportsReport(t *testing.T) {
+	unresolved := unresolvedImports{}
+	unresolved.add("a.proto", []string{"missing.proto"})
+	unresolved.add("b.proto", []string{"missing.proto", "other.proto"})
+	require.Equal(t, `The following imports could not be resolved (use --proto_import_paths to add the directories containing them):
+  missing.proto (imported by a.proto, b.proto)
+  other.proto (imported by b.proto)
+`, unresolved.report())
+}
+
+func TestLoadProtoDirectoriesInfersImportPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proto_descriptor")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	// the protos are compiled with -I proto but the root is the directory above
+	files := map[string]string{
+		"proto/api/service.proto": `syntax = "proto3";
+package test.inferred;
+import "api/messages.proto";
+
+service Inferred {
+    rpc Method(Request) returns (Request);
+}
+`,
+		"proto/api/messages.proto": `syntax = "proto3";
+package test.inferred;
+
+message Request {}
+`,
+	}
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, ioutil.WriteFile(path, []byte(contents), 0644))
+	}
+
+	protos, err := LoadProtoDirectories(logrus.New(), nil, dir)
+	require.NoError(t, err)
+	require.Contains(t, protos.Methods, "/test.inferred.Inferred/Method")
+}
@@ -4,6 +4,7 @@ package proxydialer
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
 	"encoding/base64"
 	"errors"
 	"fmt"
@@ -13,6 +14,9 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
 )
 
 const grpcUA = "grpc-go/" + grpc.Version
@@ -118,37 +122,128 @@ func doHTTPConnectHandshake(ctx context.Context, conn net.Conn, backendAddr stri
 
 // newProxyDialer returns a dialer that connects to proxy first if necessary.
 // The returned dialer checks if a proxy is necessary, dial to the proxy with the
-// provided dialer, does HTTP CONNECT handshake and returns the connection.
+// provided dialer, does HTTP CONNECT (or SOCKS5) handshake and returns the connection.
+// Proxies can be http://, https:// (TLS to the proxy itself), socks5:// or socks5h://
+// URLs optionally with a user:password@ for authentication.
 func NewProxyDialer(proxyFunc httpProxyFunc) func(context.Context, string) (net.Conn, error) {
-	dialer := func(ctx context.Context, addr string) (net.Conn, error) {
-		network, addr := parseDialTarget(addr)
-		return (&net.Dialer{}).DialContext(ctx, network, addr)
-	}
+	dialer := DialTarget
 
 	return func(ctx context.Context, addr string) (conn net.Conn, err error) {
-		var newAddr string
+		if IsUnixTarget(addr) {
+			// local sockets are never proxied
+			return dialer(ctx, addr)
+		}
+
 		proxyURL, err := mapAddress(ctx, proxyFunc, addr)
+		if err == errDisabled {
+			return dialer(ctx, addr)
+		}
 		if err != nil {
-			if err != errDisabled {
+			return nil, err
+		}
+		proxyAddr := proxyAddress(proxyURL)
+
+		switch proxyURL.Scheme {
+		case "socks5", "socks5h":
+			var auth *proxy.Auth
+			if proxyURL.User != nil {
+				password, _ := proxyURL.User.Password()
+				auth = &proxy.Auth{User: proxyURL.User.Username(), Password: password}
+			}
+			socksDialer, err := proxy.SOCKS5("tcp", proxyAddr, auth, contextDialer(dialer))
+			if err != nil {
 				return nil, err
 			}
-			newAddr = addr
-		} else {
-			newAddr = proxyURL.Host
-		}
+			if proxyURL.Scheme == "socks5" {
+				// only socks5h:// proxies resolve the destination's hostname
+				addr, err = resolveAddress(ctx, addr)
+				if err != nil {
+					return nil, err
+				}
+			}
+			return socksDialer.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
 
-		conn, err = dialer(ctx, newAddr)
-		if err != nil {
-			return
-		}
-		if proxyURL != nil {
-			// proxy is disabled if proxyURL is nil.
-			conn, err = doHTTPConnectHandshake(ctx, conn, addr, proxyURL)
+		case "https":
+			conn, err = dialer(ctx, proxyAddr)
+			if err != nil {
+				return nil, err
+			}
+			tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+			return withDeadline(ctx, tlsConn, func() (net.Conn, error) {
+				if err := tlsConn.Handshake(); err != nil {
+					conn.Close()
+					return nil, fmt.Errorf("TLS handshake with proxy %s failed: %v", proxyAddr, err)
+				}
+				return doHTTPConnectHandshake(ctx, tlsConn, addr, proxyURL)
+			})
+
+		default:
+			conn, err = dialer(ctx, proxyAddr)
+			if err != nil {
+				return nil, err
+			}
+			return withDeadline(ctx, conn, func() (net.Conn, error) {
+				return doHTTPConnectHandshake(ctx, conn, addr, proxyURL)
+			})
 		}
-		return
 	}
 }
 
+// withDeadline applies the context's deadline (if any) to a connection during a handshake
+func withDeadline(ctx context.Context, conn net.Conn, handshake func() (net.Conn, error)) (net.Conn, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	tunnel, err := handshake()
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return tunnel, nil
+}
+
+// resolveAddress replaces the hostname of a host:port with its IP address
+func resolveAddress(ctx context.Context, addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if net.ParseIP(host) != nil {
+		return addr, nil
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(ips[0].IP.String(), port), nil
+}
+
+// proxyAddress adds the default port for the proxy's scheme if it has none
+func proxyAddress(proxyURL *url.URL) string {
+	if proxyURL.Port() != "" {
+		return proxyURL.Host
+	}
+	switch proxyURL.Scheme {
+	case "https":
+		return net.JoinHostPort(proxyURL.Hostname(), "443")
+	case "socks5", "socks5h":
+		return net.JoinHostPort(proxyURL.Hostname(), "1080")
+	default:
+		return net.JoinHostPort(proxyURL.Hostname(), "80")
+	}
+}
+
+// contextDialer adapts a dial function for use by golang.org/x/net/proxy
+type contextDialer func(context.Context, string) (net.Conn, error)
+
+func (d contextDialer) Dial(network, addr string) (net.Conn, error) {
+	return d(context.Background(), addr)
+}
+
+func (d contextDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return d(ctx, addr)
+}
+
 func sendHTTPRequest(ctx context.Context, req *http.Request, conn net.Conn) error {
 	req = req.WithContext(ctx)
 	if err := req.Write(conn); err != nil {
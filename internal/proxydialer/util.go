@@ -1,16 +1,40 @@
 package proxydialer
 
 import (
+	"context"
+	"net"
 	"net/url"
 	"strings"
 )
 
+const unixAbstractScheme = "unix-abstract"
+
+// IsUnixTarget checks whether a dial target is a unix domain socket
+// (either unix:path, unix:///path or unix-abstract:name)
+func IsUnixTarget(target string) bool {
+	network, _ := parseDialTarget(target)
+	return network == "unix"
+}
+
+// DialTarget connects directly to a dial target: either a host:port
+// or a unix domain socket (as accepted by IsUnixTarget)
+func DialTarget(ctx context.Context, target string) (net.Conn, error) {
+	network, addr := parseDialTarget(target)
+	return (&net.Dialer{}).DialContext(ctx, network, addr)
+}
+
 // Copied from google.golang.org/grpc/rpc_util.go
 
 // parseDialTarget returns the network and address to pass to dialer
+// (with additional support for unix-abstract:name targets)
 func parseDialTarget(target string) (net string, addr string) {
 	net = "tcp"
 
+	if strings.HasPrefix(target, unixAbstractScheme+":") {
+		// abstract sockets are addressed with a leading @ by package net
+		return "unix", "@" + strings.TrimPrefix(target, unixAbstractScheme+":")
+	}
+
 	m1 := strings.Index(target, ":")
 	m2 := strings.Index(target, ":/")
 
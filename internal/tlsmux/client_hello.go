@@ -0,0 +1,409 @@
+package tlsmux
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bradleyjkemp/grpc-tools/internal"
+	"github.com/bradleyjkemp/grpc-tools/internal/connstate"
+)
+
+// This file captures the ClientHello of intercepted connections
+// so that the client's TLS configuration can be recorded along with
+// JA3 (https://github.com/salesforce/ja3) and JA4 (https://github.com/FoxIO-LLC/ja4)
+// fingerprints identifying the TLS library used.
+
+const (
+	recordTypeHandshake      = 22
+	handshakeTypeClientHello = 1
+
+	extensionServerName          = 0x0000
+	extensionSupportedGroups     = 0x000a
+	extensionPointFormats        = 0x000b
+	extensionSignatureAlgorithms = 0x000d
+	extensionALPN                = 0x0010
+	extensionSupportedVersions   = 0x002b
+
+	// ClientHellos are never this large in practice (even with post-quantum key shares)
+	maxClientHelloSize = 64 * 1024
+)
+
+// clientHello is the subset of a ClientHello needed for fingerprinting
+type clientHello struct {
+	version             uint16
+	cipherSuites        []uint16
+	extensions          []uint16
+	serverName          string
+	alpn                []string
+	supportedGroups     []uint16
+	pointFormats        []uint8
+	signatureAlgorithms []uint16
+	supportedVersions   []uint16
+}
+
+// recordingConn records the bytes read from a connection until stopped
+type recordingConn struct {
+	net.Conn
+	recorded  bytes.Buffer
+	recording bool
+}
+
+func newRecordingConn(conn net.Conn) *recordingConn {
+	return &recordingConn{Conn: conn, recording: true}
+}
+
+func (c *recordingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if c.recording && c.recorded.Len() < maxClientHelloSize {
+		c.recorded.Write(b[:n])
+	}
+	return n, err
+}
+
+// stop stops recording and returns the bytes read so far
+func (c *recordingConn) stop() []byte {
+	c.recording = false
+	return c.recorded.Bytes()
+}
+
+// recordHandshake records the handshake of a connection in its state
+// (connections are passed on as *tls.Conn so that net/http can negotiate HTTP/2
+// which means they can't carry the handshake themselves)
+func recordHandshake(conn *recordingConn, state tls.ConnectionState) {
+	if connState := connstate.FromConn(conn); connState != nil {
+		connState.TLS = newHandshake(conn.stop(), state)
+	}
+}
+
+func newHandshake(recorded []byte, state tls.ConnectionState) *internal.TLSHandshake {
+	handshake := &internal.TLSHandshake{
+		ServerName:         state.ServerName,
+		NegotiatedProtocol: state.NegotiatedProtocol,
+		Version:            versionName(state.Version),
+		CipherSuite:        cipherSuiteName(state.CipherSuite),
+	}
+	hello, err := parseClientHello(recorded)
+	if err != nil {
+		// the handshake succeeded so this shouldn't happen
+		return handshake
+	}
+	handshake.ALPN = hello.alpn
+	handshake.JA3String = hello.ja3String()
+	handshake.JA3 = fmt.Sprintf("%x", md5.Sum([]byte(handshake.JA3String)))
+	handshake.JA4 = hello.ja4()
+	return handshake
+}
+
+// parseClientHello parses the ClientHello from the start of a TLS connection
+func parseClientHello(data []byte) (*clientHello, error) {
+	// the handshake message may be split across several records
+	var message []byte
+	for len(data) >= 5 && data[0] == recordTypeHandshake {
+		length := int(binary.BigEndian.Uint16(data[3:5]))
+		if len(data) < 5+length {
+			break
+		}
+		message = append(message, data[5:5+length]...)
+		data = data[5+length:]
+		if len(message) >= 4 && len(message) >= 4+int(uint24(message[1:4])) {
+			break
+		}
+	}
+	if len(message) < 4 || message[0] != handshakeTypeClientHello {
+		return nil, errors.New("connection didn't start with a ClientHello")
+	}
+	body := &reader{data: message[4:]}
+	if len(body.data) > int(uint24(message[1:4])) {
+		body.data = body.data[:uint24(message[1:4])]
+	}
+
+	hello := &clientHello{version: body.uint16()}
+	body.skip(32) // random
+	body.skip(int(body.uint8()))
+	ciphers := body.vector16()
+	for ciphers.remaining() {
+		hello.cipherSuites = append(hello.cipherSuites, ciphers.uint16())
+	}
+	body.skip(int(body.uint8())) // compression methods
+	extensions := body.vector16()
+	for extensions.remaining() {
+		extension := extensions.uint16()
+		data := extensions.vector16()
+		hello.extensions = append(hello.extensions, extension)
+		switch extension {
+		case extensionServerName:
+			names := data.vector16()
+			for names.remaining() {
+				nameType, name := names.uint8(), names.vector16()
+				if nameType == 0 {
+					hello.serverName = string(name.data)
+				}
+			}
+		case extensionALPN:
+			protocols := data.vector16()
+			for protocols.remaining() {
+				hello.alpn = append(hello.alpn, string(protocols.vector8().data))
+			}
+		case extensionSupportedGroups:
+			groups := data.vector16()
+			for groups.remaining() {
+				hello.supportedGroups = append(hello.supportedGroups, groups.uint16())
+			}
+		case extensionPointFormats:
+			hello.pointFormats = data.vector8().data
+		case extensionSignatureAlgorithms:
+			algorithms := data.vector16()
+			for algorithms.remaining() {
+				hello.signatureAlgorithms = append(hello.signatureAlgorithms, algorithms.uint16())
+			}
+		case extensionSupportedVersions:
+			versions := data.vector8()
+			for versions.remaining() {
+				hello.supportedVersions = append(hello.supportedVersions, versions.uint16())
+			}
+		}
+	}
+	if body.err != nil {
+		return nil, body.err
+	}
+	return hello, nil
+}
+
+// ja3String is the comma separated version, ciphers, extensions, groups
+// and point formats (each a dash separated list of decimal values without GREASE)
+func (h *clientHello) ja3String() string {
+	var points []uint16
+	for _, point := range h.pointFormats {
+		points = append(points, uint16(point))
+	}
+	return strings.Join([]string{
+		strconv.Itoa(int(h.version)),
+		joinValues(withoutGREASE(h.cipherSuites), "-", "%d"),
+		joinValues(withoutGREASE(h.extensions), "-", "%d"),
+		joinValues(withoutGREASE(h.supportedGroups), "-", "%d"),
+		joinValues(points, "-", "%d"),
+	}, ",")
+}
+
+// ja4 is the JA4 fingerprint of the ClientHello (e.g. t13d1516h2_8daaf6152771_e5627efa2ab1)
+func (h *clientHello) ja4() string {
+	// the highest version offered in the supported_versions extension (if sent)
+	version := h.version
+	if versions := withoutGREASE(h.supportedVersions); len(versions) > 0 {
+		version = sorted(versions)[len(versions)-1]
+	}
+	sni := "i"
+	if h.serverName != "" {
+		sni = "d"
+	}
+	ciphers := withoutGREASE(h.cipherSuites)
+	extensions := withoutGREASE(h.extensions)
+
+	var hashedExtensions []uint16
+	for _, extension := range extensions {
+		if extension != extensionServerName && extension != extensionALPN {
+			hashedExtensions = append(hashedExtensions, extension)
+		}
+	}
+	extensionsHash := "000000000000"
+	if len(hashedExtensions) > 0 {
+		hashed := joinValues(sorted(hashedExtensions), ",", "%04x")
+		if len(h.signatureAlgorithms) > 0 {
+			hashed += "_" + joinValues(h.signatureAlgorithms, ",", "%04x")
+		}
+		extensionsHash = truncatedHash(hashed)
+	}
+	ciphersHash := "000000000000"
+	if len(ciphers) > 0 {
+		ciphersHash = truncatedHash(joinValues(sorted(ciphers), ",", "%04x"))
+	}
+
+	return fmt.Sprintf("t%s%s%02d%02d%s_%s_%s",
+		ja4Version(version), sni, min99(len(ciphers)), min99(len(extensions)), ja4ALPN(h.alpn),
+		ciphersHash, extensionsHash,
+	)
+}
+
+func ja4Version(version uint16) string {
+	switch version {
+	case tls.VersionTLS13:
+		return "13"
+	case tls.VersionTLS12:
+		return "12"
+	case tls.VersionTLS11:
+		return "11"
+	case tls.VersionTLS10:
+		return "10"
+	case tls.VersionSSL30:
+		return "s3"
+	default:
+		return "00"
+	}
+}
+
+// ja4ALPN is the first and last characters of the first ALPN protocol
+func ja4ALPN(protocols []string) string {
+	if len(protocols) == 0 || protocols[0] == "" {
+		return "00"
+	}
+	first, last := protocols[0][0], protocols[0][len(protocols[0])-1]
+	if !isAlphanumeric(first) || !isAlphanumeric(last) {
+		// use the first and last characters of the hex representation instead
+		encoded := hex.EncodeToString([]byte(protocols[0]))
+		return encoded[:1] + encoded[len(encoded)-1:]
+	}
+	return string([]byte{first, last})
+}
+
+func isAlphanumeric(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z'
+}
+
+func min99(n int) int {
+	if n > 99 {
+		return 99
+	}
+	return n
+}
+
+func truncatedHash(s string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(s)))[:12]
+}
+
+// GREASE values (RFC 8701) are random so must be ignored when fingerprinting
+func isGREASE(value uint16) bool {
+	return value&0x0f0f == 0x0a0a && value>>8 == value&0xff
+}
+
+func withoutGREASE(values []uint16) []uint16 {
+	var filtered []uint16
+	for _, value := range values {
+		if !isGREASE(value) {
+			filtered = append(filtered, value)
+		}
+	}
+	return filtered
+}
+
+func sorted(values []uint16) []uint16 {
+	sortedValues := append([]uint16{}, values...)
+	sort.Slice(sortedValues, func(i, j int) bool {
+		return sortedValues[i] < sortedValues[j]
+	})
+	return sortedValues
+}
+
+func joinValues(values []uint16, separator, format string) string {
+	formatted := make([]string, len(values))
+	for i, value := range values {
+		formatted[i] = fmt.Sprintf(format, value)
+	}
+	return strings.Join(formatted, separator)
+}
+
+func uint24(b []byte) uint32 {
+	return uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+}
+
+// reader reads the length prefixed fields of a handshake message.
+// Once a read fails all further reads return zero values.
+type reader struct {
+	data []byte
+	err  error
+}
+
+func (r *reader) next(n int) []byte {
+	if r.err != nil || n > len(r.data) {
+		r.err = errors.New("truncated ClientHello")
+		r.data = nil
+		return make([]byte, n)
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *reader) remaining() bool {
+	return r.err == nil && len(r.data) > 0
+}
+
+func (r *reader) skip(n int) {
+	r.next(n)
+}
+
+func (r *reader) uint8() uint8 {
+	return r.next(1)[0]
+}
+
+func (r *reader) uint16() uint16 {
+	return binary.BigEndian.Uint16(r.next(2))
+}
+
+func (r *reader) vector8() *reader {
+	return &reader{data: r.next(int(r.uint8())), err: r.err}
+}
+
+func (r *reader) vector16() *reader {
+	return &reader{data: r.next(int(r.uint16())), err: r.err}
+}
+
+var versionNames = map[uint16]string{
+	tls.VersionSSL30: "SSL 3.0",
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+func versionName(version uint16) string {
+	if name, ok := versionNames[version]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04X", version)
+}
+
+// the cipher suites that can be negotiated by crypto/tls (using their IANA names)
+var cipherSuiteNames = map[uint16]string{
+	tls.TLS_RSA_WITH_RC4_128_SHA:                "TLS_RSA_WITH_RC4_128_SHA",
+	tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA:           "TLS_RSA_WITH_3DES_EDE_CBC_SHA",
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA:            "TLS_RSA_WITH_AES_128_CBC_SHA",
+	tls.TLS_RSA_WITH_AES_256_CBC_SHA:            "TLS_RSA_WITH_AES_256_CBC_SHA",
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA256:         "TLS_RSA_WITH_AES_128_CBC_SHA256",
+	tls.TLS_RSA_WITH_AES_128_GCM_SHA256:         "TLS_RSA_WITH_AES_128_GCM_SHA256",
+	tls.TLS_RSA_WITH_AES_256_GCM_SHA384:         "TLS_RSA_WITH_AES_256_GCM_SHA384",
+	tls.TLS_ECDHE_ECDSA_WITH_RC4_128_SHA:        "TLS_ECDHE_ECDSA_WITH_RC4_128_SHA",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA:    "TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA:    "TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA",
+	tls.TLS_ECDHE_RSA_WITH_RC4_128_SHA:          "TLS_ECDHE_RSA_WITH_RC4_128_SHA",
+	tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA:     "TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA",
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA:      "TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA",
+	tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA:      "TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256: "TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256",
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256:   "TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256",
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256:   "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256: "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384:   "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384: "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305:    "TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256",
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305:  "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256",
+	tls.TLS_AES_128_GCM_SHA256:                  "TLS_AES_128_GCM_SHA256",
+	tls.TLS_AES_256_GCM_SHA384:                  "TLS_AES_256_GCM_SHA384",
+	tls.TLS_CHACHA20_POLY1305_SHA256:            "TLS_CHACHA20_POLY1305_SHA256",
+}
+
+func cipherSuiteName(id uint16) string {
+	if name, ok := cipherSuiteNames[id]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04X", id)
+}
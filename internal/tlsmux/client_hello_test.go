@@ -0,0 +1,104 @@
+package tlsmux
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/bradleyjkemp/grpc-tools/internal/connstate"
+	"github.com/bradleyjkemp/grpc-tools/testutils"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJA4(t *testing.T) {
+	// the example from the JA4 specification (a Chrome ClientHello with GREASE values added)
+	hello := &clientHello{
+		version:           tls.VersionTLS12,
+		supportedVersions: []uint16{0x0a0a, tls.VersionTLS13, tls.VersionTLS12},
+		serverName:        "example.com",
+		alpn:              []string{"h2", "http/1.1"},
+		cipherSuites: []uint16{
+			0x1a1a, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030, 0xcca9,
+			0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035,
+		},
+		extensions: []uint16{
+			0x2a2a, 0x0000, 0x0017, 0xff01, 0x000a, 0x000b, 0x0023, 0x0010, 0x0005,
+			0x000d, 0x0012, 0x0033, 0x002d, 0x002b, 0x001b, 0x4469, 0x0015,
+		},
+		signatureAlgorithms: []uint16{0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601},
+	}
+	require.Equal(t, "t13d1516h2_8daaf6152771_e5627efa2ab1", hello.ja4())
+	require.True(t, strings.HasPrefix(hello.ja3String(), "771,4865-4866-4867-"), hello.ja3String())
+
+	require.Equal(t, "00", ja4ALPN(nil))
+	require.Equal(t, "h1", ja4ALPN([]string{"http/1.1"}))
+	require.Equal(t, "ab", ja4ALPN([]string{"\xab"}))
+}
+
+func TestParseClientHello(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		_ = tls.Client(client, &tls.Config{ServerName: "api.example.com", NextProtos: []string{"h2"}}).Handshake()
+	}()
+	// the ClientHello is sent in a single write
+	recorded := make([]byte, maxClientHelloSize)
+	n, err := server.Read(recorded)
+	require.NoError(t, err)
+	_ = client.Close()
+
+	hello, err := parseClientHello(recorded[:n])
+	require.NoError(t, err)
+	require.Equal(t, "api.example.com", hello.serverName)
+	require.Equal(t, []string{"h2"}, hello.alpn)
+	require.Contains(t, hello.supportedVersions, uint16(tls.VersionTLS13))
+	require.NotEmpty(t, hello.cipherSuites)
+	require.True(t, strings.HasPrefix(hello.ja4(), "t13d"), hello.ja4())
+
+	_, err = parseClientHello(recorded[:n/2])
+	require.Error(t, err, "truncated ClientHello should fail to parse")
+	_, err = parseClientHello([]byte("GET / HTTP/1.1\r\n"))
+	require.Error(t, err)
+}
+
+func TestHandshakeCapture(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	cert, err := testutils.NewSelfSignedKeyPair()
+	require.NoError(t, err)
+	_, tlsListener := New(logrus.New(), ln, func(string) (*tls.Certificate, error) {
+		return &cert, nil
+	}, &tls.Config{})
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := tlsListener.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	client, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+		ServerName:         "api.example.com",
+		NextProtos:         []string{"h2"},
+		InsecureSkipVerify: true,
+	})
+	require.NoError(t, err)
+	conn := <-accepted
+
+	state := connstate.FromConn(conn)
+	require.NotNil(t, state)
+	handshake := state.TLS
+	require.NotNil(t, handshake)
+	require.Equal(t, "api.example.com", handshake.ServerName)
+	require.Equal(t, []string{"h2"}, handshake.ALPN)
+	require.Equal(t, "h2", handshake.NegotiatedProtocol)
+	require.Equal(t, "TLS 1.3", handshake.Version)
+	require.NotEmpty(t, handshake.CipherSuite)
+	require.Len(t, handshake.JA3, 32)
+	require.True(t, strings.HasPrefix(handshake.JA4, "t13d"), handshake.JA4)
+	require.NoError(t, client.Close())
+	require.NoError(t, conn.Close())
+}
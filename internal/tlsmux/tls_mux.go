@@ -1,13 +1,19 @@
 package tlsmux
 
 import (
+	"context"
 	"crypto/tls"
 	"net"
 	"regexp"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/bradleyjkemp/grpc-tools/internal"
+	"github.com/bradleyjkemp/grpc-tools/internal/connlog"
+	"github.com/bradleyjkemp/grpc-tools/internal/connstate"
 	"github.com/bradleyjkemp/grpc-tools/internal/peekconn"
+	"github.com/bradleyjkemp/grpc-tools/internal/proxydialer"
 	"github.com/sirupsen/logrus"
 )
 
@@ -22,6 +28,10 @@ const (
 
 type CertificateGeter = func(serverName string) (*tls.Certificate, error)
 
+// Dialer connects to the destination of connections that are passed through
+// rather than intercepted (e.g. through the same upstream proxy as intercepted requests)
+type Dialer = func(ctx context.Context, destination string) (net.Conn, error)
+
 type tlsMuxListener struct {
 	net.Listener
 	close *sync.Once
@@ -46,7 +56,59 @@ func (c *tlsMuxListener) Close() error {
 	return err
 }
 
-func New(logger logrus.FieldLogger, listener net.Listener, getCert CertificateGeter, tlsConfig tls.Config) (net.Listener, net.Listener) {
+// Policy restricts the connections accepted directly from the listener.
+// Connections tunnelled through the proxy (e.g. using HTTP CONNECT)
+// are always accepted.
+type Policy int
+
+const (
+	AllowBoth Policy = iota
+	TLSOnly
+	PlaintextOnly
+)
+
+func (p Policy) allows(isTLS bool) bool {
+	switch p {
+	case TLSOnly:
+		return isTLS
+	case PlaintextOnly:
+		return !isTLS
+	default:
+		return true
+	}
+}
+
+// Interception decides which TLS connections tunnelled to a destination are intercepted
+// (the rest are forwarded to the destination untouched)
+type Interception interface {
+	// Intercept is called with the client and destination (host:port) of each tunnelled TLS connection
+	Intercept(client net.Addr, destination string) bool
+	// Rejected is called when the client fails the handshake of an intercepted connection
+	// (e.g. because it doesn't trust our certificate or pins the destination's)
+	Rejected(client net.Addr, destination string, err error)
+}
+
+// the time allowed for clients to complete the TLS handshake
+const handshakeTimeout = 30 * time.Second
+
+func New(logger logrus.FieldLogger, listener net.Listener, getCert CertificateGeter, tlsConfig *tls.Config) (net.Listener, net.Listener) {
+	return NewWithPolicy(logger, listener, getCert, tlsConfig, AllowBoth, nil, nil)
+}
+
+// NewWithPolicy is like New but closes any connections not allowed by the policy,
+// only intercepts the TLS connections chosen by interception (all if nil) and
+// connects to the destinations of the rest using dial (directly if nil)
+func NewWithPolicy(logger logrus.FieldLogger, listener net.Listener, getCert CertificateGeter, tlsConfig *tls.Config, policy Policy, interception Interception, dial Dialer) (net.Listener, net.Listener) {
+	if dial == nil {
+		dial = proxydialer.DialTarget
+	}
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.GetCertificate = func(clientHello *tls.ClientHelloInfo) (cert *tls.Certificate, err error) {
+		return getCert(clientHello.ServerName)
+	}
+	// Support HTTP/2: https://golang.org/pkg/net/http/?m=all#Serve
+	tlsConfig.NextProtos = append(tlsConfig.NextProtos, http2NextProtoTLS)
+
 	var nonTLSConns = make(chan net.Conn, 128) // TODO decide on good buffer sizes for these channels
 	var nonTLSErrs = make(chan error, 128)
 	var tlsConns = make(chan net.Conn, 128)
@@ -57,7 +119,11 @@ func New(logger logrus.FieldLogger, listener net.Listener, getCert CertificateGe
 			if err != nil {
 				nonTLSErrs <- err
 				tlsErrs <- err
-				continue
+				if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+					continue
+				}
+				// the listener has been closed
+				return
 			}
 
 			go func() {
@@ -65,11 +131,18 @@ func New(logger logrus.FieldLogger, listener net.Listener, getCert CertificateGe
 
 				isTLS, err := conn.PeekMatch(tlsPattern, tlsPeekSize)
 				if err != nil {
-					nonTLSErrs <- err
-					tlsErrs <- err
+					// only this connection is affected so don't return the error from the listeners
+					logger.WithError(err).Debugf("Failed peeking connection from %v", rawConn.RemoteAddr())
+					_ = conn.Close()
+					return
+				}
+				if !policy.allows(isTLS) && !tunnelled(conn) {
+					logger.Debugf("Rejecting connection from %v (TLS: %v) not allowed on this listener", rawConn.RemoteAddr(), isTLS)
+					_ = conn.Close()
+					return
 				}
 				if isTLS {
-					handleTLSConn(logger, conn, getCert, tlsConns)
+					handleTLSConn(logger, conn, getCert, tlsConfig, interception, dial, tlsConns)
 				} else {
 					nonTLSConns <- conn
 				}
@@ -84,59 +157,62 @@ func New(logger logrus.FieldLogger, listener net.Listener, getCert CertificateGe
 			Listener: listener,
 			close:    closer,
 			conns:    nonTLSConns,
+			errs:     nonTLSErrs,
 		},
 		false,
+		dial,
 	}
 
-	tlsConfig.GetCertificate = func(clientHello *tls.ClientHelloInfo) (cert *tls.Certificate, err error) {
-		return getCert(clientHello.ServerName)
-	}
-	// Support HTTP/2: https://golang.org/pkg/net/http/?m=all#Serve
-	tlsConfig.NextProtos = append(tlsConfig.NextProtos, http2NextProtoTLS)
+	// connections are passed on once the TLS handshake has completed
 	tlsListener := nonHTTPBouncer{
 		logger,
-		tls.NewListener(&tlsMuxListener{
+		&tlsMuxListener{
 			Listener: listener,
 			close:    closer,
 			conns:    tlsConns,
-		}, &tlsConfig),
+			errs:     tlsErrs,
+		},
 		true,
+		dial,
 	}
 	return nonTLSListener, tlsListener
 }
 
-func handleTLSConn(logger logrus.FieldLogger, conn net.Conn, getCert CertificateGeter, tlsConns chan net.Conn) {
+func handleTLSConn(logger logrus.FieldLogger, conn net.Conn, getCert CertificateGeter, tlsConfig *tls.Config, interception Interception, dial Dialer, tlsConns chan net.Conn) {
 	logger.Debugf("Handling TLS connection %v", conn.RemoteAddr())
 
-	proxConn, ok := conn.(proxiedConnection)
-	if !ok {
-		tlsConns <- conn
-		return
-	}
-
-	if proxConn.OriginalDestination() == "" {
+	destination := originalDestination(conn)
+	if destination == "" {
 		logger.Debug("Connection has no original destination so must intercept")
 		// cannot be forwarded so must accept regardless of whether we are able to intercept
-		tlsConns <- conn
+		intercept(logger, conn, tlsConfig, "", nil, tlsConns)
 		return
 	}
-
-	logger.Debugf("Got TLS connection for destination %s", proxConn.OriginalDestination())
+	logger.Debugf("Got TLS connection for destination %s", destination)
 
 	// trim the port suffix
-	originalHostname := strings.Split(proxConn.OriginalDestination(), ":")[0]
-	if getCert != nil {
+	originalHostname := strings.Split(destination, ":")[0]
+	reason := "no certificate"
+	if interception != nil && !interception.Intercept(conn.RemoteAddr(), destination) {
+		logger.Debugf("Interception policy excludes %s, proxying instead.", destination)
+		reason = "interception policy"
+	} else if getCert != nil {
 		cert, err := getCert(originalHostname)
 		if err == nil && cert != nil {
 			// the certificate we have allows us to intercept this connection
-			tlsConns <- conn
+			intercept(logger, conn, tlsConfig, destination, interception, tlsConns)
 			return
 		}
+		logger.Debugf("No certificate able to intercept connections to %s, proxying instead.", originalHostname)
 	}
+	connlog.Log(conn, &internal.ConnectionEvent{
+		Event:       internal.ConnectionTunnelled,
+		Destination: destination,
+		Reason:      reason,
+	})
 
-	// cannot intercept so will just transparently proxy instead
-	logger.Debugf("No certificate able to intercept connections to %s, proxying instead.", originalHostname)
-	destConn, err := net.Dial(conn.LocalAddr().Network(), proxConn.OriginalDestination())
+	// cannot (or should not) intercept so will just transparently proxy instead
+	destConn, err := dial(context.Background(), destination)
 	if err != nil {
 		logger.WithError(err).Debugf("Failed proxying connection to %s, Error while dialing.", originalHostname)
 		_ = conn.Close()
@@ -151,6 +227,37 @@ func handleTLSConn(logger logrus.FieldLogger, conn net.Conn, getCert Certificate
 	}
 }
 
+// intercept completes the TLS handshake (using our certificate) before
+// passing the connection on so that clients rejecting it can be detected
+// and the ClientHello recorded
+func intercept(logger logrus.FieldLogger, conn net.Conn, tlsConfig *tls.Config, destination string, interception Interception, tlsConns chan net.Conn) {
+	// the handshake is recorded in the connection's state
+	conn, _ = connstate.New(conn)
+	recorder := newRecordingConn(conn)
+	tlsConn := tls.Server(recorder, tlsConfig)
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		logger.WithError(err).Debugf("TLS handshake with %v failed", conn.RemoteAddr())
+		connlog.Log(conn, &internal.ConnectionEvent{
+			Event:       internal.ConnectionTLSFailed,
+			Destination: destination,
+			Error:       err.Error(),
+		})
+		if interception != nil && destination != "" {
+			interception.Rejected(conn.RemoteAddr(), destination, err)
+		}
+		_ = conn.Close()
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+	recordHandshake(recorder, tlsConn.ConnectionState())
+	connlog.Log(conn, &internal.ConnectionEvent{
+		Event:       internal.ConnectionIntercepted,
+		Destination: destination,
+	})
+	tlsConns <- tlsConn
+}
+
 var (
 	tlsPattern  = regexp.MustCompile(`^\x16\x03[\x00-\x03]`) // TLS handshake byte + version number
 	tlsPeekSize = 3
@@ -163,7 +270,8 @@ var (
 type nonHTTPBouncer struct {
 	logger logrus.FieldLogger
 	net.Listener
-	tls bool
+	tls  bool
+	dial Dialer
 }
 
 var (
@@ -172,8 +280,30 @@ var (
 	httpPattern = regexp.MustCompile(`^(CONNECT)|(POST)|(PRI) `)
 )
 
-type proxiedConnection interface {
-	OriginalDestination() string
+// serverName is the name to verify the certificate of a destination against
+func serverName(destination string) string {
+	if proxydialer.IsUnixTarget(destination) {
+		return "localhost"
+	}
+	host, _, err := net.SplitHostPort(destination)
+	if err != nil {
+		return destination
+	}
+	return host
+}
+
+// originalDestination is the address a tunnelled or transparently
+// redirected connection was made to ("" for direct connections)
+func originalDestination(conn net.Conn) string {
+	if state := connstate.FromConn(conn); state != nil {
+		return state.Destination
+	}
+	return ""
+}
+
+func tunnelled(conn net.Conn) bool {
+	state := connstate.FromConn(conn)
+	return state != nil && state.Tunnelled
 }
 
 func (b nonHTTPBouncer) Accept() (net.Conn, error) {
@@ -182,8 +312,8 @@ func (b nonHTTPBouncer) Accept() (net.Conn, error) {
 		return nil, err
 	}
 
-	proxConn, ok := conn.(proxiedConnection)
-	if !ok || proxConn.OriginalDestination() == "" {
+	destination := originalDestination(conn)
+	if destination == "" {
 		// unknown (direct?) connection, must handle it ourselves
 		return conn, nil
 	}
@@ -197,23 +327,29 @@ func (b nonHTTPBouncer) Accept() (net.Conn, error) {
 		// this is a connection we want to handle
 		return peekedConn, nil
 	}
-	b.logger.Debugf("Bouncing non-HTTP connection to destination %s", proxConn.OriginalDestination())
+	b.logger.Debugf("Bouncing non-HTTP connection to destination %s", destination)
+	connlog.Log(conn, &internal.ConnectionEvent{
+		Event:       internal.ConnectionBounced,
+		Destination: destination,
+	})
 
 	// proxy this connection without interception
 	go func() {
-		destination := proxConn.OriginalDestination()
-		var destConn net.Conn
-		if b.tls {
-			destConn, err = tls.Dial(conn.LocalAddr().Network(), destination, nil)
-		} else {
-			destConn, err = net.Dial(conn.LocalAddr().Network(), destination)
+		destConn, err := b.dial(context.Background(), destination)
+		if err == nil && b.tls {
+			tlsConn := tls.Client(destConn, &tls.Config{ServerName: serverName(destination)})
+			if err = tlsConn.Handshake(); err != nil {
+				_ = destConn.Close()
+			}
+			destConn = tlsConn
 		}
 		if err != nil {
 			b.logger.WithError(err).Warnf("Error proxying connection to %s.", destination)
+			_ = peekedConn.Close()
 			return
 		}
 
-		err := forwardConnection(
+		err = forwardConnection(
 			peekedConn,
 			destConn,
 		)